@@ -0,0 +1,221 @@
+package udpnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	// timeRequestSize is the size of a time request body, the client time
+	// it was sent at.
+	timeRequestSize = 8
+
+	// timeResponseSize is the size of a time response body, the client time
+	// of the request then the server times it was received and answered.
+	timeResponseSize = 3 * 8
+
+	// clockSamples is the number of time samples the clock offset and drift
+	// are estimated from.
+	clockSamples = 16
+
+	// minDriftSamples is the number of samples from which the drift is
+	// estimated.
+	minDriftSamples = 4
+
+	// defaultTimeSyncInterval is the default interval between two time
+	// requests, 0 disables them.
+	defaultTimeSyncInterval = 250 * time.Millisecond
+)
+
+// clockSample is the result of a time request.
+type clockSample struct {
+	local  time.Duration // client time the response was received at
+	offset time.Duration // server time minus client time
+	rtt    time.Duration // round trip time, without the server processing time
+}
+
+// clockSync estimates, on a client, the offset and drift of the server clock
+// from time requests, NTP-like.
+//
+// Each request gives an offset, exact if the packets took as long on both
+// ways. Samples with a high round trip time are the most likely to be
+// asymmetric, only the half with the lowest round trip times are kept. The
+// offset and drift are then the least squares fit of their offsets over the
+// client time. Old samples are replaced by new ones, so the estimation
+// follows the round trip time changes.
+type clockSync struct {
+	samples  []clockSample // last samples, oldest first
+	offset   time.Duration // estimated offset at base
+	drift    float64       // estimated server clock drift, in seconds per second
+	base     time.Duration // client time of the estimation
+	request  time.Duration // time left before the next request
+	interval time.Duration
+}
+
+func (cs *clockSync) reset() {
+	cs.samples = nil
+	cs.offset = 0
+	cs.drift = 0
+	cs.base = 0
+	cs.request = 0
+}
+
+// addSample adds a sample and estimates the offset and drift again.
+func (cs *clockSync) addSample(s clockSample) {
+	if len(cs.samples) == clockSamples {
+		copy(cs.samples, cs.samples[1:])
+		cs.samples = cs.samples[:clockSamples-1]
+	}
+	cs.samples = append(cs.samples, s)
+
+	// reject the samples with the highest round trip times
+	kept := append([]clockSample(nil), cs.samples...)
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].rtt < kept[j].rtt })
+	kept = kept[:(len(kept)+1)/2]
+
+	var meanLocal, meanOffset float64
+	for _, k := range kept {
+		meanLocal += float64(k.local)
+		meanOffset += float64(k.offset)
+	}
+	meanLocal /= float64(len(kept))
+	meanOffset /= float64(len(kept))
+
+	cs.drift = 0
+	if len(cs.samples) >= minDriftSamples {
+		var covariance, variance float64
+		for _, k := range kept {
+			dl := float64(k.local) - meanLocal
+			covariance += dl * (float64(k.offset) - meanOffset)
+			variance += dl * dl
+		}
+		if variance > 0 {
+			cs.drift = covariance / variance
+		}
+	}
+	cs.base = time.Duration(meanLocal)
+	cs.offset = time.Duration(meanOffset)
+}
+
+// at returns the estimated offset at client time local.
+func (cs *clockSync) at(local time.Duration) time.Duration {
+	return cs.offset + time.Duration(cs.drift*float64(local-cs.base))
+}
+
+// LocalTime returns the time elapsed on the connection clock, the sum of the
+// durations given to Update since the connection started.
+func (c *Conn) LocalTime() time.Duration {
+	return c.clock
+}
+
+// ServerTime returns the time of the server clock, the monotonic time since
+// the server connection started. On a client it is estimated from the time
+// requests sent to the server, and is the monotonic time since the client
+// started until the first response. Server and clients share the server
+// timeline. Time requests are only sent with the handshake, see SetHandshake:
+// without it, a client returns its own monotonic time.
+func (c *Conn) ServerTime() time.Duration {
+	now := c.now()
+	if c.mode != Client {
+		return now
+	}
+	return now + c.clockSync.at(now)
+}
+
+// IsClockSynced indicates if a client received answers to its time requests.
+// It is always false without the handshake.
+func (c *Conn) IsClockSynced() bool {
+	return c.mode == Client && len(c.clockSync.samples) > 0
+}
+
+// ClockOffset returns the estimated offset of the server clock to the client
+// clock, at the current time.
+func (c *Conn) ClockOffset() time.Duration {
+	if c.mode != Client {
+		return 0
+	}
+	return c.clockSync.at(c.now())
+}
+
+// ClockDrift returns the estimated drift of the server clock relative to the
+// client clock, in seconds per second. The drift is positive when the server
+// clock runs faster.
+func (c *Conn) ClockDrift() float64 {
+	return c.clockSync.drift
+}
+
+// SetTimeSyncInterval sets the interval between two time requests sent by a
+// client, 250 milliseconds by default. 0 disables the time requests. Time
+// requests require the handshake, so a positive interval is an error on a
+// connection without it.
+func (c *Conn) SetTimeSyncInterval(interval time.Duration) error {
+	if interval < 0 {
+		return errors.New("time sync interval can't be negative")
+	}
+	if interval > 0 && !c.handshake {
+		return errors.New("time sync requires the handshake")
+	}
+	c.clockSync.interval = interval
+	return nil
+}
+
+// updateClockSync sends the time requests of a connected client.
+func (c *Conn) updateClockSync(dt time.Duration) {
+	cs := &c.clockSync
+	if cs.interval == 0 {
+		return
+	}
+	cs.request -= dt
+	if cs.request > 0 {
+		return
+	}
+	cs.request = cs.interval
+	c.sendPacket(c.address, timeRequestPacket, appendUint64(nil, uint64(c.now())), c.session)
+}
+
+// processTimeRequest answers, on a server, the time request of a client.
+func (c *Conn) processTimeRequest(sender *net.UDPAddr, body []byte) {
+	if c.mode != Server {
+		return
+	}
+	received := c.now()
+	p, request, _ := c.openPeerPacket(timeRequestPacket, body)
+	if p == nil || p.suspended || !sameAddress(sender, p.address) || len(request) != timeRequestSize {
+		return
+	}
+	response := append([]byte(nil), request...)
+	response = appendUint64(response, uint64(received))
+	response = appendUint64(response, uint64(c.now()))
+	c.sendPacket(p.address, timeResponsePacket, response, p.session)
+}
+
+// processTimeResponse adds, on a client, the sample given by a time response.
+func (c *Conn) processTimeResponse(sender *net.UDPAddr, body []byte) {
+	if c.mode != Client || c.state != connected || !sameAddress(sender, c.address) {
+		return
+	}
+	t3 := c.now()
+	if c.session != nil {
+		var ok bool
+		if body, ok = c.session.open(c.additionalData(timeResponsePacket), body); !ok {
+			return
+		}
+	}
+	if len(body) != timeResponseSize {
+		return
+	}
+	t0 := time.Duration(binary.BigEndian.Uint64(body))
+	t1 := time.Duration(binary.BigEndian.Uint64(body[8:]))
+	t2 := time.Duration(binary.BigEndian.Uint64(body[16:]))
+	if t0 > t3 || t1 > t2 {
+		return
+	}
+	c.clockSync.addSample(clockSample{
+		local:  t3,
+		offset: ((t1 - t0) + (t2 - t3)) / 2,
+		rtt:    (t3 - t0) - (t2 - t1),
+	})
+}
@@ -0,0 +1,145 @@
+package udpnet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClockSyncOutliers(t *testing.T) {
+	const Offset = time.Duration(500) * time.Millisecond
+
+	var cs clockSync
+	for i := 0; i < clockSamples; i++ {
+		local := time.Duration(i) * 100 * time.Millisecond
+		s := clockSample{local: local, offset: Offset, rtt: 20 * time.Millisecond}
+		if i%3 == 0 {
+			// delayed response: high rtt and skewed offset
+			s.offset -= 80 * time.Millisecond
+			s.rtt = 180 * time.Millisecond
+		}
+		cs.addSample(s)
+	}
+	assert.Equal(t, Offset, cs.at(time.Second), "outliers should be rejected")
+	assert.InDelta(t, 0, cs.drift, 1e-9)
+
+	t.Logf("check drift estimation\n")
+	cs.reset()
+	for i := 0; i < clockSamples; i++ {
+		local := time.Duration(i) * 100 * time.Millisecond
+		cs.addSample(clockSample{local: local, offset: Offset + local/100, rtt: 20 * time.Millisecond})
+	}
+	assert.InDelta(t, 0.01, cs.drift, 1e-6)
+	assert.InDelta(t, float64(Offset+20*time.Millisecond), float64(cs.at(2*time.Second)), float64(time.Microsecond))
+
+	t.Logf("check old samples are replaced\n")
+	for i := 0; i < clockSamples; i++ {
+		local := time.Duration(clockSamples+i) * 100 * time.Millisecond
+		cs.addSample(clockSample{local: local, offset: 2 * Offset, rtt: 50 * time.Millisecond})
+	}
+	assert.Equal(t, 2*Offset, cs.at(5*time.Second), "estimation should follow the new samples")
+}
+
+func TestReliableConnectionClockSync(t *testing.T) {
+	const (
+		DeltaTime  = time.Millisecond
+		ServerTime = time.Duration(1100) * time.Microsecond // server clock runs 10% faster
+		TimeOut    = time.Second
+	)
+
+	// the connections sample simulated monotonic clocks
+	var clientClock, serverClock time.Duration
+	server := NewReliableConn(protocolID, TimeOut, maxSequence)
+	server.SetHandshake(true)
+	server.now = func() time.Duration { return serverClock }
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+	server.Listen()
+	for i := 0; i < 500; i++ {
+		server.Update(ServerTime)
+		serverClock += ServerTime
+	}
+
+	client := NewReliableConn(protocolID, TimeOut, maxSequence)
+	client.SetHandshake(true)
+	client.now = func() time.Duration { return clientClock }
+	require.True(t, client.Start(clientPort), "couldn't start client connection")
+	defer client.Stop()
+	require.NoError(t, client.SetTimeSyncInterval(10*time.Millisecond))
+	assert.Error(t, client.SetTimeSyncInterval(-1))
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	client.Connect(sAddr)
+	assert.False(t, client.IsClockSynced())
+	assert.Equal(t, clientClock, client.ServerTime(), "server time should be the local time until synced")
+
+	for i := 0; i < 1000 && len(client.clockSync.samples) < clockSamples; i++ {
+		for _, c := range []*ReliableConn{client, server} {
+			for {
+				var packet [256]byte
+				if c.ReceivePacket(packet[:]) == 0 {
+					break
+				}
+			}
+		}
+		client.Update(DeltaTime)
+		server.Update(ServerTime)
+		clientClock += DeltaTime
+		serverClock += ServerTime
+	}
+	require.True(t, client.IsClockSynced(), "client clock should be synced")
+	assert.False(t, server.IsClockSynced())
+	assert.Equal(t, serverClock, server.ServerTime())
+
+	diff := client.ServerTime() - server.ServerTime()
+	assert.True(t, diff > -5*time.Millisecond && diff < 5*time.Millisecond,
+		"client estimation should be close to the server time")
+	assert.True(t, client.ClockOffset() > 500*time.Millisecond, "offset should cover the server head start")
+	assert.InDelta(t, 0.1, client.ClockDrift(), 0.03)
+}
+
+func TestConnectionClockSyncMonotonic(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Second
+	)
+
+	server := NewConn(dummyCallback{}, protocolID, TimeOut)
+	server.SetHandshake(true)
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+	server.Listen()
+
+	client := NewConn(dummyCallback{}, protocolID, TimeOut)
+	assert.Error(t, client.SetTimeSyncInterval(10*time.Millisecond), "time sync should require the handshake")
+	assert.NoError(t, client.SetTimeSyncInterval(0))
+	client.SetHandshake(true)
+	require.True(t, client.Start(clientPort), "couldn't start client connection")
+	defer client.Stop()
+	require.NoError(t, client.SetTimeSyncInterval(0))
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	client.Connect(sAddr)
+
+	t.Logf("check the server time follows the monotonic clock, not Update\n")
+	before := server.ServerTime()
+	time.Sleep(2 * time.Millisecond)
+	assert.True(t, server.ServerTime()-before >= 2*time.Millisecond, "server time should advance without Update")
+	assert.Equal(t, time.Duration(0), server.LocalTime())
+
+	t.Logf("check a zero interval disables the time requests\n")
+	updateConns(DeltaTime, 1000, client.IsConnected, nil, client, server)
+	require.True(t, client.IsConnected(), "client should be connected")
+	updateConns(DeltaTime, 100, func() bool { return false }, nil, client, server)
+	assert.False(t, client.IsClockSynced(), "client should not send time requests")
+
+	t.Logf("check the client estimates the server monotonic clock\n")
+	require.NoError(t, client.SetTimeSyncInterval(10*time.Millisecond))
+	updateConns(DeltaTime, 1000, client.IsClockSynced, nil, client, server)
+	require.True(t, client.IsClockSynced(), "client clock should be synced")
+	diff := client.ServerTime() - server.ServerTime()
+	assert.True(t, diff > -5*time.Millisecond && diff < 5*time.Millisecond,
+		"client estimation should be close to the server time")
+}
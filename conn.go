@@ -1,8 +1,10 @@
 package udpnet
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"net"
 	"time"
 )
@@ -31,6 +33,20 @@ const (
 	Server
 )
 
+// Framing indicates how a connection identifies its own packets, valid
+// framings are ProtocolIDFraming and ChecksumFraming.
+type Framing int
+
+const (
+	// ProtocolIDFraming prefixes each packet with the protocol id.
+	ProtocolIDFraming Framing = iota
+
+	// ChecksumFraming prefixes each packet with the CRC32 of the protocol id
+	// followed by the payload. The protocol id is not sent on the wire and
+	// corrupted packets are rejected.
+	ChecksumFraming
+)
+
 type connState int
 
 const (
@@ -39,19 +55,51 @@ const (
 	connecting
 	connectFail
 	connected
+	resuming
 )
 
 // Conn represents a Connection between two distant parties.
 type Conn struct {
 	protocolID         uint
+	framing            Framing
+	handshake          bool
 	timeout            time.Duration
 	running            bool
 	mode               ConnMode
 	state              connState
-	socket             Socket
+	transport          Transport
 	timeoutAccumulator time.Duration
 	address            *net.UDPAddr
 	cb                 ConnCallback
+
+	privateKey         *Key                            // server: key shared with the token issuer, enables secure joins
+	token              *ConnectToken                   // client: token presented to the servers
+	tokenServer        int                             // client: index of the token server being connected to
+	session            *session                        // keys and sequence of the secure session, if any
+	pending            map[string]*session             // server: handshakes waiting for a challenge response, by address
+	usedTokens         map[string]usedToken            // server: connect tokens already presented, by token tag
+	budgets            map[string]*amplificationBudget // server: bytes exchanged with unverified addresses
+	requestAccumulator time.Duration                   // client: time left before sending the next connection request
+	guard              floodGuard                      // server: per-IP rate limits, bans and drop counters
+	denyReason         DenyReason                      // client: reason given by the server that denied the connection
+	clientID           uint64                          // client: id assigned by the server
+	sessionID          uint64                          // client: id identifying the client packets, assigned by the server
+	maxClients         int                             // server: number of client slots
+	peers              []*peer                         // server: connected clients, by slot
+	nextClientID       uint64                          // server: last id assigned to a client joining without token
+	lastSlot           int                             // slot of the client that sent the last received payload
+	minVersion         uint16                          // lowest protocol version supported
+	maxVersion         uint16                          // highest protocol version supported
+	features           uint32                          // feature flags supported
+	negotiated         negotiation                     // client: version and features agreed on with the server
+	resumeGrace        time.Duration                   // server: time the session of a client that timed out is kept
+	resumeTicket       []byte                          // client: ticket resuming the session
+	ticketGrace        time.Duration                   // client: time the server keeps the session after a timeout
+	resumeLeft         time.Duration                   // client: time left to resume the session
+	clock              time.Duration                   // time elapsed in Update since the connection started
+	start              time.Time                       // time the connection started
+	now                func() time.Duration            // monotonic time since the connection started, sampled by clock sync
+	clockSync          clockSync                       // client: server clock estimation
 }
 
 // NewConn returns a new connection using given protocol id and timeout.
@@ -63,27 +111,61 @@ func NewConn(cb ConnCallback, protocolID uint, timeout time.Duration) *Conn {
 		running:    false,
 		cb:         cb,
 	}
-	c.clearData()
+	c.init()
 	return c
 }
 
+func (c *Conn) init() {
+	c.pending = make(map[string]*session)
+	c.usedTokens = make(map[string]usedToken)
+	c.budgets = make(map[string]*amplificationBudget)
+	c.maxClients = 1
+	c.clockSync.interval = defaultTimeSyncInterval
+	c.now = func() time.Duration { return time.Since(c.start) }
+	c.clearData()
+}
+
 // Start initiates the connection on given port
 func (c *Conn) Start(port int) bool {
 	fmt.Printf("start connection on port %d\n", port)
-	if err := c.socket.Open(port); err != nil {
+	var socket Socket
+	if err := socket.Open(port); err != nil {
+		return false
+	}
+	return c.StartTransport(&socket)
+}
+
+// StartAddr initiates the connection on given local address, for example
+// the unspecified address to be reachable on all the local addresses.
+func (c *Conn) StartAddr(addr *net.UDPAddr) bool {
+	fmt.Printf("start connection on %v\n", addr)
+	var socket Socket
+	if err := socket.OpenAddr(addr); err != nil {
 		return false
 	}
+	return c.StartTransport(&socket)
+}
+
+// StartTransport initiates the connection on given transport, for example a
+// transport of a MemNetwork. The connection closes it when it stops.
+func (c *Conn) StartTransport(transport Transport) bool {
+	c.transport = transport
 	c.running = true
+	c.clock = 0
+	c.start = time.Now()
 	c.cb.OnStart()
 	return true
 }
 
-// Stop immediately stops the connection and closes the underlying socket.
+// Stop immediately stops the connection and closes the underlying transport.
 func (c *Conn) Stop() {
 	fmt.Printf("stop connection\n")
 	connected := c.IsConnected()
 	c.clearData()
-	c.socket.Close()
+	if c.transport != nil {
+		c.transport.Close()
+		c.transport = nil
+	}
 	c.running = false
 	if connected {
 		c.cb.OnDisconnect()
@@ -120,6 +202,9 @@ func (c *Conn) Connect(address *net.UDPAddr) {
 	c.mode = Client
 	c.state = connecting
 	c.address = address
+	c.token = nil
+	c.tokenServer = 0
+	c.denyReason = DenyNone
 }
 
 // IsConnecting indicates if the connection is currently trying to connect.
@@ -142,6 +227,33 @@ func (c *Conn) IsListening() bool {
 	return c.state == listening
 }
 
+// SetHandshake enables the connection handshake, disabled by default. With
+// the handshake, packets carry their type and clients join by sending
+// connection requests the server accepts or denies. It is required by secure
+// joins, version negotiation, session ids, resumption and clock sync, and is
+// enabled by SetPrivateKey and ConnectWithToken. Without it, a server
+// connects the clients as their first packet arrives and a client connects
+// when the server answers. Both ends of the connection must agree.
+func (c *Conn) SetHandshake(enabled bool) {
+	c.handshake = enabled
+}
+
+// Handshake indicates if the connection handshake is enabled.
+func (c *Conn) Handshake() bool {
+	return c.handshake
+}
+
+// SetFraming sets the packet framing, both ends of the connection must use
+// the same framing.
+func (c *Conn) SetFraming(framing Framing) {
+	c.framing = framing
+}
+
+// Framing returns the packet framing.
+func (c *Conn) Framing() Framing {
+	return c.framing
+}
+
 // Mode returns the current connection mode.
 func (c *Conn) Mode() ConnMode {
 	return c.mode
@@ -149,14 +261,39 @@ func (c *Conn) Mode() ConnMode {
 
 // Update updates the connection underlying state, reagarding elapsed time.
 func (c *Conn) Update(dt time.Duration) {
+	c.clock += dt
+	if c.state == connecting && c.handshake {
+		if c.requestAccumulator <= 0 {
+			c.sendConnectionRequest()
+			c.requestAccumulator = connectRequestInterval
+		}
+		c.requestAccumulator -= dt
+	}
+	c.updateHandshakes(dt)
+	c.guard.update(dt)
+
+	if c.mode == Server {
+		c.updatePeers(dt)
+		return
+	}
+	if c.state == resuming {
+		c.updateResume(dt)
+		return
+	}
+	if c.state == connected && c.handshake {
+		c.updateClockSync(dt)
+	}
+
 	c.timeoutAccumulator += dt
 	if c.timeoutAccumulator > c.timeout {
-		if c.state == connecting {
+		if c.state == connecting && c.nextServer() {
+			fmt.Printf("connect timed out, trying next server %v\n", c.address.String())
+		} else if c.state == connecting {
 			fmt.Printf("connect timed out\n")
 			c.clearData()
 			c.state = connectFail
 			c.cb.OnDisconnect()
-		} else if c.state == connected {
+		} else if c.state == connected && !c.suspend() {
 			fmt.Printf("connection timed out\n")
 			c.clearData()
 			if c.state == connecting {
@@ -167,65 +304,311 @@ func (c *Conn) Update(dt time.Duration) {
 	}
 }
 
-// SendPacket sends a slice of data on the connection.
+// SendPacket sends a slice of data on the connection. A server connection
+// sends it to all its connected clients.
 func (c *Conn) SendPacket(data []byte) error {
+	if c.mode == Server {
+		if !c.IsConnected() {
+			return errors.New("not connected")
+		}
+		var err error
+		for slot, p := range c.peers {
+			if p != nil && !p.suspended {
+				if e := c.SendPacketTo(slot, data); e != nil && err == nil {
+					err = e
+				}
+			}
+		}
+		return err
+	}
 	if c.address == nil {
 		return errors.New("address not set")
 	}
-	packet := make([]byte, len(data)+4)
-	packet[0] = byte(c.protocolID >> 24)
-	packet[1] = byte((c.protocolID >> 16) & 0xFF)
-	packet[2] = byte((c.protocolID >> 8) & 0xFF)
-	packet[3] = byte((c.protocolID) & 0xFF)
-	copy(packet[4:], data)
-	return c.socket.Send(c.address, packet)
+	if !c.IsConnected() && (c.handshake || !c.IsConnecting()) {
+		// without the handshake, clients connect by sending payloads
+		return errors.New("not connected")
+	}
+	return c.sendPacket(c.address, payloadPacket, data, c.session)
+}
+
+// sendPacket frames and sends a packet of given type to addr. The body is
+// sealed if a session is provided. Without the handshake, only payloads are
+// sent and the type is not written.
+func (c *Conn) sendPacket(addr *net.UDPAddr, packetType byte, body []byte, s *session) error {
+	if !c.handshake && packetType != payloadPacket {
+		return errors.New("handshake disabled")
+	}
+	packet := make([]byte, 4, 5+sessionIDSize+sealedOverhead+len(body))
+	if c.handshake {
+		packet = append(packet, packetType)
+	}
+	if c.handshake && c.mode == Client && (packetType == payloadPacket || packetType == migrationResponsePacket || packetType == timeRequestPacket) {
+		packet = appendUint64(packet, c.sessionID)
+	}
+	if s != nil {
+		packet = s.seal(packet, c.additionalData(packetType), body)
+	} else {
+		packet = append(packet, body...)
+	}
+	writeFraming(packet, c.framing, c.protocolID)
+	if c.mode == Server && !c.isVerified(addr) {
+		// never send more to an unverified address than received from it
+		b := c.budget(addr)
+		if b.sent+len(packet) > b.received {
+			c.guard.stats.AmplificationLimited++
+			return errors.New("amplification limit reached")
+		}
+		b.sent += len(packet)
+	}
+	if c.transport == nil {
+		return errors.New("connection not started")
+	}
+	return c.transport.Send(addr, packet)
 }
 
-// ReceivePacket received a slice of data from the connection.
+// maxDatagramsPerReceive is the maximum number of datagrams ReceivePacket
+// reads in a call, so that a flood of dropped datagrams can't keep it from
+// returning.
+const maxDatagramsPerReceive = 64
+
+// ReceivePacket received a slice of data from the connection. It returns 0
+// when there is nothing to receive, or after reading maxDatagramsPerReceive
+// datagrams without payload.
 func (c *Conn) ReceivePacket(data []byte) int {
-	packet := make([]byte, len(data)+4)
-	var sender net.UDPAddr
-	bytesRead := c.socket.Receive(&sender, packet)
-	if bytesRead == 0 {
-		return 0
+	size := len(data) + c.HeaderSize() + sessionIDSize
+	if size < maxConnectionRequestSize {
+		size = maxConnectionRequestSize
 	}
-	if bytesRead <= 4 {
+	if c.transport == nil {
 		return 0
 	}
-	if packet[0] != byte(c.protocolID>>24) ||
-		packet[1] != byte((c.protocolID>>16)&0xFF) ||
-		packet[2] != byte((c.protocolID>>8)&0xFF) ||
-		packet[3] != byte(c.protocolID&0xFF) {
+	packet := make([]byte, size)
+	for i := 0; i < maxDatagramsPerReceive; i++ {
+		var sender net.UDPAddr
+		bytesRead := c.transport.Receive(&sender, packet)
+		if bytesRead == 0 {
+			return 0
+		}
+		ip := sender.IP.String()
+		if c.mode == Server && !c.guard.allowPacket(ip) {
+			// tell a banned client why, once per ban
+			if c.handshake && bytesRead >= MinConnectionRequestSize && packet[4] == connectionRequestPacket &&
+				c.isValidFraming(packet[:bytesRead]) && c.guard.notifyBan(ip) {
+				c.budget(&sender).received += bytesRead
+				c.sendConnectionDenied(&sender, DenyBanned, nil)
+			}
+			continue
+		}
+		if !c.isValidFraming(packet[:bytesRead]) {
+			c.guard.stats.Invalid++
+			continue
+		}
+
+		if c.mode == Server && !c.isVerified(&sender) {
+			b := c.budget(&sender)
+			b.received += bytesRead
+			b.idle = 0
+		}
+
+		if !c.handshake {
+			if n := c.processPlainPayload(&sender, packet[4:bytesRead], data); n > 0 {
+				return n
+			}
+			continue
+		}
+
+		body := packet[5:bytesRead]
+		switch packet[4] {
+		case payloadPacket:
+			if n := c.processPayload(&sender, body, data); n > 0 {
+				return n
+			}
+		case connectionRequestPacket:
+			if c.mode != Server {
+				continue
+			}
+			if bytesRead < MinConnectionRequestSize {
+				c.guard.stats.Undersized++
+				continue
+			}
+			if c.guard.allowRequest(ip) {
+				c.processConnectionRequest(&sender, body)
+			}
+		case connectionChallengePacket:
+			c.processConnectionChallenge(&sender, body)
+		case connectionResponsePacket:
+			c.processConnectionResponse(&sender, body)
+		case connectionAcceptedPacket:
+			if c.session != nil {
+				var ok bool
+				if body, ok = c.session.open(c.additionalData(connectionAcceptedPacket), body); !ok {
+					continue
+				}
+			}
+			c.processConnectionAccepted(&sender, body)
+		case connectionDeniedPacket:
+			c.processConnectionDenied(&sender, body)
+		case migrationChallengePacket:
+			c.processMigrationChallenge(&sender, body)
+		case migrationResponsePacket:
+			c.processMigrationResponse(&sender, body)
+		case resumeRequestPacket:
+			if c.mode != Server {
+				continue
+			}
+			if bytesRead < MinConnectionRequestSize {
+				c.guard.stats.Undersized++
+				continue
+			}
+			if c.guard.allowRequest(ip) {
+				c.processResumeRequest(&sender, body)
+			}
+		case sessionResumedPacket:
+			c.processSessionResumed(&sender, body)
+		case timeRequestPacket:
+			c.processTimeRequest(&sender, body)
+		case timeResponsePacket:
+			c.processTimeResponse(&sender, body)
+		case disconnectPacket:
+			c.processDisconnect(&sender, body)
+		}
+	}
+	return 0
+}
+
+// isValidFraming indicates if packet is framed by this connection protocol
+// id or checksum, and is not empty.
+func (c *Conn) isValidFraming(packet []byte) bool {
+	return hasFraming(packet, c.framing, c.protocolID)
+}
+
+// processPlainPayload copies the payload received from the remote end of a
+// connection without handshake into data and returns its size. A server
+// connects new clients in its free slots, a client connects when it receives
+// the first payload of the server.
+func (c *Conn) processPlainPayload(sender *net.UDPAddr, body, data []byte) int {
+	if c.mode == Server {
+		p := c.peerByAddress(sender)
+		if p == nil {
+			if c.freeSlot() < 0 {
+				return 0
+			}
+			p = c.acceptConnection(sender, nil, negotiation{})
+		}
+		p.timeoutAccumulator = 0
+		c.lastSlot = p.slot
+		return copy(data, body)
+	}
+	if !sameAddress(sender, c.address) || (c.state != connected && c.state != connecting) {
 		return 0
 	}
-	if c.mode == Server && !c.IsConnected() {
-		fmt.Printf("server accepts connection from client %v\n",
-			sender.String())
-		c.state = connected
-		c.address = &sender
-		c.cb.OnConnect()
+	if c.state == connecting {
+		c.completeConnection()
 	}
-	// TODO: Aurelien, should check if this the only way to compare two net.UDPAddr
-	if sender.String() == c.address.String() {
-		if c.mode == Client && c.state == connecting {
-			fmt.Printf("client completes connection with server\n")
-			c.state = connected
-			c.cb.OnConnect()
+	c.timeoutAccumulator = time.Duration(0)
+	return copy(data, body)
+}
+
+// processPayload copies the payload received from the remote end into data
+// and returns its size.
+func (c *Conn) processPayload(sender *net.UDPAddr, body, data []byte) int {
+	if c.mode == Server {
+		p, body, fresh := c.openPeerPacket(payloadPacket, body)
+		if p == nil {
+			return 0
+		}
+		if !sameAddress(sender, p.address) {
+			c.migratePeer(p, sender, fresh)
+			return 0
 		}
-		c.timeoutAccumulator = time.Duration(0)
-		copy(data, packet[4:bytesRead])
-		return bytesRead - 4
+		if p.suspended && sameAddress(sender, p.address) {
+			c.resumePeer(p)
+		}
+		p.timeoutAccumulator = 0
+		c.lastSlot = p.slot
+		return copy(data, body)
 	}
-	return 0
+	if !sameAddress(sender, c.address) || (c.state != connected && c.state != resuming) {
+		return 0
+	}
+	if c.session != nil {
+		var ok bool
+		if body, ok = c.session.open(c.additionalData(payloadPacket), body); !ok {
+			return 0
+		}
+	}
+	if c.state == resuming {
+		// the server didn't time out the session
+		c.resumeSession()
+	}
+	c.timeoutAccumulator = time.Duration(0)
+	return copy(data, body)
 }
 
-// HeaderSize returns the size of the connection header.
+// HeaderSize returns the size of the connection header. With the handshake,
+// packets carry their type and clients prefix them with their session id.
 func (c *Conn) HeaderSize() int {
-	return 4
+	if !c.handshake {
+		return 4
+	}
+	size := 5
+	if c.mode == Client {
+		size += sessionIDSize
+	}
+	if c.isSecure() {
+		size += sealedOverhead
+	}
+	return size
+}
+
+// checksum returns the CRC32 of the protocol id followed by data.
+func (c *Conn) checksum(data []byte) uint32 {
+	return framingChecksum(c.protocolID, data)
+}
+
+// writeFraming writes the protocol id, or the checksum of the rest of the
+// packet, in the 4 first bytes of packet.
+func writeFraming(packet []byte, framing Framing, protocolID uint) {
+	if framing == ChecksumFraming {
+		binary.BigEndian.PutUint32(packet, framingChecksum(protocolID, packet[4:]))
+	} else {
+		binary.BigEndian.PutUint32(packet, uint32(protocolID))
+	}
+}
+
+// hasFraming indicates if packet is framed by given protocol id or checksum,
+// and is not empty.
+func hasFraming(packet []byte, framing Framing, protocolID uint) bool {
+	if len(packet) <= 4 {
+		return false
+	}
+	if framing == ChecksumFraming {
+		return binary.BigEndian.Uint32(packet) == framingChecksum(protocolID, packet[4:])
+	}
+	return hasProtocolID(protocolID, packet)
+}
+
+// framingChecksum returns the CRC32 of the protocol id followed by data.
+func framingChecksum(protocolID uint, data []byte) uint32 {
+	var id [4]byte
+	binary.BigEndian.PutUint32(id[:], uint32(protocolID))
+	crc := crc32.ChecksumIEEE(id[:])
+	return crc32.Update(crc, crc32.IEEETable, data)
 }
 
 func (c *Conn) clearData() {
 	c.state = disconnected
 	c.timeoutAccumulator = time.Duration(0)
+	c.requestAccumulator = time.Duration(0)
 	c.address = nil
+	c.session = nil
+	c.clientID = 0
+	c.sessionID = 0
+	c.resumeTicket = nil
+	c.ticketGrace = 0
+	c.resumeLeft = 0
+	c.negotiated = negotiation{}
+	c.peers = make([]*peer, c.maxClients)
+	c.lastSlot = 0
+	c.clockSync.reset()
 }
@@ -2,6 +2,7 @@ package udpnet
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"testing"
@@ -226,6 +227,49 @@ func TestConnectionJoinBusy(t *testing.T) {
 	assert.True(t, busy.ConnectFailed(), "busy.ConnectFailed() should return true")
 }
 
+func TestConnectionJoinBusyDenied(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(100) * time.Millisecond
+	)
+
+	client := NewConn(dummyCallback{}, protocolID, TimeOut)
+	client.SetHandshake(true)
+	require.True(t, client.Start(clientPort), "couldn't start client connection")
+	defer client.Stop()
+
+	server := NewConn(dummyCallback{}, protocolID, TimeOut)
+	server.SetHandshake(true)
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+
+	busy := NewConn(dummyCallback{}, protocolID, TimeOut)
+	busy.SetHandshake(true)
+	require.True(t, busy.Start(clientPort+1), "couldn't start busy connection")
+	defer busy.Stop()
+
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	client.Connect(sAddr)
+	server.Listen()
+	updateConns(DeltaTime, 1000, func() bool {
+		return client.IsConnected() && server.IsConnected()
+	}, clientPacket, client, server)
+	require.True(t, client.IsConnected(), "client should be connected")
+
+	t.Logf("check busy is denied before timing out\n")
+	busy.Connect(sAddr)
+	var elapsed time.Duration
+	updateConns(DeltaTime, 1000, func() bool {
+		elapsed += DeltaTime
+		return !busy.IsConnecting()
+	}, clientPacket, client, server, busy)
+	assert.True(t, busy.ConnectFailed(), "busy.ConnectFailed() should return true")
+	assert.Equal(t, DenyServerFull, busy.DenyReason())
+	assert.True(t, elapsed < TimeOut, "busy should be denied before timing out")
+	assert.True(t, client.IsConnected(), "client should be connected")
+	assert.True(t, server.IsConnected(), "server should be connected")
+}
+
 func TestConnectionRejoin(t *testing.T) {
 	const (
 		DeltaTime = time.Millisecond
@@ -402,3 +446,186 @@ func TestConnectionPayload(t *testing.T) {
 	assert.True(t, client.IsConnected(), "client should be connected")
 	assert.True(t, server.IsConnected(), "server should be connected")
 }
+
+func TestConnectionMemNetwork(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(100) * time.Millisecond
+	)
+
+	network := NewMemNetwork()
+	sAddr := &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: serverPort}
+	st, err := network.Listen(sAddr)
+	require.NoError(t, err)
+	nat, err := network.AddNAT(net.ParseIP("2.2.2.2"), PortRestrictedNAT)
+	require.NoError(t, err)
+	ct, err := nat.Listen(&net.UDPAddr{IP: net.ParseIP("192.168.0.2"), Port: clientPort})
+	require.NoError(t, err)
+
+	server := NewConn(dummyCallback{}, protocolID, TimeOut)
+	server.SetHandshake(true)
+	require.True(t, server.StartTransport(st), "couldn't start server connection")
+	defer server.Stop()
+	server.Listen()
+
+	client := NewConn(dummyCallback{}, protocolID, TimeOut)
+	client.SetHandshake(true)
+	require.True(t, client.StartTransport(ct), "couldn't start client connection")
+	defer client.Stop()
+	client.Connect(sAddr)
+
+	updateConns(DeltaTime, 1000, func() bool {
+		return client.IsConnected() && server.IsConnected()
+	}, nil, client, server)
+	require.True(t, client.IsConnected(), "client should be connected")
+	require.True(t, server.IsConnected(), "server should be connected")
+	peer, ok := server.PeerBySlot(0)
+	require.True(t, ok)
+	assert.Equal(t, fmt.Sprintf("2.2.2.2:%d", firstNATPort), peer.Address.String(), "server should see the NAT public address")
+
+	require.NoError(t, client.SendPacket(clientPacket))
+	require.NoError(t, server.SendPacket(serverPacket))
+	var packet [256]byte
+	n := server.ReceivePacket(packet[:])
+	assert.Equal(t, clientPacket, packet[:n])
+	n = client.ReceivePacket(packet[:])
+	assert.Equal(t, serverPacket, packet[:n])
+
+	client.Stop()
+	assert.Nil(t, ct.LocalAddr(), "stopping the connection should close its transport")
+}
+
+func TestConnectionChecksumFraming(t *testing.T) {
+	const TimeOut = time.Duration(100) * time.Millisecond
+
+	server := NewConn(dummyCallback{}, protocolID, TimeOut)
+	server.SetFraming(ChecksumFraming)
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+	server.Listen()
+
+	var socket Socket
+	require.NoError(t, socket.Open(clientPort))
+	defer socket.Close()
+
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+
+	// receive returns the payload size read by the server, if any
+	receive := func(packet []byte) int {
+		require.NoError(t, socket.Send(sAddr, packet))
+		for i := 0; i < 100; i++ {
+			var buf [256]byte
+			if n := server.ReceivePacket(buf[:]); n != 0 {
+				return n
+			}
+		}
+		return 0
+	}
+
+	t.Logf("check plaintext protocol id is rejected\n")
+	packet := append([]byte{0x11, 0x11, 0x22, 0x22}, clientPacket...)
+	assert.Equal(t, 0, receive(packet))
+	assert.True(t, server.IsListening(), "server should still be listening")
+
+	t.Logf("check corrupted packet is rejected\n")
+	packet = make([]byte, 4+len(clientPacket))
+	copy(packet[4:], clientPacket)
+	binary.BigEndian.PutUint32(packet, server.checksum(clientPacket))
+	packet[len(packet)-1] ^= 0x01
+	assert.Equal(t, 0, receive(packet))
+	assert.True(t, server.IsListening(), "server should still be listening")
+
+	t.Logf("check foreign protocol is rejected\n")
+	foreign := NewConn(dummyCallback{}, protocolID+1, TimeOut)
+	binary.BigEndian.PutUint32(packet, foreign.checksum(clientPacket))
+	packet[len(packet)-1] ^= 0x01
+	assert.Equal(t, 0, receive(packet))
+	assert.True(t, server.IsListening(), "server should still be listening")
+
+	t.Logf("check valid packet is accepted\n")
+	binary.BigEndian.PutUint32(packet, server.checksum(clientPacket))
+	assert.Equal(t, len(clientPacket), receive(packet))
+	assert.True(t, server.IsConnected(), "server should be connected")
+}
+
+func TestConnectionChecksumPayload(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(100) * time.Millisecond
+	)
+
+	client := NewConn(dummyCallback{}, protocolID, TimeOut)
+	client.SetFraming(ChecksumFraming)
+	require.True(t, client.Start(clientPort), "couldn't start client connection")
+	defer client.Stop()
+
+	server := NewConn(dummyCallback{}, protocolID, TimeOut)
+	server.SetFraming(ChecksumFraming)
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+
+	cAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	client.Connect(cAddr)
+	server.Listen()
+
+	for {
+		if client.IsConnected() && server.IsConnected() {
+			break
+		}
+
+		if !client.IsConnecting() && client.ConnectFailed() {
+			break
+		}
+
+		client.SendPacket(clientPacket)
+		server.SendPacket(serverPacket)
+
+		for {
+			var packet [256]byte
+			bytesRead := client.ReceivePacket(packet[:])
+			if bytesRead == 0 {
+				break
+			}
+			assert.Equal(t, "server to client", string(packet[:bytesRead]))
+		}
+
+		for {
+			var packet [256]byte
+			bytesRead := server.ReceivePacket(packet[:])
+			if bytesRead == 0 {
+				break
+			}
+			assert.Equal(t, "client to server", string(packet[:bytesRead]))
+		}
+
+		client.Update(DeltaTime)
+		server.Update(DeltaTime)
+	}
+
+	assert.True(t, client.IsConnected(), "client should be connected")
+	assert.True(t, server.IsConnected(), "server should be connected")
+}
+
+// updateConns receives all pending packets and updates each connection, until
+// done returns true or the maximum number of iterations is reached. payload
+// is sent by each connected connection at every iteration.
+func updateConns(dt time.Duration, maxIterations int, done func() bool, payload []byte, conns ...*Conn) {
+	for i := 0; i < maxIterations && !done(); i++ {
+		for _, c := range conns {
+			if c.IsConnected() && payload != nil {
+				c.SendPacket(payload)
+			}
+		}
+		for _, c := range conns {
+			for {
+				var packet [256]byte
+				if c.ReceivePacket(packet[:]) == 0 {
+					break
+				}
+			}
+		}
+		for _, c := range conns {
+			c.Update(dt)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package udpnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// MaxEntityFields is the maximum number of fields of an entity state.
+	MaxEntityFields = 32
+
+	// MaxEntities is the maximum number of entities of a world state.
+	MaxEntities = 0xFFFF
+
+	// deltaHeaderSize is the size of the header of an encoded world state,
+	// its tick, baseline flag and number of entities. The baseline tick
+	// follows the flag in delta encoded states.
+	deltaHeaderSize = 8 + 1 + 2
+)
+
+// EntityState is the replicated state of an entity, a fixed number of fields.
+// A nil EntityState is an entity slot not in use.
+type EntityState []uint32
+
+// WorldState is the state of all the entities at a server tick, by slot.
+type WorldState struct {
+	Tick     uint64
+	Entities []EntityState
+}
+
+// clone returns a deep copy of ws.
+func (ws WorldState) clone() WorldState {
+	c := WorldState{Tick: ws.Tick, Entities: make([]EntityState, len(ws.Entities))}
+	for i, e := range ws.Entities {
+		if e != nil {
+			c.Entities[i] = append(EntityState{}, e...)
+		}
+	}
+	return c
+}
+
+// sentState is a world state sent by a DeltaEncoder.
+type sentState struct {
+	sequence uint // sequence of the packet it was sent in
+	acked    bool
+	state    WorldState
+}
+
+// DeltaEncoder encodes, on the server, the world states sent to a client as
+// a delta against the last state the client acked, its baseline. Only the
+// changed fields of the changed entities are written, after a bitmask of the
+// changed entities. Until a state is acked, or when the baseline is too old,
+// the full state is sent.
+//
+// Acks come from the reliability system of the connection: states are
+// recorded with the sequence of the packet they are sent in, and acked by
+// the acks of that sequence. States not acked within the ack window of the
+// reliability system are forgotten.
+type DeltaEncoder struct {
+	fields      int
+	capacity    int
+	history     []sentState // last states sent, oldest first
+	maxSequence uint        // maximum sequence of the reliability system
+	ackWindow   uint        // ack window of the reliability system
+	full        uint64      // number of full states encoded
+	deltas      uint64      // number of delta encoded states
+}
+
+// NewDeltaEncoder returns an encoder of world states whose entities have
+// fields fields, remembering the last history states sent as baselines.
+// history must not be greater than the history of the client DeltaDecoder.
+func NewDeltaEncoder(fields, history int) (*DeltaEncoder, error) {
+	if fields < 1 || fields > MaxEntityFields {
+		return nil, fmt.Errorf("entities must have from 1 to %d fields", MaxEntityFields)
+	}
+	if history < 1 {
+		return nil, errors.New("history must hold at least 1 state")
+	}
+	return &DeltaEncoder{fields: fields, capacity: history, maxSequence: 0xFFFFFFFF, ackWindow: 32}, nil
+}
+
+// SetReliabilitySystem sets the reliability system the states are sent with,
+// its maximum sequence and ack window tell which acks are stale. By default
+// states are sent with 32-bit sequences and an ack window of 32.
+func (de *DeltaEncoder) SetReliabilitySystem(rs *ReliabilitySystem) {
+	de.maxSequence = rs.MaxSequence()
+	de.ackWindow = rs.AckWindow()
+}
+
+// Reset forgets the states sent, the next state is sent in full. It must be
+// called when the client connects again.
+func (de *DeltaEncoder) Reset() {
+	de.history = nil
+}
+
+// Stats returns the number of states encoded in full and as deltas.
+func (de *DeltaEncoder) Stats() (full, deltas uint64) {
+	return de.full, de.deltas
+}
+
+// Baseline returns the tick of the newest state acked by the client.
+func (de *DeltaEncoder) Baseline() (uint64, bool) {
+	if base := de.baseline(); base != nil {
+		return base.Tick, true
+	}
+	return 0, false
+}
+
+func (de *DeltaEncoder) baseline() *WorldState {
+	var base *WorldState
+	for i := range de.history {
+		s := &de.history[i]
+		if s.acked && (base == nil || s.state.Tick > base.Tick) {
+			base = &s.state
+		}
+	}
+	return base
+}
+
+// ProcessAcks marks the states sent in the acked packets as received by the
+// client. acks are the acks of the reliability system, to pass after
+// receiving packets and before updating it.
+func (de *DeltaEncoder) ProcessAcks(acks []uint) {
+	if len(de.history) == 0 {
+		return
+	}
+	newest := de.history[len(de.history)-1].sequence
+	for _, ack := range acks {
+		// acks of packets not sent yet, or older than the ack window, are
+		// from a previous sequence wrap around
+		if sequenceMoreRecent(ack, newest, de.maxSequence) || sequenceDelta(newest, ack, de.maxSequence) > de.ackWindow {
+			continue
+		}
+		for i := range de.history {
+			if de.history[i].sequence == ack {
+				de.history[i].acked = true
+			}
+		}
+	}
+}
+
+// expire forgets the states that weren't acked within the ack window of the
+// state sent in the packet of given sequence.
+func (de *DeltaEncoder) expire(sequence uint) {
+	history := de.history[:0]
+	for _, s := range de.history {
+		if s.acked || sequenceDelta(sequence, s.sequence, de.maxSequence) <= de.ackWindow {
+			history = append(history, s)
+		}
+	}
+	for i := len(history); i < len(de.history); i++ {
+		de.history[i] = sentState{}
+	}
+	de.history = history
+}
+
+// Encode encodes state against the baseline, to be sent in the packet of
+// given sequence, usually the local sequence of the reliability system.
+func (de *DeltaEncoder) Encode(sequence uint, state WorldState) ([]byte, error) {
+	if len(state.Entities) > MaxEntities {
+		return nil, fmt.Errorf("too many entities, %d max", MaxEntities)
+	}
+	for _, e := range state.Entities {
+		if e != nil && len(e) != de.fields {
+			return nil, fmt.Errorf("entities must have %d fields", de.fields)
+		}
+	}
+	base := de.baseline()
+
+	buf := appendUint64(nil, state.Tick)
+	if base != nil {
+		buf = append(buf, 1)
+		buf = appendUint64(buf, base.Tick)
+		de.deltas++
+	} else {
+		buf = append(buf, 0)
+		de.full++
+	}
+	buf = appendUint16(buf, uint16(len(state.Entities)))
+	mask := len(buf)
+	buf = append(buf, make([]byte, (len(state.Entities)+7)/8)...)
+	for i, e := range state.Entities {
+		var prev EntityState
+		if base != nil && i < len(base.Entities) {
+			prev = base.Entities[i]
+		}
+		// a changed entity with no fields set is a removed entity
+		var fields uint32
+		switch {
+		case e == nil && prev == nil:
+			continue
+		case e != nil:
+			for f := range e {
+				if prev == nil || e[f] != prev[f] {
+					fields |= 1 << uint(f)
+				}
+			}
+			if fields == 0 {
+				continue
+			}
+		}
+		buf[mask+i/8] |= 1 << uint(i%8)
+		buf = appendUint32(buf, fields)
+		for f := range e {
+			if fields&(1<<uint(f)) != 0 {
+				buf = appendUint32(buf, e[f])
+			}
+		}
+	}
+
+	de.expire(sequence)
+	if len(de.history) == de.capacity {
+		copy(de.history, de.history[1:])
+		de.history = de.history[:de.capacity-1]
+	}
+	de.history = append(de.history, sentState{sequence: sequence, state: state.clone()})
+	return buf, nil
+}
+
+// DeltaDecoder decodes, on the client, the world states encoded by a
+// DeltaEncoder, reconstructing delta encoded states from the baselines it
+// received.
+type DeltaDecoder struct {
+	fields   int
+	capacity int
+	history  []WorldState // last states decoded, oldest first
+}
+
+// NewDeltaDecoder returns a decoder of world states whose entities have
+// fields fields, remembering the last history states decoded as baselines.
+func NewDeltaDecoder(fields, history int) (*DeltaDecoder, error) {
+	if fields < 1 || fields > MaxEntityFields {
+		return nil, fmt.Errorf("entities must have from 1 to %d fields", MaxEntityFields)
+	}
+	if history < 1 {
+		return nil, errors.New("history must hold at least 1 state")
+	}
+	return &DeltaDecoder{fields: fields, capacity: history}, nil
+}
+
+// Reset forgets the states decoded.
+func (dd *DeltaDecoder) Reset() {
+	dd.history = nil
+}
+
+// Decode decodes a world state. It fails if the data is malformed or if the
+// baseline of a delta encoded state is not known.
+func (dd *DeltaDecoder) Decode(data []byte) (WorldState, error) {
+	if len(data) < deltaHeaderSize {
+		return WorldState{}, errors.New("truncated world state")
+	}
+	state := WorldState{Tick: binary.BigEndian.Uint64(data)}
+	var base *WorldState
+	switch data[8] {
+	case 0:
+		data = data[9:]
+	case 1:
+		if len(data) < deltaHeaderSize+8 {
+			return WorldState{}, errors.New("truncated world state")
+		}
+		baseTick := binary.BigEndian.Uint64(data[9:])
+		for i := range dd.history {
+			if dd.history[i].Tick == baseTick {
+				base = &dd.history[i]
+			}
+		}
+		if base == nil {
+			return WorldState{}, fmt.Errorf("baseline %d not received", baseTick)
+		}
+		data = data[17:]
+	default:
+		return WorldState{}, errors.New("invalid world state flags")
+	}
+
+	n := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < (n+7)/8 {
+		return WorldState{}, errors.New("truncated world state")
+	}
+	mask := data[:(n+7)/8]
+	data = data[(n+7)/8:]
+	state.Entities = make([]EntityState, n)
+	for i := range state.Entities {
+		var prev EntityState
+		if base != nil && i < len(base.Entities) {
+			prev = base.Entities[i]
+		}
+		if mask[i/8]&(1<<uint(i%8)) == 0 {
+			if prev != nil {
+				state.Entities[i] = append(EntityState{}, prev...)
+			}
+			continue
+		}
+		if len(data) < 4 {
+			return WorldState{}, errors.New("truncated world state")
+		}
+		fields := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		if fields == 0 {
+			// removed entity
+			continue
+		}
+		if fields>>uint(dd.fields) != 0 || (prev == nil && fields != 1<<uint(dd.fields)-1) {
+			return WorldState{}, errors.New("invalid entity fields")
+		}
+		e := make(EntityState, dd.fields)
+		copy(e, prev)
+		for f := range e {
+			if fields&(1<<uint(f)) == 0 {
+				continue
+			}
+			if len(data) < 4 {
+				return WorldState{}, errors.New("truncated world state")
+			}
+			e[f] = binary.BigEndian.Uint32(data)
+			data = data[4:]
+		}
+		state.Entities[i] = e
+	}
+	if len(data) != 0 {
+		return WorldState{}, errors.New("trailing data in world state")
+	}
+
+	if len(dd.history) == dd.capacity {
+		copy(dd.history, dd.history[1:])
+		dd.history = dd.history[:dd.capacity-1]
+	}
+	dd.history = append(dd.history, state.clone())
+	return state, nil
+}
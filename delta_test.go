@@ -0,0 +1,227 @@
+package udpnet
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeltaCompression(t *testing.T) {
+	_, err := NewDeltaEncoder(MaxEntityFields+1, 8)
+	assert.Error(t, err)
+	_, err = NewDeltaDecoder(3, 0)
+	assert.Error(t, err)
+
+	enc, err := NewDeltaEncoder(3, 4)
+	require.NoError(t, err)
+	dec, err := NewDeltaDecoder(3, 4)
+	require.NoError(t, err)
+
+	_, err = enc.Encode(0, WorldState{Entities: []EntityState{{1, 2}}})
+	assert.Error(t, err, "entities with the wrong number of fields should be refused")
+
+	t.Logf("check the first state is sent in full\n")
+	s1 := WorldState{Tick: 1, Entities: []EntityState{{1, 2, 3}, nil, {4, 5, 6}, {7, 8, 9}}}
+	data, err := enc.Encode(0, s1)
+	require.NoError(t, err)
+	full := len(data)
+	got, err := dec.Decode(data)
+	require.NoError(t, err)
+	assert.Equal(t, s1, got)
+	_, ok := enc.Baseline()
+	assert.False(t, ok)
+
+	t.Logf("check unacked states are sent in full\n")
+	s2 := WorldState{Tick: 2, Entities: []EntityState{{1, 2, 3}, nil, {4, 50, 6}, {7, 8, 9}}}
+	data, err = enc.Encode(1, s2)
+	require.NoError(t, err)
+	assert.Equal(t, full, len(data))
+	_, err = dec.Decode(data)
+	require.NoError(t, err)
+
+	t.Logf("check acked states are used as baseline\n")
+	enc.ProcessAcks([]uint{1})
+	base, ok := enc.Baseline()
+	require.True(t, ok)
+	assert.EqualValues(t, 2, base)
+	s3 := WorldState{Tick: 3, Entities: []EntityState{{1, 2, 3}, {10, 11, 12}, nil, {7, 8, 90}, {13, 14, 15}}}
+	data, err = enc.Encode(2, s3)
+	require.NoError(t, err)
+	// header, baseline, entities mask, then the field masks and fields of
+	// the created, removed, changed and created entities
+	assert.Equal(t, deltaHeaderSize+8+1+4*(1+3)+4+4*(1+1)+4*(1+3), len(data))
+	got, err = dec.Decode(data)
+	require.NoError(t, err)
+	assert.Equal(t, s3, got)
+
+	t.Logf("check unchanged states are reduced to their header\n")
+	enc.ProcessAcks([]uint{2})
+	s4 := s3
+	s4.Tick = 4
+	data, err = enc.Encode(3, s4)
+	require.NoError(t, err)
+	assert.Equal(t, deltaHeaderSize+8+1, len(data))
+	got, err = dec.Decode(data)
+	require.NoError(t, err)
+	assert.Equal(t, s4, got)
+
+	t.Logf("check shrinking states remove the last entities\n")
+	s5 := WorldState{Tick: 5, Entities: []EntityState{{1, 2, 3}}}
+	data, err = enc.Encode(4, s5)
+	require.NoError(t, err)
+	got, err = dec.Decode(data)
+	require.NoError(t, err)
+	assert.Equal(t, s5, got)
+
+	t.Logf("check unknown baselines fail\n")
+	other, err := NewDeltaDecoder(3, 4)
+	require.NoError(t, err)
+	_, err = other.Decode(data)
+	assert.Error(t, err)
+	_, err = other.Decode(data[:5])
+	assert.Error(t, err)
+
+	t.Logf("check baselines out of the history are not used\n")
+	for seq := uint(5); seq < 9; seq++ {
+		_, err = enc.Encode(seq, WorldState{Tick: uint64(seq + 1)})
+		require.NoError(t, err)
+	}
+	_, ok = enc.Baseline()
+	assert.False(t, ok)
+	enc.ProcessAcks([]uint{4})
+	_, ok = enc.Baseline()
+	assert.False(t, ok, "acks of forgotten states should be ignored")
+	fulls, deltas := enc.Stats()
+	assert.EqualValues(t, 4, fulls)
+	assert.EqualValues(t, 5, deltas)
+}
+
+func TestDeltaEncoderAckWindow(t *testing.T) {
+	const MaxSequence = 0xFF
+
+	enc, err := NewDeltaEncoder(1, 8)
+	require.NoError(t, err)
+	enc.SetReliabilitySystem(NewReliabilitySystem(MaxSequence))
+	state := func(tick uint64) WorldState {
+		return WorldState{Tick: tick, Entities: []EntityState{{uint32(tick)}}}
+	}
+
+	t.Logf("check states not acked within the ack window are forgotten\n")
+	_, err = enc.Encode(10, state(1))
+	require.NoError(t, err)
+	_, err = enc.Encode(50, state(2))
+	require.NoError(t, err)
+	enc.ProcessAcks([]uint{10})
+	_, ok := enc.Baseline()
+	assert.False(t, ok, "state out of the ack window should be forgotten")
+	enc.ProcessAcks([]uint{50})
+	base, ok := enc.Baseline()
+	require.True(t, ok)
+	assert.EqualValues(t, 2, base)
+
+	t.Logf("check acks across the sequence wrap around\n")
+	enc.Reset()
+	for i, seq := range []uint{254, 255, 0, 1} {
+		_, err = enc.Encode(seq, state(uint64(10+i)))
+		require.NoError(t, err)
+	}
+	enc.ProcessAcks([]uint{100})
+	_, ok = enc.Baseline()
+	assert.False(t, ok, "acks of packets not sent should be ignored")
+	enc.ProcessAcks([]uint{255})
+	base, ok = enc.Baseline()
+	require.True(t, ok)
+	assert.EqualValues(t, 11, base)
+	enc.ProcessAcks([]uint{1})
+	base, _ = enc.Baseline()
+	assert.EqualValues(t, 13, base)
+}
+
+func TestDeltaCompressionReliableConn(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(1000) * time.Millisecond
+		Entities  = 200
+		Fields    = 4
+		Ticks     = 200
+	)
+
+	client := NewReliableConn(protocolID, TimeOut, maxSequence)
+	require.True(t, client.Start(clientPort), "couldn't start client connection")
+	defer client.Stop()
+
+	server := NewReliableConn(protocolID, TimeOut, maxSequence)
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+
+	cAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	client.Connect(cAddr)
+	server.Listen()
+
+	// drop some of the server packets
+	server.SetPacketLossMask(1)
+
+	enc, err := NewDeltaEncoder(Fields, 32)
+	require.NoError(t, err)
+	enc.SetReliabilitySystem(server.ReliabilitySystem())
+	dec, err := NewDeltaDecoder(Fields, 32)
+	require.NoError(t, err)
+
+	r := rand.New(rand.NewSource(1))
+	world := WorldState{Entities: make([]EntityState, Entities)}
+	for i := range world.Entities {
+		world.Entities[i] = EntityState{uint32(i), 0, 0, 0}
+	}
+	sent := make(map[uint64]WorldState)
+	var received, bytes int
+	for i := 0; i < 2000 && received < Ticks; i++ {
+		if client.IsConnected() || client.IsConnecting() {
+			client.SendPacket(clientPacket)
+		}
+		if server.IsConnected() {
+			// a few entities move every tick
+			world.Tick++
+			for j := 0; j < 5; j++ {
+				e := world.Entities[r.Intn(Entities)]
+				e[1+r.Intn(Fields-1)] = r.Uint32()
+			}
+			data, err := enc.Encode(server.ReliabilitySystem().LocalSequence(), world)
+			require.NoError(t, err)
+			sent[world.Tick] = world.clone()
+			bytes += len(data)
+			server.SendPacket(data)
+		}
+
+		for {
+			var packet [4096]byte
+			n := client.ReceivePacket(packet[:])
+			if n == 0 {
+				break
+			}
+			state, err := dec.Decode(packet[:n])
+			require.NoError(t, err)
+			assert.Equal(t, sent[state.Tick], state, "client should reconstruct the server state")
+			received++
+		}
+		for {
+			var packet [256]byte
+			if server.ReceivePacket(packet[:]) == 0 {
+				break
+			}
+		}
+		enc.ProcessAcks(server.ReliabilitySystem().Acks())
+
+		client.Update(DeltaTime)
+		server.Update(DeltaTime)
+	}
+	require.Equal(t, Ticks, received)
+	fulls, deltas := enc.Stats()
+	assert.True(t, deltas > fulls, "most states should be delta encoded")
+	raw := int(world.Tick) * Entities * Fields * 4
+	assert.True(t, bytes < raw/4, "delta encoding should save bandwidth")
+}
@@ -0,0 +1,317 @@
+package udpnet
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// packet types of the discovery protocol
+const (
+	discoveryProbePacket byte = iota // browser -> server: nonce, padded
+	discoveryInfoPacket              // server -> browser: nonce and server info
+)
+
+const (
+	// MaxServerNameSize is the maximum size of a server name in discovery
+	// answers.
+	MaxServerNameSize = 64
+
+	// discoveryProbeSize is the size probes are padded to, so that servers
+	// never answer with more than they received.
+	discoveryProbeSize = 128
+
+	// discoveryInfoSize is the size of the server info without its name.
+	discoveryInfoSize = 8 + 2 + 2 + 2 + 2 + 1
+
+	// defaultProbeInterval is the default interval between two probes sent by
+	// a browser.
+	defaultProbeInterval = time.Second
+
+	// defaultDiscoveryExpiry is the default time after which servers not
+	// answering anymore are removed from the browser list.
+	defaultDiscoveryExpiry = 5 * time.Second
+)
+
+// ServerInfo is the record servers send to answer discovery probes.
+type ServerInfo struct {
+	Name       string // up to MaxServerNameSize bytes
+	Players    int
+	MaxPlayers int
+	Version    uint16
+	Port       int // port the server accepts connections on
+}
+
+// DiscoveredServer is a server that answered the probes of a Browser.
+type DiscoveredServer struct {
+	Address *net.UDPAddr // address of the server, with the port of its info
+	Info    ServerInfo
+	RTT     time.Duration // smoothed round trip time of the probes
+	Age     time.Duration // time since the last answer
+}
+
+// DiscoveryServer answers the discovery probes sent by browsers on the LAN,
+// by broadcast or multicast, with the server info.
+type DiscoveryServer struct {
+	protocolID uint
+	socket     Socket
+	info       ServerInfo
+	answered   uint64 // number of probes answered
+}
+
+// NewDiscoveryServer returns a discovery server answering with info.
+func NewDiscoveryServer(protocolID uint, info ServerInfo) (*DiscoveryServer, error) {
+	ds := &DiscoveryServer{protocolID: protocolID}
+	if err := ds.SetInfo(info); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// Listen listens for the probes broadcast, or sent directly, on port.
+func (ds *DiscoveryServer) Listen(port int) error {
+	return ds.socket.OpenAddr(&net.UDPAddr{IP: net.IPv4zero, Port: port})
+}
+
+// ListenMulticast listens for the probes sent to a multicast group, on ifi or
+// on the system-assigned interface if ifi is nil.
+func (ds *DiscoveryServer) ListenMulticast(group *net.UDPAddr, ifi *net.Interface) error {
+	return ds.socket.OpenMulticast(group, ifi)
+}
+
+// Stop stops listening for probes.
+func (ds *DiscoveryServer) Stop() {
+	ds.socket.Close()
+}
+
+// SetInfo sets the info sent in answer to the probes, for example when the
+// number of players changes.
+func (ds *DiscoveryServer) SetInfo(info ServerInfo) error {
+	if len(info.Name) > MaxServerNameSize {
+		return fmt.Errorf("server name too long, %d bytes max", MaxServerNameSize)
+	}
+	if info.Players < 0 || info.MaxPlayers < 0 || info.Players > 0xFFFF || info.MaxPlayers > 0xFFFF {
+		return errors.New("invalid number of players")
+	}
+	if info.Port < 0 || info.Port > 0xFFFF {
+		return errors.New("invalid port")
+	}
+	ds.info = info
+	return nil
+}
+
+// Info returns the info sent in answer to the probes.
+func (ds *DiscoveryServer) Info() ServerInfo {
+	return ds.info
+}
+
+// Answered returns the number of probes answered.
+func (ds *DiscoveryServer) Answered() uint64 {
+	return ds.answered
+}
+
+// Update answers the received probes.
+func (ds *DiscoveryServer) Update() {
+	if !ds.socket.IsOpen() {
+		return
+	}
+	for {
+		var (
+			sender net.UDPAddr
+			packet [discoveryProbeSize]byte
+		)
+		n := ds.socket.Receive(&sender, packet[:])
+		if n == 0 {
+			break
+		}
+		if n < discoveryProbeSize || !hasProtocolID(ds.protocolID, packet[:n]) || packet[4] != discoveryProbePacket {
+			continue
+		}
+		body := append([]byte(nil), packet[5:13]...)
+		body = appendUint16(body, ds.info.Version)
+		body = appendUint16(body, uint16(ds.info.Players))
+		body = appendUint16(body, uint16(ds.info.MaxPlayers))
+		body = appendUint16(body, uint16(ds.info.Port))
+		body = append(body, byte(len(ds.info.Name)))
+		body = append(body, ds.info.Name...)
+		if err := sendProtocolPacket(&ds.socket, ds.protocolID, &sender, discoveryInfoPacket, body); err == nil {
+			ds.answered++
+		}
+	}
+}
+
+// Browser probes the LAN for servers and keeps the list of the servers that
+// answered, with their round trip time. Probes are sent to targets, usually
+// a broadcast address or a multicast group, every probe interval.
+type Browser struct {
+	protocolID uint
+	socket     Socket
+	targets    []*net.UDPAddr
+	probes     map[uint64]time.Duration // time the probes in flight were sent, by nonce
+	start      time.Time                // time the browser started
+	now        func() time.Duration     // monotonic time since start
+	probe      time.Duration            // time left before the next probes
+	interval   time.Duration
+	expiry     time.Duration
+	servers    []*DiscoveredServer
+}
+
+// NewBrowser returns a browser sending probes to targets.
+func NewBrowser(protocolID uint, targets ...*net.UDPAddr) *Browser {
+	b := &Browser{
+		protocolID: protocolID,
+		targets:    targets,
+		probes:     make(map[uint64]time.Duration),
+		interval:   defaultProbeInterval,
+		expiry:     defaultDiscoveryExpiry,
+	}
+	b.now = func() time.Duration { return time.Since(b.start) }
+	return b
+}
+
+// SetProbeInterval sets the interval between two probes, 1 second by
+// default.
+func (b *Browser) SetProbeInterval(interval time.Duration) {
+	b.interval = interval
+}
+
+// SetExpiry sets the time after which servers not answering anymore are
+// removed from the list, 5 seconds by default.
+func (b *Browser) SetExpiry(expiry time.Duration) {
+	b.expiry = expiry
+}
+
+// Start starts the browser on given port, on all local addresses.
+func (b *Browser) Start(port int) error {
+	return b.StartAddr(&net.UDPAddr{IP: net.IPv4zero, Port: port})
+}
+
+// StartAddr starts the browser on addr, for example to send multicast probes
+// on the interface of that address.
+func (b *Browser) StartAddr(addr *net.UDPAddr) error {
+	if err := b.socket.OpenAddr(addr); err != nil {
+		return err
+	}
+	b.start = time.Now()
+	return nil
+}
+
+// Stop stops the browser.
+func (b *Browser) Stop() {
+	b.socket.Close()
+}
+
+// Servers returns the servers that answered, by increasing round trip time.
+func (b *Browser) Servers() []DiscoveredServer {
+	servers := make([]DiscoveredServer, len(b.servers))
+	for i, s := range b.servers {
+		servers[i] = *s
+	}
+	sort.SliceStable(servers, func(i, j int) bool { return servers[i].RTT < servers[j].RTT })
+	return servers
+}
+
+// Update sends the probes, processes the answers and removes the servers
+// not answering anymore.
+func (b *Browser) Update(dt time.Duration) {
+	if !b.socket.IsOpen() {
+		return
+	}
+	for {
+		var (
+			sender net.UDPAddr
+			packet [5 + discoveryInfoSize + MaxServerNameSize]byte
+		)
+		n := b.socket.Receive(&sender, packet[:])
+		if n == 0 {
+			break
+		}
+		if !hasProtocolID(b.protocolID, packet[:n]) || packet[4] != discoveryInfoPacket {
+			continue
+		}
+		b.processInfo(&sender, packet[5:n])
+	}
+
+	servers := b.servers[:0]
+	for _, s := range b.servers {
+		s.Age += dt
+		if s.Age <= b.expiry {
+			servers = append(servers, s)
+		}
+	}
+	for i := len(servers); i < len(b.servers); i++ {
+		b.servers[i] = nil
+	}
+	b.servers = servers
+	now := b.now()
+	for nonce, sent := range b.probes {
+		if now-sent > b.expiry {
+			delete(b.probes, nonce)
+		}
+	}
+
+	b.probe -= dt
+	if b.probe <= 0 {
+		b.sendProbes()
+		b.probe = b.interval
+	}
+}
+
+// sendProbes sends a probe with a new nonce to each target.
+func (b *Browser) sendProbes() {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return
+	}
+	b.probes[binary.BigEndian.Uint64(nonce[:])] = b.now()
+	body := make([]byte, discoveryProbeSize-5)
+	copy(body, nonce[:])
+	for _, addr := range b.targets {
+		if err := sendProtocolPacket(&b.socket, b.protocolID, addr, discoveryProbePacket, body); err != nil {
+			fmt.Printf("couldn't send probe to %v, %v\n", addr.String(), err)
+		}
+	}
+}
+
+// processInfo adds or refreshes a server answering one of our probes.
+func (b *Browser) processInfo(sender *net.UDPAddr, body []byte) {
+	if len(body) < discoveryInfoSize {
+		return
+	}
+	sent, ok := b.probes[binary.BigEndian.Uint64(body)]
+	if !ok {
+		return
+	}
+	size := int(body[discoveryInfoSize-1])
+	if size > MaxServerNameSize || len(body) < discoveryInfoSize+size {
+		return
+	}
+	info := ServerInfo{
+		Version:    binary.BigEndian.Uint16(body[8:]),
+		Players:    int(binary.BigEndian.Uint16(body[10:])),
+		MaxPlayers: int(binary.BigEndian.Uint16(body[12:])),
+		Port:       int(binary.BigEndian.Uint16(body[14:])),
+		Name:       string(body[discoveryInfoSize : discoveryInfoSize+size]),
+	}
+	addr := &net.UDPAddr{IP: append(net.IP(nil), sender.IP...), Port: info.Port}
+	// the round trip is measured on the monotonic clock, Update may be
+	// called at any rate
+	rtt := b.now() - sent
+
+	for _, s := range b.servers {
+		if sameAddress(s.Address, addr) {
+			// a server may answer the same probe on several targets
+			if s.Age > 0 {
+				s.RTT += (rtt - s.RTT) / 10
+			}
+			s.Info = info
+			s.Age = 0
+			return
+		}
+	}
+	b.servers = append(b.servers, &DiscoveredServer{Address: addr, Info: info, RTT: rtt})
+}
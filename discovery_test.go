@@ -0,0 +1,164 @@
+package udpnet
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const discoveryPort = 30010
+
+// updateDiscovery updates a browser and discovery servers until done returns
+// true.
+func updateDiscovery(dt time.Duration, maxIterations int, done func() bool, b *Browser, servers ...*DiscoveryServer) {
+	for i := 0; i < maxIterations && !done(); i++ {
+		for _, s := range servers {
+			s.Update()
+		}
+		b.Update(dt)
+	}
+}
+
+// isLocalIP indicates if ip is the address of a local interface.
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDiscoveryBroadcast(t *testing.T) {
+	const DeltaTime = time.Millisecond
+
+	info := ServerInfo{Name: "lan party", Players: 3, MaxPlayers: 8, Version: 2, Port: serverPort}
+	server, err := NewDiscoveryServer(protocolID, info)
+	require.NoError(t, err)
+	require.NoError(t, server.Listen(discoveryPort))
+	defer server.Stop()
+
+	browser := NewBrowser(protocolID, &net.UDPAddr{IP: net.IPv4bcast, Port: discoveryPort})
+	browser.SetProbeInterval(time.Duration(50) * time.Millisecond)
+	browser.SetExpiry(time.Duration(200) * time.Millisecond)
+	require.NoError(t, browser.Start(clientPort))
+	defer browser.Stop()
+	assert.True(t, browser.socket.LocalAddr().IP.IsUnspecified(), "browser should listen on all addresses")
+
+	updateDiscovery(DeltaTime, 1000, func() bool { return len(browser.Servers()) > 0 }, browser, server)
+	servers := browser.Servers()
+	require.Len(t, servers, 1)
+	assert.Equal(t, info, servers[0].Info)
+	assert.Equal(t, serverPort, servers[0].Address.Port)
+	assert.True(t, isLocalIP(servers[0].Address.IP), "server should be found on a local address")
+	assert.True(t, servers[0].RTT > 0, "rtt should be measured")
+
+	t.Logf("check info updates\n")
+	info.Players = 4
+	require.NoError(t, server.SetInfo(info))
+	updateDiscovery(DeltaTime, 1000, func() bool { return browser.Servers()[0].Info.Players == 4 }, browser, server)
+	assert.Equal(t, 4, browser.Servers()[0].Info.Players)
+
+	t.Logf("check servers not answering expire\n")
+	server.Stop()
+	updateDiscovery(DeltaTime, 1000, func() bool { return len(browser.Servers()) == 0 }, browser)
+	assert.Empty(t, browser.Servers())
+}
+
+func TestDiscoveryMulticast(t *testing.T) {
+	const DeltaTime = time.Millisecond
+
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	group := &net.UDPAddr{IP: net.ParseIP("239.255.0.1"), Port: discoveryPort}
+	var servers []*DiscoveryServer
+	for i, name := range []string{"first", "second"} {
+		s, err := NewDiscoveryServer(protocolID, ServerInfo{Name: name, MaxPlayers: 4, Port: serverPort + i})
+		require.NoError(t, err)
+		if err := s.ListenMulticast(group, lo); err != nil {
+			t.Skipf("multicast unavailable on loopback: %v", err)
+		}
+		defer s.Stop()
+		servers = append(servers, s)
+	}
+
+	// probes go out on the interface of the browser address
+	browser := NewBrowser(protocolID, group)
+	require.NoError(t, browser.StartAddr(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: clientPort}))
+	defer browser.Stop()
+
+	updateDiscovery(DeltaTime, 1000, func() bool { return len(browser.Servers()) == 2 }, browser, servers...)
+	found := browser.Servers()
+	require.Len(t, found, 2)
+	var names []string
+	for _, s := range found {
+		names = append(names, fmt.Sprintf("%s:%d", s.Info.Name, s.Address.Port))
+	}
+	assert.Contains(t, names, fmt.Sprintf("first:%d", serverPort))
+	assert.Contains(t, names, fmt.Sprintf("second:%d", serverPort+1))
+	assert.True(t, found[0].RTT <= found[1].RTT, "servers should be sorted by rtt")
+}
+
+func TestDiscoveryRTT(t *testing.T) {
+	const (
+		DeltaTime = time.Duration(10) * time.Millisecond
+		ClockStep = time.Duration(250) * time.Microsecond
+	)
+
+	server, err := NewDiscoveryServer(protocolID, ServerInfo{Name: "server", Port: serverPort})
+	require.NoError(t, err)
+	require.NoError(t, server.Listen(discoveryPort))
+	defer server.Stop()
+
+	browser := NewBrowser(protocolID, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: discoveryPort})
+	require.NoError(t, browser.Start(clientPort))
+	defer browser.Stop()
+
+	// the browser clock runs independently of the update rate
+	var clock time.Duration
+	browser.now = func() time.Duration { return clock }
+	updateDiscovery(DeltaTime, 1000, func() bool {
+		clock += ClockStep
+		return len(browser.Servers()) > 0
+	}, browser, server)
+	servers := browser.Servers()
+	require.Len(t, servers, 1)
+	assert.True(t, servers[0].RTT > 0, "rtt should be measured")
+	assert.True(t, servers[0].RTT < DeltaTime, "rtt should not depend on the update rate")
+	assert.EqualValues(t, 0, servers[0].RTT%ClockStep, "rtt should be measured on the browser clock")
+}
+
+func TestDiscoveryServerInfo(t *testing.T) {
+	_, err := NewDiscoveryServer(protocolID, ServerInfo{Name: strings.Repeat("x", MaxServerNameSize+1)})
+	assert.Error(t, err)
+	_, err = NewDiscoveryServer(protocolID, ServerInfo{Players: -1})
+	assert.Error(t, err)
+	_, err = NewDiscoveryServer(protocolID, ServerInfo{Port: 70000})
+	assert.Error(t, err)
+
+	t.Logf("check undersized probes are ignored\n")
+	server, err := NewDiscoveryServer(protocolID, ServerInfo{Name: "server"})
+	require.NoError(t, err)
+	require.NoError(t, server.Listen(discoveryPort))
+	defer server.Stop()
+	var socket Socket
+	require.NoError(t, socket.Open(clientPort))
+	defer socket.Close()
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: discoveryPort}
+	require.NoError(t, sendProtocolPacket(&socket, protocolID, addr, discoveryProbePacket, make([]byte, 8)))
+	for i := 0; i < 10; i++ {
+		server.Update()
+	}
+	assert.EqualValues(t, 0, server.Answered())
+}
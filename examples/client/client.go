@@ -45,21 +45,15 @@ func main() {
 		return
 	}
 	connection.Connect(addr)
-	var connected bool
+	var connected, failed bool
 
-	for {
-		if !connected && connection.IsConnected() {
-			fmt.Printf("client connected to server\n")
-			connected = true
-		}
-
-		if !connected && connection.ConnectFailed() {
-			fmt.Printf("connection failed\n")
-			break
-		}
-
-		packet := []byte("client to server")
-		connection.SendPacket(packet)
+	runner, err := udpnet.NewTickRunner(deltaTime, connection)
+	if err != nil {
+		fmt.Printf("could not create tick runner, %v\n", err)
+		return
+	}
+	stop := make(chan struct{})
+	runner.OnReceive(func(tick uint64) {
 		for {
 			var packet [256]byte
 
@@ -69,8 +63,24 @@ func main() {
 			}
 			fmt.Printf("received packet from server\n")
 		}
+	})
+	runner.OnSend(func(tick uint64) {
+		if !connected && connection.IsConnected() {
+			fmt.Printf("client connected to server\n")
+			connected = true
+		}
 
-		connection.Update(deltaTime)
-		time.Sleep(deltaTime)
-	}
+		if !connected && connection.ConnectFailed() {
+			if !failed {
+				fmt.Printf("connection failed\n")
+				close(stop)
+				failed = true
+			}
+			return
+		}
+
+		packet := []byte("client to server")
+		connection.SendPacket(packet)
+	})
+	runner.Run(stop)
 }
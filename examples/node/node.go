@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net"
 	"time"
@@ -8,52 +9,63 @@ import (
 	"github.com/aurelien-rainone/udpnet"
 )
 
+const (
+	protocolID  = 0x99887766
+	deltaTime   = time.Duration(250) * time.Millisecond
+	timeout     = time.Duration(10) * time.Second
+	maxSequence = 0xFFFFFFFF
+)
+
+type callback struct{}
+
+func (callback) OnPeerJoin(addr *net.UDPAddr)  { fmt.Printf("%v joined\n", addr.String()) }
+func (callback) OnPeerLeave(addr *net.UDPAddr) { fmt.Printf("%v left\n", addr.String()) }
+
+// usage: node -port 30001 127.0.0.1:30000 127.0.0.1:30002
 func main() {
-	port := 30000
-	fmt.Printf("creating socket on port %d\n", port)
+	port := flag.Int("port", 30000, "port to listen on")
+	flag.Parse()
 
-	var socket udpnet.Socket
-	if err := socket.Open(port); err != nil {
-		fmt.Printf("failed to create Socket: %v\n", err)
+	node := udpnet.NewNode(callback{}, protocolID, timeout, maxSequence)
+	if !node.Start(*port) {
+		fmt.Printf("could not start node on port %d\n", *port)
 		return
 	}
-	defer socket.Close()
-
-	// read in addresses.txt to get the set of addresses we will send packets to
-	addresses := []string{
-		"127.0.0.1:30000",
-		"127.0.0.1:30001",
-		"127.0.0.1:30002",
-		"127.0.0.1:30003",
-		"127.0.0.1:30004",
+	defer node.Stop()
+
+	// join the peers given on the command line, the others join us
+	for _, as := range flag.Args() {
+		addr, err := net.ResolveUDPAddr("udp", as)
+		if err != nil {
+			fmt.Printf("can't resolve udp addr %v: %v\n", as, err)
+			return
+		}
+		if err := node.AddPeer(addr); err != nil {
+			fmt.Printf("can't add peer %v: %v\n", as, err)
+		}
 	}
 
 	// send and receive packets until the user ctrl-breaks...
 	for {
-		data := []byte("hello world!")
-		for _, as := range addresses {
-			ad, err := net.ResolveUDPAddr("udp", as)
-			if err != nil {
-				fmt.Printf("can't resolve udp addr %v\n", ad)
-				break
-			}
-			socket.Send(ad, data)
-		}
+		node.Broadcast([]byte("hello world!"))
 
 		for {
-			var (
-				sender net.UDPAddr
-				buf    [256]byte
-			)
-			bytesRead := socket.Receive(&sender, buf[:])
+			var buf [256]byte
+			bytesRead, from := node.ReceivePacket(buf[:])
 			if bytesRead == 0 {
 				break
 			}
-
 			fmt.Printf("received packet from %v (%d bytes): '%v'\n",
-				sender.String(), bytesRead, string(buf[:bytesRead]))
+				from.String(), bytesRead, string(buf[:bytesRead]))
+		}
+
+		for _, addr := range node.Peers() {
+			stats, _ := node.PeerStats(addr)
+			fmt.Printf("%v: rtt %v, sent %d, acked %d, lost %d\n", addr.String(),
+				stats.RoundTripTime, stats.SentPackets, stats.AckedPackets, stats.LostPackets)
 		}
 
-		time.Sleep(1000 * time.Millisecond)
+		node.Update(deltaTime)
+		time.Sleep(deltaTime)
 	}
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/aurelien-rainone/udpnet"
+)
+
+const (
+	protocolID = 0x99887766
+	deltaTime  = time.Duration(10) * time.Millisecond
+)
+
+func main() {
+	var (
+		bind       = flag.String("bind", "0.0.0.0", "local address to listen on")
+		port       = flag.Int("port", 30000, "port to listen on")
+		maxClients = flag.Int("max-clients", 64, "maximum number of clients")
+		bandwidth  = flag.Int("bandwidth", 0, "bytes per second each client can send, 0 for no cap")
+		idle       = flag.Duration("idle", time.Minute, "time after which clients not sending payloads are kicked")
+		timeout    = flag.Duration("timeout", 10*time.Second, "connection timeout")
+	)
+	flag.Parse()
+
+	relay, err := udpnet.NewRelay(protocolID, *timeout, *maxClients)
+	if err != nil {
+		fmt.Printf("could not create relay: %v\n", err)
+		return
+	}
+	if err := relay.SetBandwidth(*bandwidth); err != nil {
+		fmt.Printf("could not set bandwidth: %v\n", err)
+		return
+	}
+	relay.SetIdleTimeout(*idle)
+
+	ip := net.ParseIP(*bind)
+	if ip == nil {
+		fmt.Printf("invalid bind address %q\n", *bind)
+		return
+	}
+	addr := &net.UDPAddr{IP: ip, Port: *port}
+	if !relay.StartAddr(addr) {
+		fmt.Printf("could not start relay on %v\n", addr)
+		return
+	}
+	defer relay.Stop()
+
+	var (
+		stats   udpnet.RelayStats
+		elapsed time.Duration
+	)
+	for {
+		relay.Update(deltaTime)
+		time.Sleep(deltaTime)
+
+		// print the counters every second, when they changed
+		elapsed += deltaTime
+		if s := relay.Stats(); elapsed >= time.Second && s != stats {
+			stats = s
+			fmt.Printf("forwarded: %d, throttled: %d, unrouted: %d, expired: %d\n",
+				s.Forwarded, s.Throttled, s.Unrouted, s.Expired)
+			elapsed = 0
+		}
+	}
+}
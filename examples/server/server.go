@@ -27,12 +27,12 @@ func main() {
 
 	connection.Listen()
 
-	for {
-		if connection.IsConnected() {
-			packet := []byte("server to client")
-			connection.SendPacket(packet)
-		}
-
+	runner, err := udpnet.NewTickRunner(deltaTime, connection)
+	if err != nil {
+		fmt.Printf("could not create tick runner, %v\n", err)
+		return
+	}
+	runner.OnReceive(func(tick uint64) {
 		for {
 			var packet [256]byte
 
@@ -42,8 +42,14 @@ func main() {
 			}
 			fmt.Printf("received packet from client\n")
 		}
+	})
+	runner.OnSend(func(tick uint64) {
+		if connection.IsConnected() {
+			packet := []byte("server to client")
+			connection.SendPacket(packet)
+		}
+	})
 
-		connection.Update(deltaTime)
-		time.Sleep(deltaTime)
-	}
+	// run until the user ctrl-breaks...
+	runner.Run(nil)
 }
@@ -0,0 +1,224 @@
+package udpnet
+
+import (
+	"container/list"
+	"fmt"
+	"time"
+)
+
+// maxTrackedIPs is the default number of IPs a floodGuard tracks, the least
+// recently seen IPs are forgotten first.
+const maxTrackedIPs = 4096
+
+// RateLimits configures the flood protection of a server connection. The
+// zero value disables all limits.
+type RateLimits struct {
+	PacketsPerSecond  float64 // packets accepted per second from a single IP, 0 means unlimited
+	PacketBurst       int     // packets accepted in a burst from a single IP
+	RequestsPerSecond float64 // connection requests accepted per second from a single IP, 0 means unlimited
+	RequestBurst      int     // connection requests accepted in a burst from a single IP
+
+	// MaxPendingHandshakes is the maximum number of clients going through
+	// the connect token handshake at the same time, 0 means unlimited.
+	MaxPendingHandshakes int
+
+	// an IP is banned for BanDuration when more than BanThreshold of its
+	// packets are dropped by the rate limits within a second, a BanThreshold
+	// of 0 disables bans.
+	BanThreshold int
+	BanDuration  time.Duration
+}
+
+// DropStats counts the packets dropped by a server connection, by reason.
+type DropStats struct {
+	Invalid            uint // packets too short, or with an invalid protocol id or checksum
+	RateLimited        uint // packets over the per-IP packet rate
+	RequestRateLimited uint // connection requests over the per-IP request rate
+	Banned             uint // packets from banned IPs
+	HandshakesFull     uint // connection requests dropped because of too many pending handshakes
+	Undersized         uint // connection requests smaller than MinConnectionRequestSize
+	Replayed           uint // client packets replayed from another address
+	Bans               uint // number of bans issued
+
+	// AmplificationLimited counts the packets not sent to an unverified
+	// address because they would exceed the bytes received from it.
+	AmplificationLimited uint
+}
+
+// ipLimiter tracks the packets received from a single IP.
+type ipLimiter struct {
+	packets    float64       // available packet tokens
+	requests   float64       // available connection request tokens
+	violations int           // packets dropped by the rate limits in the current second
+	banned     time.Duration // time left before the ban is lifted
+	notified   bool          // the banned client has been told it is banned
+	element    *list.Element // position in the least recently seen list
+}
+
+// floodGuard applies the per-IP rate limits and bans of a server connection.
+type floodGuard struct {
+	limits   RateLimits
+	ips      map[string]*ipLimiter
+	seen     list.List     // tracked IPs, most recently seen first
+	capacity int           // maximum number of tracked IPs, maxTrackedIPs if 0
+	window   time.Duration // time elapsed in the current violation counting second
+	stats    DropStats
+}
+
+func (g *floodGuard) enabled() bool {
+	return g.limits.PacketsPerSecond > 0 || g.limits.RequestsPerSecond > 0
+}
+
+// limiter returns the limiter of ip. The table of tracked IPs is bounded, so
+// that spoofed sources can't grow it: when it is full the least recently seen
+// IP is forgotten.
+func (g *floodGuard) limiter(ip string) *ipLimiter {
+	if l, ok := g.ips[ip]; ok {
+		g.seen.MoveToFront(l.element)
+		return l
+	}
+	capacity := g.capacity
+	if capacity <= 0 {
+		capacity = maxTrackedIPs
+	}
+	for len(g.ips) >= capacity {
+		g.forget(g.seen.Back().Value.(string))
+	}
+	l := &ipLimiter{
+		packets:  float64(burst(g.limits.PacketBurst)),
+		requests: float64(burst(g.limits.RequestBurst)),
+	}
+	if g.ips == nil {
+		g.ips = make(map[string]*ipLimiter)
+	}
+	l.element = g.seen.PushFront(ip)
+	g.ips[ip] = l
+	return l
+}
+
+// forget stops tracking ip.
+func (g *floodGuard) forget(ip string) {
+	g.seen.Remove(g.ips[ip].element)
+	delete(g.ips, ip)
+}
+
+// allowPacket indicates if a packet from ip should be processed.
+func (g *floodGuard) allowPacket(ip string) bool {
+	if !g.enabled() {
+		return true
+	}
+	l := g.limiter(ip)
+	if l.banned > 0 {
+		g.stats.Banned++
+		return false
+	}
+	if g.limits.PacketsPerSecond > 0 {
+		if l.packets < 1 {
+			g.stats.RateLimited++
+			g.violation(ip, l)
+			return false
+		}
+		l.packets--
+	}
+	return true
+}
+
+// allowRequest indicates if a connection request from ip should be
+// processed, allowPacket must have been called before.
+func (g *floodGuard) allowRequest(ip string) bool {
+	if g.limits.RequestsPerSecond <= 0 {
+		return true
+	}
+	l := g.limiter(ip)
+	if l.requests < 1 {
+		g.stats.RequestRateLimited++
+		g.violation(ip, l)
+		return false
+	}
+	l.requests--
+	return true
+}
+
+func (g *floodGuard) violation(ip string, l *ipLimiter) {
+	l.violations++
+	if g.limits.BanThreshold > 0 && l.violations > g.limits.BanThreshold {
+		fmt.Printf("banning %v for %v\n", ip, g.limits.BanDuration)
+		l.banned = g.limits.BanDuration
+		l.violations = 0
+		g.stats.Bans++
+	}
+}
+
+// isBanned indicates if ip is currently banned.
+func (g *floodGuard) isBanned(ip string) bool {
+	l, ok := g.ips[ip]
+	return ok && l.banned > 0
+}
+
+// notifyBan indicates if ip is banned and hasn't been told yet.
+func (g *floodGuard) notifyBan(ip string) bool {
+	l, ok := g.ips[ip]
+	if !ok || l.banned <= 0 || l.notified {
+		return false
+	}
+	l.notified = true
+	return true
+}
+
+// update refills the rate limits, lifts expired bans and forgets the IPs
+// that are back to their initial state.
+func (g *floodGuard) update(dt time.Duration) {
+	g.window += dt
+	resetViolations := g.window >= time.Second
+	if resetViolations {
+		g.window = 0
+	}
+	packetBurst := float64(burst(g.limits.PacketBurst))
+	requestBurst := float64(burst(g.limits.RequestBurst))
+	for ip, l := range g.ips {
+		l.packets += g.limits.PacketsPerSecond * dt.Seconds()
+		if l.packets > packetBurst {
+			l.packets = packetBurst
+		}
+		l.requests += g.limits.RequestsPerSecond * dt.Seconds()
+		if l.requests > requestBurst {
+			l.requests = requestBurst
+		}
+		if resetViolations {
+			l.violations = 0
+		}
+		if l.banned > 0 {
+			l.banned -= dt
+			if l.banned <= 0 {
+				fmt.Printf("ban lifted for %v\n", ip)
+			}
+		}
+		if l.banned <= 0 && l.violations == 0 && l.packets == packetBurst && l.requests == requestBurst {
+			g.forget(ip)
+		}
+	}
+}
+
+func burst(b int) int {
+	if b < 1 {
+		return 1
+	}
+	return b
+}
+
+// SetRateLimits sets the per-IP rate limits and bans applied by a server
+// connection to the packets it receives.
+func (c *Conn) SetRateLimits(limits RateLimits) {
+	c.guard.limits = limits
+}
+
+// RateLimits returns the per-IP rate limits of the connection.
+func (c *Conn) RateLimits() RateLimits {
+	return c.guard.limits
+}
+
+// DropStats returns the number of packets dropped by the connection, by
+// reason.
+func (c *Conn) DropStats() DropStats {
+	return c.guard.stats
+}
@@ -0,0 +1,322 @@
+package udpnet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFloodGuard(t *testing.T) {
+	var g floodGuard
+
+	t.Logf("check disabled guard allows everything\n")
+	for i := 0; i < 100; i++ {
+		assert.True(t, g.allowPacket("1.2.3.4"))
+		assert.True(t, g.allowRequest("1.2.3.4"))
+	}
+	assert.Equal(t, DropStats{}, g.stats)
+
+	g.limits = RateLimits{
+		PacketsPerSecond:  10,
+		PacketBurst:       5,
+		RequestsPerSecond: 1,
+		RequestBurst:      2,
+		BanThreshold:      3,
+		BanDuration:       2 * time.Second,
+	}
+
+	t.Logf("check packet burst\n")
+	for i := 0; i < 5; i++ {
+		assert.True(t, g.allowPacket("1.2.3.4"))
+	}
+	assert.False(t, g.allowPacket("1.2.3.4"))
+	assert.True(t, g.allowPacket("5.6.7.8"), "limits are per IP")
+	assert.EqualValues(t, 1, g.stats.RateLimited)
+
+	t.Logf("check packet rate refill\n")
+	g.update(100 * time.Millisecond)
+	assert.True(t, g.allowPacket("1.2.3.4"))
+	assert.False(t, g.allowPacket("1.2.3.4"))
+	assert.EqualValues(t, 2, g.stats.RateLimited)
+
+	t.Logf("check request burst\n")
+	assert.True(t, g.allowRequest("5.6.7.8"))
+	assert.True(t, g.allowRequest("5.6.7.8"))
+	assert.False(t, g.allowRequest("5.6.7.8"))
+	assert.EqualValues(t, 1, g.stats.RequestRateLimited)
+
+	t.Logf("check ban\n")
+	g.update(time.Second)
+	for i := 0; i < 5; i++ {
+		g.allowPacket("1.2.3.4")
+	}
+	for i := 0; i < 4; i++ {
+		g.allowPacket("1.2.3.4")
+	}
+	assert.True(t, g.isBanned("1.2.3.4"))
+	assert.EqualValues(t, 1, g.stats.Bans)
+	g.update(time.Second)
+	assert.False(t, g.allowPacket("1.2.3.4"), "banned IP should be dropped")
+	assert.EqualValues(t, 1, g.stats.Banned)
+	g.update(time.Second)
+	assert.False(t, g.isBanned("1.2.3.4"))
+	assert.True(t, g.allowPacket("1.2.3.4"))
+
+	t.Logf("check idle IPs are forgotten\n")
+	g.update(time.Second)
+	g.update(time.Second)
+	assert.Len(t, g.ips, 0)
+
+	t.Logf("check the least recently seen IPs are forgotten first\n")
+	g.capacity = 2
+	for i := 0; i < 5; i++ {
+		g.allowPacket("1.2.3.4")
+	}
+	g.allowPacket("5.6.7.8")
+	g.allowPacket("9.10.11.12")
+	assert.Len(t, g.ips, 2)
+	assert.Equal(t, 2, g.seen.Len())
+	_, ok := g.ips["1.2.3.4"]
+	assert.False(t, ok, "least recently seen IP should be forgotten")
+	g.allowPacket("5.6.7.8")
+	g.allowPacket("13.14.15.16")
+	_, ok = g.ips["5.6.7.8"]
+	assert.True(t, ok, "recently seen IP should be kept")
+	_, ok = g.ips["9.10.11.12"]
+	assert.False(t, ok)
+}
+
+func TestConnectionFloodProtection(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(100) * time.Millisecond
+	)
+
+	server := NewConn(dummyCallback{}, protocolID, TimeOut)
+	server.SetHandshake(true)
+	server.SetRateLimits(RateLimits{
+		PacketsPerSecond:  100,
+		PacketBurst:       10,
+		RequestsPerSecond: 10,
+		RequestBurst:      2,
+		BanThreshold:      20,
+		BanDuration:       50 * time.Millisecond,
+	})
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+	server.Listen()
+
+	var socket Socket
+	require.NoError(t, socket.Open(clientPort))
+	defer socket.Close()
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+
+	// flood the server with garbage and connection requests
+	garbage := []byte{0xde, 0xad, 0xbe, 0xef, 0x00}
+	request := make([]byte, MinConnectionRequestSize)
+	copy(request, []byte{0x11, 0x11, 0x22, 0x22, connectionRequestPacket})
+	for i := 0; i < 50; i++ {
+		require.NoError(t, socket.Send(sAddr, garbage))
+		require.NoError(t, socket.Send(sAddr, request))
+	}
+	for i := 0; i < 10; i++ {
+		var packet [256]byte
+		server.ReceivePacket(packet[:])
+	}
+
+	stats := server.DropStats()
+	assert.True(t, stats.Invalid > 0, "garbage should be counted as invalid")
+	assert.True(t, stats.RateLimited > 0, "flood should be rate limited")
+	assert.EqualValues(t, 1, stats.Bans, "flooding IP should be banned")
+	assert.True(t, stats.Banned > 0, "packets from banned IP should be dropped")
+	assert.True(t, server.guard.isBanned("127.0.0.1"))
+
+	// the banned client is told why, only once
+	var denied int
+	for {
+		var from net.UDPAddr
+		var buf [256]byte
+		n := socket.Receive(&from, buf[:])
+		if n <= 0 {
+			break
+		}
+		if n == 6 && buf[4] == connectionDeniedPacket {
+			assert.Equal(t, DenyBanned, DenyReason(buf[5]))
+			denied++
+		}
+	}
+	assert.Equal(t, 1, denied)
+
+	assert.True(t, stats.RequestRateLimited > 0, "connection requests should be rate limited")
+
+	// the ban expires, as well as the connection accepted from the flood
+	updateConns(DeltaTime, 1000, func() bool {
+		return !server.guard.isBanned("127.0.0.1") && !server.IsConnected()
+	}, nil, server)
+	assert.False(t, server.guard.isBanned("127.0.0.1"))
+
+	// a well behaved client can then connect
+	client := NewConn(dummyCallback{}, protocolID, TimeOut)
+	client.SetHandshake(true)
+	require.True(t, client.Start(clientPort+1), "couldn't start client connection")
+	defer client.Stop()
+	client.Connect(sAddr)
+	updateConns(DeltaTime, 1000, func() bool {
+		return client.IsConnected() && server.IsConnected()
+	}, nil, client, server)
+	assert.True(t, client.IsConnected(), "client should be connected")
+	assert.True(t, server.IsConnected(), "server should be connected")
+}
+
+func TestConnectionReceiveLimit(t *testing.T) {
+	const TimeOut = time.Duration(100) * time.Millisecond
+
+	server := NewConn(dummyCallback{}, protocolID, TimeOut)
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+	server.Listen()
+
+	var socket Socket
+	require.NoError(t, socket.Open(clientPort))
+	defer socket.Close()
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+
+	garbage := []byte{0xde, 0xad, 0xbe, 0xef, 0x00}
+	for i := 0; i < 2*maxDatagramsPerReceive; i++ {
+		require.NoError(t, socket.Send(sAddr, garbage))
+	}
+	var packet [256]byte
+	assert.Equal(t, 0, server.ReceivePacket(packet[:]))
+	assert.True(t, server.DropStats().Invalid <= maxDatagramsPerReceive, "receive should stop after the datagram limit")
+	for i := 0; i < 2; i++ {
+		server.ReceivePacket(packet[:])
+	}
+	assert.EqualValues(t, 2*maxDatagramsPerReceive, server.DropStats().Invalid, "the next calls should read the remaining datagrams")
+}
+
+func TestConnectionMaxPendingHandshakes(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(100) * time.Millisecond
+	)
+
+	key, err := GenerateKey()
+	require.NoError(t, err)
+	issuer := NewTokenIssuer(protocolID, key)
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+
+	server := NewConn(dummyCallback{}, protocolID, TimeOut)
+	server.SetPrivateKey(key)
+	server.SetRateLimits(RateLimits{MaxPendingHandshakes: 2})
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+	server.Listen()
+
+	// clients send connection requests but never answer the challenges
+	for i := 0; i < 3; i++ {
+		token, err := issuer.Issue(uint64(i), []*net.UDPAddr{sAddr}, time.Minute, nil)
+		require.NoError(t, err)
+		client := NewConn(dummyCallback{}, protocolID, TimeOut)
+		require.True(t, client.Start(clientPort+i), "couldn't start client connection")
+		defer client.Stop()
+		require.NoError(t, client.ConnectWithToken(token))
+		client.Update(DeltaTime)
+	}
+	for i := 0; i < 10; i++ {
+		var packet [256]byte
+		server.ReceivePacket(packet[:])
+	}
+
+	assert.Len(t, server.pending, 2)
+	assert.EqualValues(t, 1, server.DropStats().HandshakesFull)
+
+	// pending handshakes expire
+	updateConns(DeltaTime, 1000, func() bool {
+		return len(server.pending) == 0
+	}, nil, server)
+	assert.Len(t, server.pending, 0)
+}
+
+func TestConnectionAmplification(t *testing.T) {
+	const TimeOut = time.Duration(100) * time.Millisecond
+
+	key, err := GenerateKey()
+	require.NoError(t, err)
+	issuer := NewTokenIssuer(protocolID, key)
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	token, err := issuer.Issue(42, []*net.UDPAddr{sAddr}, time.Minute, nil)
+	require.NoError(t, err)
+
+	server := NewConn(dummyCallback{}, protocolID, TimeOut)
+	server.SetPrivateKey(key)
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+	server.Listen()
+
+	var socket Socket
+	require.NoError(t, socket.Open(clientPort))
+	defer socket.Close()
+
+	// request builds a connection request carrying token, padded to size
+	request := func(size int) []byte {
+		packet := []byte{0x11, 0x11, 0x22, 0x22, connectionRequestPacket}
+		packet = append(packet, make([]byte, versionRequestSize)...)
+		packet = appendUint64(packet, uint64(token.ExpireTime.UnixNano()))
+		packet = append(packet, token.nonce[:]...)
+		packet = appendUint16(packet, uint16(len(token.private)))
+		packet = append(packet, token.private...)
+		if len(packet) < size {
+			packet = append(packet, make([]byte, size-len(packet))...)
+		}
+		return packet
+	}
+	// exchange sends packet, if any, to the server and returns the bytes it
+	// replied
+	exchange := func(packet []byte) (replied int) {
+		if packet != nil {
+			require.NoError(t, socket.Send(sAddr, packet))
+		}
+		for i := 0; i < 10; i++ {
+			var buf [256]byte
+			server.ReceivePacket(buf[:])
+		}
+		time.Sleep(10 * time.Millisecond)
+		for {
+			var from net.UDPAddr
+			var buf [2048]byte
+			n := socket.Receive(&from, buf[:])
+			if n <= 0 {
+				return replied
+			}
+			replied += n
+		}
+	}
+
+	t.Logf("check undersized request is dropped\n")
+	undersized := request(0)
+	require.True(t, len(undersized) < MinConnectionRequestSize)
+	assert.Equal(t, 0, exchange(undersized))
+	assert.EqualValues(t, 1, server.DropStats().Undersized)
+	assert.Len(t, server.pending, 0)
+
+	t.Logf("check padded request gets a smaller challenge\n")
+	var sent, replied int
+	for i := 0; i < 5; i++ {
+		padded := request(MinConnectionRequestSize)
+		sent += len(padded)
+		replied += exchange(padded)
+	}
+	assert.True(t, replied > 0, "server should send a challenge")
+	assert.True(t, replied <= sent, "server should never send more than it receives")
+	assert.Len(t, server.pending, 1)
+
+	t.Logf("check server won't exceed the bytes received from an unverified address\n")
+	cAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", clientPort))
+	assert.Error(t, server.sendPacket(cAddr, payloadPacket, make([]byte, sent), nil))
+	assert.EqualValues(t, 1, server.DropStats().AmplificationLimited)
+	assert.Equal(t, 0, exchange(nil))
+}
@@ -0,0 +1,573 @@
+package udpnet
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// packet types, written after the protocol id or checksum
+const (
+	payloadPacket byte = iota
+	connectionRequestPacket
+	connectionChallengePacket
+	connectionResponsePacket
+	connectionAcceptedPacket
+	connectionDeniedPacket
+	migrationChallengePacket
+	migrationResponsePacket
+	resumeRequestPacket
+	sessionResumedPacket
+	timeRequestPacket
+	timeResponsePacket
+	disconnectPacket
+)
+
+// DenyReason indicates why a server denied a connection request.
+type DenyReason byte
+
+const (
+	// DenyNone means the connection hasn't been denied.
+	DenyNone DenyReason = iota
+
+	// DenyServerFull means the server has no room for another client.
+	DenyServerFull
+
+	// DenyVersionMismatch means the client and the server protocol versions
+	// are incompatible.
+	DenyVersionMismatch
+
+	// DenyBanned means the client IP is banned by the server.
+	DenyBanned
+
+	// DenyInvalidToken means the connect token is missing, expired, not
+	// valid for the server or already used by another client.
+	DenyInvalidToken
+
+	// DenySessionExpired means the server doesn't know the session a client
+	// tries to resume.
+	DenySessionExpired
+)
+
+func (r DenyReason) String() string {
+	switch r {
+	case DenyNone:
+		return "none"
+	case DenyServerFull:
+		return "server full"
+	case DenyVersionMismatch:
+		return "version mismatch"
+	case DenyBanned:
+		return "banned"
+	case DenyInvalidToken:
+		return "invalid token"
+	case DenySessionExpired:
+		return "session expired"
+	}
+	return fmt.Sprintf("unknown deny reason %d", byte(r))
+}
+
+const (
+	// interval between connection requests sent by a connecting client
+	connectRequestInterval = 100 * time.Millisecond
+
+	challengeSize = 32
+
+	// size of the sequence and authentication tag of sealed packets
+	sealedOverhead = 8 + tokenTagSize
+
+	// maximum size of a connection request carrying a connect token
+	maxConnectionRequestSize = 5 + 8 + tokenNonceSize + 2 + maxPrivateToken
+
+	// number of sequences a session remembers to reject replayed packets
+	replayWindowSize = 256
+)
+
+// MinConnectionRequestSize is the size connection requests are padded to. It
+// is larger than any reply of a server to a connection request, servers
+// drop smaller requests so they can't be used to amplify reflection attacks.
+const MinConnectionRequestSize = 256
+
+// session holds the keys and sequence used to seal and open the packets
+// exchanged with a peer that joined with a connect token.
+type session struct {
+	clientID     uint64
+	userData     []byte
+	send         cipher.AEAD
+	recv         cipher.AEAD
+	sendSequence uint64
+	replay       replayWindow
+	received     bool // a packet has been opened
+
+	challenge  []byte        // server: challenge sent to the client during the handshake
+	negotiated negotiation   // server: version and features agreed on with the client
+	age        time.Duration // server: time since the handshake started
+}
+
+func newSession(sendKey, recvKey Key) (*session, error) {
+	send, err := newAEAD(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newAEAD(recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return &session{send: send, recv: recv}, nil
+}
+
+// seal appends the sequence and the sealed body to dst.
+func (s *session) seal(dst, ad, body []byte) []byte {
+	sequence := s.sendSequence
+	s.sendSequence++
+	dst = appendUint64(dst, sequence)
+	return s.send.Seal(dst, packetNonce(sequence), body, ad)
+}
+
+// open returns the body of a packet sealed by the remote end of the session.
+// Replayed packets are rejected.
+func (s *session) open(ad, sealed []byte) ([]byte, bool) {
+	body, _, ok := s.openFresh(ad, sealed)
+	return body, ok
+}
+
+// openFresh opens a packet like open, and indicates if its sequence is higher
+// than the sequence of all the packets opened before.
+func (s *session) openFresh(ad, sealed []byte) (body []byte, fresh, ok bool) {
+	if len(sealed) < sealedOverhead {
+		return nil, false, false
+	}
+	sequence := binary.BigEndian.Uint64(sealed)
+	if s.replay.alreadyReceived(sequence) {
+		return nil, false, false
+	}
+	body, err := s.recv.Open(nil, packetNonce(sequence), sealed[8:], ad)
+	if err != nil {
+		return nil, false, false
+	}
+	fresh = !s.received || sequence > s.replay.mostRecent
+	s.replay.advance(sequence)
+	s.received = true
+	return body, fresh, true
+}
+
+// replayWindow remembers the sequences of the last packets opened by a
+// session, like netcode.io. Packets older than the window, or whose sequence
+// was already opened, are replays.
+type replayWindow struct {
+	mostRecent uint64
+	received   [replayWindowSize]uint64 // sequence+1 of the packets opened, by sequence modulo the window size
+}
+
+// alreadyReceived indicates if a packet of given sequence must be rejected.
+func (w *replayWindow) alreadyReceived(sequence uint64) bool {
+	if sequence+replayWindowSize <= w.mostRecent {
+		return true
+	}
+	return w.received[sequence%replayWindowSize] >= sequence+1
+}
+
+// advance records that the packet of given sequence was opened.
+func (w *replayWindow) advance(sequence uint64) {
+	if sequence > w.mostRecent {
+		w.mostRecent = sequence
+	}
+	w.received[sequence%replayWindowSize] = sequence + 1
+}
+
+// amplificationBudget tracks the bytes exchanged by a server with an address
+// that has not proven yet it receives the packets sent to it.
+type amplificationBudget struct {
+	received int
+	sent     int
+	idle     time.Duration
+}
+
+// usedToken records the address that first presented a connect token.
+type usedToken struct {
+	address    string
+	expireTime time.Time
+}
+
+// SetPrivateKey sets the key shared by the server and the token issuer, it
+// enables secure joins: clients must present a valid connect token and all
+// packets are sealed with the keys of the token. It enables the handshake.
+func (c *Conn) SetPrivateKey(key Key) {
+	c.privateKey = &key
+	c.handshake = true
+}
+
+// ConnectWithToken sets the connection mode as client and tries to connect,
+// using token, to the servers listed in it, in order.
+func (c *Conn) ConnectWithToken(token *ConnectToken) error {
+	s, err := newSession(token.ClientToServerKey, token.ServerToClientKey)
+	if err != nil {
+		return err
+	}
+	c.handshake = true
+	c.Connect(token.ServerAddresses[0])
+	c.token = token
+	c.session = s
+	return nil
+}
+
+// ClientID returns the id of the client, as issued in its connect token or
+// assigned by the server. On a server, it returns the id of the client in the
+// first connected slot, see PeerBySlot.
+func (c *Conn) ClientID() uint64 {
+	if c.mode == Server {
+		if p := c.firstPeer(); p != nil {
+			return p.clientID
+		}
+		return 0
+	}
+	return c.clientID
+}
+
+// UserData returns, on a server, the user data of the connect token used by
+// the client in the first connected slot, see PeerBySlot.
+func (c *Conn) UserData() []byte {
+	if p := c.firstPeer(); p != nil {
+		return p.info().UserData
+	}
+	return nil
+}
+
+// DenyReason returns, on a client whose connection failed, the reason given
+// by the server that denied it, or DenyNone.
+func (c *Conn) DenyReason() DenyReason {
+	return c.denyReason
+}
+
+func (c *Conn) isSecure() bool {
+	return c.privateKey != nil || c.token != nil
+}
+
+// additionalData returns the data authenticated along sealed packets.
+func (c *Conn) additionalData(packetType byte) []byte {
+	var ad [5]byte
+	binary.BigEndian.PutUint32(ad[:], uint32(c.protocolID))
+	ad[4] = packetType
+	return ad[:]
+}
+
+func (c *Conn) sendConnectionRequest() {
+	body := c.appendVersions(nil)
+	if c.token != nil {
+		body = appendUint64(body, uint64(c.token.ExpireTime.UnixNano()))
+		body = append(body, c.token.nonce[:]...)
+		body = appendUint16(body, uint16(len(c.token.private)))
+		body = append(body, c.token.private...)
+	}
+	if padding := MinConnectionRequestSize - 5 - len(body); padding > 0 {
+		body = append(body, make([]byte, padding)...)
+	}
+	if err := c.sendPacket(c.address, connectionRequestPacket, body, nil); err != nil {
+		fmt.Printf("couldn't send connection request, %v\n", err)
+	}
+}
+
+func (c *Conn) processConnectionRequest(sender *net.UDPAddr, body []byte) {
+	if c.mode != Server {
+		return
+	}
+	if p := c.peerByAddress(sender); p != nil {
+		c.sendConnectionAccepted(p)
+		return
+	}
+	if s, ok := c.pending[sender.String()]; ok {
+		// the token was checked already, send the same challenge again
+		c.sendPacket(sender, connectionChallengePacket, s.challenge, s)
+		return
+	}
+	if len(body) < versionRequestSize {
+		return
+	}
+
+	// the token is opened first, so that the denials can be sealed with its
+	// keys
+	var s *session
+	if c.privateKey != nil {
+		if limit := c.guard.limits.MaxPendingHandshakes; limit > 0 && len(c.pending) >= limit {
+			c.guard.stats.HandshakesFull++
+			c.sendConnectionDenied(sender, DenyServerFull, nil)
+			return
+		}
+		var valid bool
+		if s, valid = c.openConnectToken(sender, body[versionRequestSize:]); !valid {
+			c.sendConnectionDenied(sender, DenyInvalidToken, s)
+			return
+		}
+	}
+	if c.freeSlot() < 0 {
+		c.sendConnectionDenied(sender, DenyServerFull, s)
+		return
+	}
+	n, ok := c.negotiate(body)
+	if !ok {
+		c.sendConnectionDenied(sender, DenyVersionMismatch, s)
+		return
+	}
+	if s == nil {
+		c.acceptConnection(sender, nil, n)
+		return
+	}
+	s.negotiated = n
+	s.challenge = make([]byte, challengeSize)
+	if _, err := rand.Read(s.challenge); err != nil {
+		return
+	}
+	c.pending[sender.String()] = s
+	c.sendPacket(sender, connectionChallengePacket, s.challenge, s)
+}
+
+// openConnectToken validates the connect token of a connection request. It
+// returns the session the token describes if it could be opened, even if the
+// token is rejected, so that the denial can be sealed.
+func (c *Conn) openConnectToken(sender *net.UDPAddr, body []byte) (s *session, valid bool) {
+	if len(body) < 8+tokenNonceSize+2 {
+		return nil, false
+	}
+	expire := time.Unix(0, int64(binary.BigEndian.Uint64(body)))
+	nonce := body[8 : 8+tokenNonceSize]
+	size := int(binary.BigEndian.Uint16(body[8+tokenNonceSize:]))
+	if size < tokenTagSize || len(body) < 8+tokenNonceSize+2+size {
+		return nil, false
+	}
+	sealed := body[8+tokenNonceSize+2 : 8+tokenNonceSize+2+size]
+	pt, err := openPrivateToken(c.protocolID, *c.privateKey, expire, nonce, sealed)
+	if err != nil {
+		fmt.Printf("connection request from %v denied: %v\n", sender.String(), err)
+		return nil, false
+	}
+	s, err = newSession(pt.serverToClientKey, pt.clientToServerKey)
+	if err != nil {
+		return nil, false
+	}
+	s.clientID = pt.clientID
+	s.userData = pt.userData
+	if !pt.hasAddress(c.transport.LocalAddr()) {
+		fmt.Printf("connection request from %v denied: wrong server\n", sender.String())
+		return s, false
+	}
+
+	now := time.Now()
+	for tag, used := range c.usedTokens {
+		if !now.Before(used.expireTime) {
+			delete(c.usedTokens, tag)
+		}
+	}
+	tag := string(sealed[len(sealed)-tokenTagSize:])
+	if used, ok := c.usedTokens[tag]; ok && used.address != sender.String() {
+		fmt.Printf("connection request from %v denied: token already used\n", sender.String())
+		return s, false
+	}
+	c.usedTokens[tag] = usedToken{address: sender.String(), expireTime: expire}
+	return s, true
+}
+
+func (c *Conn) processConnectionChallenge(sender *net.UDPAddr, body []byte) {
+	if c.mode != Client || c.state != connecting || c.session == nil || !sameAddress(sender, c.address) {
+		return
+	}
+	challenge, ok := c.session.open(c.additionalData(connectionChallengePacket), body)
+	if !ok {
+		return
+	}
+	c.sendPacket(c.address, connectionResponsePacket, challenge, c.session)
+}
+
+func (c *Conn) processConnectionResponse(sender *net.UDPAddr, body []byte) {
+	if c.mode != Server || c.privateKey == nil {
+		return
+	}
+	s, ok := c.pending[sender.String()]
+	if !ok {
+		return
+	}
+	challenge, ok := s.open(c.additionalData(connectionResponsePacket), body)
+	if !ok || !bytes.Equal(challenge, s.challenge) {
+		return
+	}
+	delete(c.pending, sender.String())
+	if c.freeSlot() < 0 {
+		c.sendConnectionDenied(sender, DenyServerFull, s)
+		return
+	}
+	if c.peerByClientID(s.clientID) != nil {
+		fmt.Printf("client %d is already connected\n", s.clientID)
+		c.sendConnectionDenied(sender, DenyInvalidToken, s)
+		return
+	}
+	c.acceptConnection(sender, s, s.negotiated)
+}
+
+// acceptConnection connects sender in the first free slot and returns it.
+func (c *Conn) acceptConnection(sender *net.UDPAddr, s *session, n negotiation) *peer {
+	slot := c.freeSlot()
+	fmt.Printf("server accepts connection from client %v in slot %d\n", sender.String(), slot)
+	delete(c.budgets, sender.String())
+	p := &peer{
+		slot:         slot,
+		sessionID:    c.newSessionID(),
+		resumeTicket: newResumeTicket(),
+		address:      sender,
+		session:      s,
+		negotiated:   n,
+	}
+	if s != nil {
+		p.clientID = s.clientID
+	} else {
+		c.nextClientID++
+		p.clientID = c.nextClientID
+	}
+	c.peers[slot] = p
+	c.state = connected
+	if c.handshake {
+		c.sendConnectionAccepted(p)
+	}
+	if sc, ok := c.cb.(SlotCallback); ok {
+		sc.OnClientConnect(slot)
+	}
+	c.cb.OnConnect()
+	return p
+}
+
+func (c *Conn) sendConnectionAccepted(p *peer) {
+	body := appendUint64(nil, p.clientID)
+	body = appendUint64(body, p.sessionID)
+	body = append(body, p.resumeTicket...)
+	body = appendUint32(body, uint32(c.resumeGrace/time.Millisecond))
+	body = appendUint16(body, p.negotiated.version)
+	body = appendUint32(body, p.negotiated.features)
+	c.sendPacket(p.address, connectionAcceptedPacket, body, p.session)
+}
+
+func (c *Conn) processConnectionAccepted(sender *net.UDPAddr, body []byte) {
+	if c.mode != Client || c.state != connecting || !sameAddress(sender, c.address) {
+		return
+	}
+	if len(body) != 8+sessionIDSize+resumeTicketSize+4+2+4 {
+		return
+	}
+	clientID := binary.BigEndian.Uint64(body)
+	sessionID := binary.BigEndian.Uint64(body[8:])
+	ticket := body[16 : 16+resumeTicketSize]
+	body = body[16+resumeTicketSize:]
+	grace := time.Duration(binary.BigEndian.Uint32(body)) * time.Millisecond
+	version := binary.BigEndian.Uint16(body[4:])
+	if version < c.minVersion || version > c.maxVersion {
+		return
+	}
+	c.clientID = clientID
+	c.sessionID = sessionID
+	c.resumeTicket = append([]byte(nil), ticket...)
+	c.ticketGrace = grace
+	c.negotiated = negotiation{
+		version:  version,
+		features: binary.BigEndian.Uint32(body[6:]) & c.features,
+	}
+	c.completeConnection()
+}
+
+// sendConnectionDenied tells addr its connection request is denied. The
+// denial is sealed with the session of the client connect token, if the
+// server could open it.
+func (c *Conn) sendConnectionDenied(addr *net.UDPAddr, reason DenyReason, s *session) {
+	fmt.Printf("server denies connection from %v: %v\n", addr.String(), reason)
+	c.sendPacket(addr, connectionDeniedPacket, []byte{byte(reason)}, s)
+}
+
+func (c *Conn) processConnectionDenied(sender *net.UDPAddr, body []byte) {
+	if c.mode != Client || (c.state != connecting && c.state != resuming) || !sameAddress(sender, c.address) {
+		return
+	}
+	if c.session != nil {
+		// anyone can forge the denials that are not sealed
+		var ok bool
+		if body, ok = c.session.open(c.additionalData(connectionDeniedPacket), body); !ok {
+			return
+		}
+	}
+	if len(body) != 1 {
+		return
+	}
+	c.denyReason = DenyReason(body[0])
+	if c.state == resuming {
+		fmt.Printf("couldn't resume session: %v\n", c.denyReason)
+		c.clearData()
+		c.cb.OnDisconnect()
+		return
+	}
+	if c.nextServer() {
+		fmt.Printf("connection denied: %v, trying next server %v\n", c.denyReason, c.address.String())
+		return
+	}
+	fmt.Printf("connection denied: %v\n", c.denyReason)
+	c.clearData()
+	c.state = connectFail
+	c.cb.OnDisconnect()
+}
+
+// nextServer moves a client connecting with a token to the next server of the
+// token, it returns false if there is none left.
+func (c *Conn) nextServer() bool {
+	if c.token == nil || c.tokenServer+1 >= len(c.token.ServerAddresses) {
+		return false
+	}
+	c.tokenServer++
+	c.address = c.token.ServerAddresses[c.tokenServer]
+	c.timeoutAccumulator = 0
+	c.requestAccumulator = 0
+	return true
+}
+
+func (c *Conn) completeConnection() {
+	fmt.Printf("client completes connection with server\n")
+	c.state = connected
+	c.timeoutAccumulator = 0
+	c.cb.OnConnect()
+}
+
+// updateHandshakes drops the pending handshakes older than the timeout, and
+// forgets the unverified addresses idle for longer than the timeout.
+func (c *Conn) updateHandshakes(dt time.Duration) {
+	for addr, s := range c.pending {
+		s.age += dt
+		if s.age > c.timeout {
+			delete(c.pending, addr)
+		}
+	}
+	for addr, b := range c.budgets {
+		b.idle += dt
+		if b.idle > c.timeout {
+			delete(c.budgets, addr)
+		}
+	}
+}
+
+// isVerified indicates if addr is the address of a connected client. With
+// connect tokens, the client proves it receives the server packets by
+// answering the challenge before being connected.
+func (c *Conn) isVerified(addr *net.UDPAddr) bool {
+	return c.peerByAddress(addr) != nil
+}
+
+// budget returns the amplification budget of an unverified address.
+func (c *Conn) budget(addr *net.UDPAddr) *amplificationBudget {
+	b, ok := c.budgets[addr.String()]
+	if !ok {
+		b = &amplificationBudget{}
+		c.budgets[addr.String()] = b
+	}
+	return b
+}
+
+func sameAddress(a, b *net.UDPAddr) bool {
+	// TODO: Aurelien, should check if this the only way to compare two net.UDPAddr
+	return a != nil && b != nil && a.String() == b.String()
+}
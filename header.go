@@ -0,0 +1,307 @@
+package udpnet
+
+import "encoding/binary"
+
+// HeaderFormat indicates how a ReliableConn encodes the sequence, ack and ack
+// bits at the start of every packet.
+type HeaderFormat int
+
+const (
+	// FixedHeader is the original 12 bytes header: 32-bit sequence, 32-bit
+	// ack and 32 ack bits.
+	FixedHeader HeaderFormat = iota
+
+	// CompactHeader is a variable-length header of 4 to 9 bytes, based on
+	// the reliable.io packet header. Sequence numbers are 16-bit so it
+	// requires a maximum sequence of MaxCompactSequence or less.
+	CompactHeader
+)
+
+// MaxCompactSequence is the highest maximum sequence value that can be used
+// with CompactHeader.
+const MaxCompactSequence = 0xFFFF
+
+// compact header layout: prefix byte, 2 bytes sequence, ack as a 1 byte delta
+// from sequence or as 2 bytes, then 0 to 4 bytes of ack bits.
+// Bits 0-3 of the prefix byte are set when the corresponding ack bits byte is
+// written, ack bits bytes equal to 0xFF are omitted. Bit 4 is set when the ack
+// is written as a delta.
+const (
+	compactAckBitsMask  = 0x0F
+	compactAckDeltaFlag = 0x10
+
+	minCompactHeaderSize = 4
+	maxCompactHeaderSize = 9
+)
+
+// sequenceDelta returns the distance from s2 to s1, s1 being more recent,
+// taking wrap around into account.
+func sequenceDelta(s1, s2, maxSequence uint) uint {
+	if s1 >= s2 {
+		return s1 - s2
+	}
+	return maxSequence + 1 - s2 + s1
+}
+
+func compactHeaderSize(sequence, ack, ackBits, maxSequence uint) int {
+	size := 3
+	if sequenceDelta(sequence, ack, maxSequence) <= 0xFF {
+		size++
+	} else {
+		size += 2
+	}
+	for i := uint(0); i < 4; i++ {
+		if byte(ackBits>>(8*i)) != 0xFF {
+			size++
+		}
+	}
+	return size
+}
+
+// writeCompactHeader writes a compact header at the start of header and
+// returns the number of bytes written. header must be at least
+// maxCompactHeaderSize bytes long.
+func writeCompactHeader(header []byte, sequence, ack, ackBits, maxSequence uint) int {
+	var prefix byte
+	header[1] = byte(sequence >> 8)
+	header[2] = byte(sequence & 0xFF)
+	i := 3
+	if delta := sequenceDelta(sequence, ack, maxSequence); delta <= 0xFF {
+		prefix |= compactAckDeltaFlag
+		header[i] = byte(delta)
+		i++
+	} else {
+		header[i] = byte(ack >> 8)
+		header[i+1] = byte(ack & 0xFF)
+		i += 2
+	}
+	for b := uint(0); b < 4; b++ {
+		bits := byte(ackBits >> (8 * b))
+		if bits != 0xFF {
+			prefix |= 1 << b
+			header[i] = bits
+			i++
+		}
+	}
+	header[0] = prefix
+	return i
+}
+
+// readCompactHeader reads the compact header at the start of header. It
+// returns the header size, or 0 if the header is truncated or malformed.
+func readCompactHeader(header []byte, maxSequence uint) (sequence, ack, ackBits uint, size int) {
+	if len(header) < minCompactHeaderSize {
+		return 0, 0, 0, 0
+	}
+	prefix := header[0]
+	if prefix&^(compactAckBitsMask|compactAckDeltaFlag) != 0 {
+		return 0, 0, 0, 0
+	}
+	sequence = uint(header[1])<<8 | uint(header[2])
+	i := 3
+	if prefix&compactAckDeltaFlag != 0 {
+		delta := uint(header[i])
+		if delta > maxSequence {
+			return 0, 0, 0, 0
+		}
+		ack = sequenceDelta(sequence, delta, maxSequence)
+		i++
+	} else {
+		if len(header) < i+2 {
+			return 0, 0, 0, 0
+		}
+		ack = uint(header[i])<<8 | uint(header[i+1])
+		i += 2
+	}
+	if sequence > maxSequence || ack > maxSequence {
+		return 0, 0, 0, 0
+	}
+	for b := uint(0); b < 4; b++ {
+		bits := uint(0xFF)
+		if prefix&(1<<b) != 0 {
+			if len(header) <= i {
+				return 0, 0, 0, 0
+			}
+			bits = uint(header[i])
+			i++
+		}
+		ackBits |= bits << (8 * b)
+	}
+	return sequence, ack, ackBits, i
+}
+
+// ack extension layout, appended to the reliability header when the ack
+// window is wider than 32 or ack ranges are enabled: (window-32)/8 bytes of
+// ack bits, then if ack ranges are enabled a count byte followed by 2 bytes
+// offset and 2 bytes count per range.
+
+func maxAckExtensionSize(window uint, maxRanges int) int {
+	size := int(window-32) / 8
+	if maxRanges > 0 {
+		size += 1 + 4*maxRanges
+	}
+	return size
+}
+
+func ackExtensionSize(ext ackExtension, maxRanges int) int {
+	size := len(ext.bits)
+	if maxRanges > 0 {
+		size += 1 + 4*len(ext.ranges)
+	}
+	return size
+}
+
+// writeAckExtension writes ext at the start of buf and returns the number of
+// bytes written.
+func writeAckExtension(buf []byte, ext ackExtension, maxRanges int) int {
+	i := copy(buf, ext.bits)
+	if maxRanges == 0 {
+		return i
+	}
+	buf[i] = byte(len(ext.ranges))
+	i++
+	for _, r := range ext.ranges {
+		buf[i] = byte(r.offset >> 8)
+		buf[i+1] = byte(r.offset & 0xFF)
+		buf[i+2] = byte(r.count >> 8)
+		buf[i+3] = byte(r.count & 0xFF)
+		i += 4
+	}
+	return i
+}
+
+// readAckExtension reads the ack extension at the start of buf. It returns
+// the extension size, or 0 if it is truncated or malformed.
+func readAckExtension(buf []byte, window uint, maxRanges int) (ackExtension, int) {
+	var ext ackExtension
+	n := int(window-32) / 8
+	if len(buf) < n {
+		return ext, 0
+	}
+	if n > 0 {
+		ext.bits = make([]byte, n)
+		copy(ext.bits, buf)
+	}
+	if maxRanges == 0 {
+		return ext, n
+	}
+	if len(buf) <= n {
+		return ext, 0
+	}
+	count := int(buf[n])
+	i := n + 1
+	if count > maxRanges || len(buf) < i+4*count {
+		return ext, 0
+	}
+	for r := 0; r < count; r++ {
+		ext.ranges = append(ext.ranges, ackRange{
+			offset: uint(buf[i])<<8 | uint(buf[i+1]),
+			count:  uint(buf[i+2])<<8 | uint(buf[i+3]),
+		})
+		i += 4
+	}
+	return ext, i
+}
+
+// writeFixedHeader writes the 12 bytes fixed header at the start of header.
+func writeFixedHeader(header []byte, sequence, ack, ackBits uint) {
+	binary.BigEndian.PutUint32(header, uint32(sequence))
+	binary.BigEndian.PutUint32(header[4:], uint32(ack))
+	binary.BigEndian.PutUint32(header[8:], uint32(ackBits))
+}
+
+// readFixedHeader reads the 12 bytes fixed header at the start of header.
+func readFixedHeader(header []byte) (sequence, ack, ackBits uint) {
+	sequence = uint(binary.BigEndian.Uint32(header))
+	ack = uint(binary.BigEndian.Uint32(header[4:]))
+	ackBits = uint(binary.BigEndian.Uint32(header[8:]))
+	return
+}
+
+// maxReliabilityHeaderSize returns the maximum size of the reliability header
+// of rs in given format, ack extension included.
+func maxReliabilityHeaderSize(rs *ReliabilitySystem, format HeaderFormat) int {
+	size := rs.HeaderSize()
+	if format == CompactHeader {
+		size = maxCompactHeaderSize
+	}
+	if rs.hasAckExtension() {
+		size += maxAckExtensionSize(rs.AckWindow(), rs.MaxAckRanges())
+	}
+	return size
+}
+
+// reliabilityHeaderSize returns the size of the reliability header of the
+// next packet sent with rs in given format, ack extension included.
+func reliabilityHeaderSize(rs *ReliabilitySystem, format HeaderFormat) int {
+	size := rs.HeaderSize()
+	if format == CompactHeader {
+		size = compactHeaderSize(rs.LocalSequence(), rs.RemoteSequence(), rs.GenerateAckBits(), rs.MaxSequence())
+	}
+	if rs.hasAckExtension() {
+		size += rs.ackExtensionSize()
+	}
+	return size
+}
+
+// encodeReliabilityHeader writes the header in given format, followed by the
+// ack extension of rs if any, and returns its size. packet must be at least
+// maxReliabilityHeaderSize bytes long.
+func encodeReliabilityHeader(packet []byte, rs *ReliabilitySystem, format HeaderFormat, sequence, ack, ackBits uint) int {
+	var size int
+	if format == CompactHeader {
+		size = writeCompactHeader(packet, sequence, ack, ackBits, rs.MaxSequence())
+	} else {
+		writeFixedHeader(packet, sequence, ack, ackBits)
+		size = rs.HeaderSize()
+	}
+	if rs.hasAckExtension() {
+		size += writeAckExtension(packet[size:], rs.generateAckExtension(), rs.MaxAckRanges())
+	}
+	return size
+}
+
+// decodeReliabilityHeader reads the header in given format, followed by the
+// ack extension of rs if any. size is 0 if the header is invalid.
+func decodeReliabilityHeader(packet []byte, rs *ReliabilitySystem, format HeaderFormat) (sequence, ack, ackBits uint, ext ackExtension, size int) {
+	if format == CompactHeader {
+		sequence, ack, ackBits, size = readCompactHeader(packet, rs.MaxSequence())
+		if size == 0 {
+			return 0, 0, 0, ext, 0
+		}
+	} else {
+		size = rs.HeaderSize()
+		if len(packet) < size {
+			return 0, 0, 0, ext, 0
+		}
+		sequence, ack, ackBits = readFixedHeader(packet)
+	}
+	if rs.hasAckExtension() {
+		var n int
+		ext, n = readAckExtension(packet[size:], rs.AckWindow(), rs.MaxAckRanges())
+		if n == 0 {
+			return 0, 0, 0, ext, 0
+		}
+		size += n
+	}
+	return sequence, ack, ackBits, ext, size
+}
+
+// processReliabilityHeader decodes the reliability header at the start of
+// packet and accounts for the packet and its acks in rs. It returns the
+// header size, the packet being ack-only if it is the packet size, or 0 if
+// the header is invalid.
+func processReliabilityHeader(packet []byte, rs *ReliabilitySystem, format HeaderFormat) int {
+	sequence, ack, ackBits, ext, size := decodeReliabilityHeader(packet, rs, format)
+	if size == 0 {
+		return 0
+	}
+	if len(packet) > size {
+		rs.PacketReceived(sequence, len(packet)-size)
+	}
+	rs.ProcessAck(ack, ackBits)
+	if rs.hasAckExtension() {
+		rs.processAckExtension(ack, ext)
+	}
+	return size
+}
@@ -0,0 +1,196 @@
+package udpnet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactHeader(t *testing.T) {
+	tests := []struct {
+		sequence, ack, ackBits, maxSequence uint
+		size                                int
+	}{
+		{100, 99, 0xFFFFFFFF, MaxCompactSequence, 4},
+		{100, 100, 0xFFFFFFFE, MaxCompactSequence, 5},
+		{100, 100, 0x00FFFF00, MaxCompactSequence, 6},
+		{1000, 10, 0x00000000, MaxCompactSequence, 9},
+		{5, 65530, 0xFFFFFFFF, MaxCompactSequence, 4},
+		{65530, 5, 0xFFFFFFFF, MaxCompactSequence, 5},
+		{3, 30, 0xFF00FFFF, 31, 5},
+		{0, 0, 0, 0xFFFF, 8},
+	}
+
+	for _, tt := range tests {
+		t.Logf("check compact header %+v\n", tt)
+		var header [maxCompactHeaderSize]byte
+		size := writeCompactHeader(header[:], tt.sequence, tt.ack, tt.ackBits, tt.maxSequence)
+		assert.Equal(t, tt.size, size)
+		assert.Equal(t, tt.size, compactHeaderSize(tt.sequence, tt.ack, tt.ackBits, tt.maxSequence))
+
+		sequence, ack, ackBits, n := readCompactHeader(header[:size], tt.maxSequence)
+		assert.Equal(t, size, n)
+		assert.EqualValues(t, tt.sequence, sequence)
+		assert.EqualValues(t, tt.ack, ack)
+		assert.EqualValues(t, tt.ackBits, ackBits)
+
+		_, _, _, n = readCompactHeader(header[:size-1], tt.maxSequence)
+		assert.Equal(t, 0, n, "truncated header should be rejected")
+	}
+
+	t.Logf("check invalid prefix\n")
+	_, _, _, n := readCompactHeader([]byte{0x20, 0, 1, 1}, MaxCompactSequence)
+	assert.Equal(t, 0, n)
+
+	t.Logf("check sequence above maxSequence\n")
+	_, _, _, n = readCompactHeader([]byte{0x10, 0, 40, 1}, 31)
+	assert.Equal(t, 0, n)
+}
+
+func TestCompactHeaderMaxSequence(t *testing.T) {
+	c := NewReliableConn(protocolID, time.Second, maxSequence)
+	assert.Error(t, c.SetHeaderFormat(CompactHeader))
+	assert.Equal(t, FixedHeader, c.HeaderFormat())
+	assert.Equal(t, 16, c.HeaderSize())
+
+	c = NewReliableConn(protocolID, time.Second, MaxCompactSequence)
+	assert.NoError(t, c.SetHeaderFormat(CompactHeader))
+	assert.Equal(t, CompactHeader, c.HeaderFormat())
+	// no packet received yet: ack 0, no ack bits
+	assert.Equal(t, 4+8, c.HeaderSize())
+}
+
+func TestCompactHeaderAcks(t *testing.T) {
+	const (
+		DeltaTime   = time.Millisecond
+		TimeOut     = time.Duration(100) * time.Millisecond
+		PacketCount = 100
+	)
+
+	client := NewReliableConn(protocolID, TimeOut, MaxCompactSequence)
+	require.NoError(t, client.SetHeaderFormat(CompactHeader))
+	require.True(t, client.Start(clientPort), "couldn't start client connection")
+	defer client.Stop()
+
+	server := NewReliableConn(protocolID, TimeOut, MaxCompactSequence)
+	require.NoError(t, server.SetHeaderFormat(CompactHeader))
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+
+	cAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	client.Connect(cAddr)
+	server.Listen()
+
+	var (
+		clientAckedPackets [PacketCount]bool
+		serverAckedPackets [PacketCount]bool
+		allPacketsAcked    bool
+	)
+
+	for {
+		if !client.IsConnecting() && client.ConnectFailed() {
+			break
+		}
+		if allPacketsAcked {
+			break
+		}
+
+		var ackPacket [256]byte
+		for i := range ackPacket {
+			ackPacket[i] = byte(i)
+		}
+
+		client.SendPacket(ackPacket[:])
+		server.SendPacket(ackPacket[:])
+
+		for {
+			var packet [256]byte
+			bytesRead := client.ReceivePacket(packet[:])
+			if bytesRead == 0 {
+				break
+			}
+			assert.EqualValues(t, bytesRead, 256)
+			for i := range packet {
+				assert.EqualValues(t, packet[i], i)
+			}
+		}
+
+		for {
+			var packet [256]byte
+			bytesRead := server.ReceivePacket(packet[:])
+			if bytesRead == 0 {
+				break
+			}
+			assert.EqualValues(t, bytesRead, 256)
+			for i := range packet {
+				assert.EqualValues(t, packet[i], i)
+			}
+		}
+
+		for _, ack := range client.ReliabilitySystem().Acks() {
+			if ack < PacketCount {
+				assert.False(t, clientAckedPackets[ack])
+				clientAckedPackets[ack] = true
+			}
+		}
+		for _, ack := range server.ReliabilitySystem().Acks() {
+			if ack < PacketCount {
+				assert.False(t, serverAckedPackets[ack])
+				serverAckedPackets[ack] = true
+			}
+		}
+
+		var clientAckCount, serverAckCount uint
+		for i := 0; i < PacketCount; i++ {
+			if clientAckedPackets[i] {
+				clientAckCount++
+			}
+			if serverAckedPackets[i] {
+				serverAckCount++
+			}
+		}
+		allPacketsAcked = clientAckCount == PacketCount && serverAckCount == PacketCount
+
+		client.Update(DeltaTime)
+		validateReliabilitySystem(t, client.reliabilitySystem)
+		server.Update(DeltaTime)
+		validateReliabilitySystem(t, server.reliabilitySystem)
+	}
+
+	assert.True(t, client.IsConnected(), "client should be connected")
+	assert.True(t, server.IsConnected(), "server should be connected")
+	// steady state: ack one behind or equal to sequence and all ack bits set
+	assert.True(t, client.HeaderSize() <= 4+6, "compact header should be at most 6 bytes")
+}
+
+func TestAckExtensionHeader(t *testing.T) {
+	ext := ackExtension{
+		bits:   []byte{0x01, 0x02, 0x03, 0x04},
+		ranges: []ackRange{{offset: 69, count: 2}, {offset: 300, count: 1000}},
+	}
+	var buf [64]byte
+	size := writeAckExtension(buf[:], ext, 4)
+	assert.Equal(t, 4+1+8, size)
+	assert.Equal(t, size, ackExtensionSize(ext, 4))
+	assert.True(t, size <= maxAckExtensionSize(64, 4))
+
+	read, n := readAckExtension(buf[:size], 64, 4)
+	assert.Equal(t, size, n)
+	assert.Equal(t, ext, read)
+
+	_, n = readAckExtension(buf[:size-1], 64, 4)
+	assert.Equal(t, 0, n, "truncated extension should be rejected")
+	_, n = readAckExtension(buf[:size], 64, 1)
+	assert.Equal(t, 0, n, "too many ranges should be rejected")
+
+	t.Logf("check extension without ranges\n")
+	size = writeAckExtension(buf[:], ackExtension{bits: ext.bits}, 0)
+	assert.Equal(t, 4, size)
+	read, n = readAckExtension(buf[:size], 64, 0)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, ext.bits, read.bits)
+}
@@ -0,0 +1,268 @@
+package udpnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// MaxInputSize is the maximum size of an input.
+	MaxInputSize = 256
+
+	// MaxInputRedundancy is the maximum number of inputs sent in a packet.
+	MaxInputRedundancy = 64
+
+	// inputHeaderSize is the size of the header of an input, its tick and
+	// size.
+	inputHeaderSize = 8 + 2
+
+	// maxInputLead is the maximum number of ticks an input received can be
+	// ahead of the next input to deliver.
+	maxInputLead = 1024
+
+	// maxBufferedInputs is the maximum number of inputs an InputReceiver
+	// holds until they are delivered.
+	maxBufferedInputs = 4 * MaxInputRedundancy
+)
+
+// Input is the input of a client for a tick.
+type Input struct {
+	Tick uint64
+	Data []byte
+	Gap  uint64 // number of inputs missing right before this one
+}
+
+// inputPacket is a packet sent by an InputSender.
+type inputPacket struct {
+	sequence uint   // sequence of the packet
+	tick     uint64 // newest input tick in the packet
+}
+
+// InputSender sends, on a client, its inputs with redundancy: each packet
+// carries the last inputs not acked yet, so that inputs lost with a packet
+// are received with the next ones. The client adds an input every tick.
+//
+// Acks come from the reliability system of the connection: an acked packet
+// acks the inputs it carried and all the older ones.
+type InputSender struct {
+	redundancy int
+	inputs     []Input       // inputs not acked yet, oldest first
+	packets    []inputPacket // packets in flight, oldest first
+	acked      uint64        // newest input tick acked
+	hasAcked   bool
+}
+
+// NewInputSender returns a sender of up to redundancy inputs per packet.
+func NewInputSender(redundancy int) (*InputSender, error) {
+	if redundancy < 1 || redundancy > MaxInputRedundancy {
+		return nil, fmt.Errorf("redundancy must be from 1 to %d", MaxInputRedundancy)
+	}
+	return &InputSender{redundancy: redundancy}, nil
+}
+
+// Add adds the input of a tick. Ticks must increase.
+func (is *InputSender) Add(tick uint64, data []byte) error {
+	if len(data) > MaxInputSize {
+		return fmt.Errorf("input too big, %d bytes max", MaxInputSize)
+	}
+	if n := len(is.inputs); (n > 0 && tick <= is.inputs[n-1].Tick) || (is.hasAcked && tick <= is.acked) {
+		return errors.New("input ticks must increase")
+	}
+	is.inputs = append(is.inputs, Input{Tick: tick, Data: append([]byte(nil), data...)})
+	if len(is.inputs) > is.redundancy {
+		// too old to be sent anymore
+		copy(is.inputs, is.inputs[1:])
+		is.inputs[len(is.inputs)-1] = Input{}
+		is.inputs = is.inputs[:len(is.inputs)-1]
+	}
+	return nil
+}
+
+// Pending returns the number of inputs not acked yet, that the next packet
+// carries.
+func (is *InputSender) Pending() int {
+	return len(is.inputs)
+}
+
+// Acked returns the newest input tick acked.
+func (is *InputSender) Acked() (uint64, bool) {
+	return is.acked, is.hasAcked
+}
+
+// Encode returns the inputs not acked yet, to be sent in the packet of given
+// sequence, usually the local sequence of the reliability system. It returns
+// nil if there is no input to send.
+func (is *InputSender) Encode(sequence uint) []byte {
+	if len(is.inputs) == 0 {
+		return nil
+	}
+	buf := []byte{byte(len(is.inputs))}
+	for _, in := range is.inputs {
+		buf = appendUint64(buf, in.Tick)
+		buf = appendUint16(buf, uint16(len(in.Data)))
+		buf = append(buf, in.Data...)
+	}
+	if len(is.packets) == MaxInputRedundancy {
+		copy(is.packets, is.packets[1:])
+		is.packets = is.packets[:MaxInputRedundancy-1]
+	}
+	is.packets = append(is.packets, inputPacket{sequence: sequence, tick: is.inputs[len(is.inputs)-1].Tick})
+	return buf
+}
+
+// ProcessAcks removes the inputs carried by the acked packets. acks are the
+// acks of the reliability system, to pass after receiving packets and before
+// updating it.
+func (is *InputSender) ProcessAcks(acks []uint) {
+	for _, ack := range acks {
+		for _, p := range is.packets {
+			if p.sequence == ack && (!is.hasAcked || p.tick > is.acked) {
+				is.acked = p.tick
+				is.hasAcked = true
+			}
+		}
+	}
+	if !is.hasAcked {
+		return
+	}
+	inputs := is.inputs[:0]
+	for _, in := range is.inputs {
+		if in.Tick > is.acked {
+			inputs = append(inputs, in)
+		}
+	}
+	for i := len(inputs); i < len(is.inputs); i++ {
+		is.inputs[i] = Input{}
+	}
+	is.inputs = inputs
+	packets := is.packets[:0]
+	for _, p := range is.packets {
+		if p.tick > is.acked {
+			packets = append(packets, p)
+		}
+	}
+	is.packets = packets
+}
+
+// InputReceiver receives, on the server, the inputs of a client sent by an
+// InputSender. Inputs received several times are dropped, and inputs are
+// delivered in tick order. An input missing is waited for as long as it can
+// still arrive with the next packets, that is until inputs redundancy ticks
+// newer are received. It is then reported as a gap.
+//
+// Packets with inputs too far ahead of the next input to deliver are
+// refused, and inputs received while the receiver holds too many inputs not
+// delivered yet are dropped.
+type InputReceiver struct {
+	redundancy int
+	started    bool
+	next       uint64  // tick of the next input to deliver
+	inputs     []Input // inputs received and not delivered, by tick
+	duplicates uint64  // number of inputs received more than once
+	lost       uint64  // number of inputs never received
+}
+
+// NewInputReceiver returns a receiver of the inputs of a sender of same
+// redundancy.
+func NewInputReceiver(redundancy int) (*InputReceiver, error) {
+	if redundancy < 1 || redundancy > MaxInputRedundancy {
+		return nil, fmt.Errorf("redundancy must be from 1 to %d", MaxInputRedundancy)
+	}
+	return &InputReceiver{redundancy: redundancy}, nil
+}
+
+// Stats returns the number of inputs received more than once, and the number
+// of inputs never received.
+func (ir *InputReceiver) Stats() (duplicates, lost uint64) {
+	return ir.duplicates, ir.lost
+}
+
+// Decode adds the inputs of a packet sent by an InputSender.
+func (ir *InputReceiver) Decode(data []byte) error {
+	if len(data) < 1 {
+		return errors.New("truncated inputs")
+	}
+	n := int(data[0])
+	data = data[1:]
+	if n > ir.redundancy {
+		return errors.New("too many inputs")
+	}
+	received := make([]Input, 0, n)
+	for i := 0; i < n; i++ {
+		if len(data) < inputHeaderSize {
+			return errors.New("truncated inputs")
+		}
+		tick := binary.BigEndian.Uint64(data)
+		size := int(binary.BigEndian.Uint16(data[8:]))
+		data = data[inputHeaderSize:]
+		if size > MaxInputSize || len(data) < size {
+			return errors.New("truncated inputs")
+		}
+		received = append(received, Input{Tick: tick, Data: append([]byte(nil), data[:size]...)})
+		data = data[size:]
+	}
+	if len(data) != 0 {
+		return errors.New("trailing data in inputs")
+	}
+	next := ir.next
+	if !ir.started && n > 0 {
+		next = received[0].Tick
+	}
+	for _, in := range received {
+		if in.Tick > next && in.Tick-next > maxInputLead {
+			return fmt.Errorf("input tick %d too far ahead, %d ticks max", in.Tick, maxInputLead)
+		}
+	}
+
+	for _, in := range received {
+		if !ir.started {
+			ir.started = true
+			ir.next = in.Tick
+		}
+		if in.Tick < ir.next {
+			ir.duplicates++
+			continue
+		}
+		i := 0
+		for i < len(ir.inputs) && ir.inputs[i].Tick < in.Tick {
+			i++
+		}
+		if i < len(ir.inputs) && ir.inputs[i].Tick == in.Tick {
+			ir.duplicates++
+			continue
+		}
+		if len(ir.inputs) == maxBufferedInputs {
+			// never delivered, reported in a gap
+			continue
+		}
+		ir.inputs = append(ir.inputs, Input{})
+		copy(ir.inputs[i+1:], ir.inputs[i:])
+		ir.inputs[i] = in
+	}
+	return nil
+}
+
+// Next returns the next input in tick order, if it was received or if the
+// inputs before it can't be received anymore. It returns false if there is
+// no input to deliver yet.
+func (ir *InputReceiver) Next() (Input, bool) {
+	if len(ir.inputs) == 0 {
+		return Input{}, false
+	}
+	in := ir.inputs[0]
+	if in.Tick != ir.next {
+		newest := ir.inputs[len(ir.inputs)-1].Tick
+		if newest-ir.next < uint64(ir.redundancy) {
+			// the missing inputs may still arrive
+			return Input{}, false
+		}
+		in.Gap = in.Tick - ir.next
+		ir.lost += in.Gap
+	}
+	copy(ir.inputs, ir.inputs[1:])
+	ir.inputs[len(ir.inputs)-1] = Input{}
+	ir.inputs = ir.inputs[:len(ir.inputs)-1]
+	ir.next = in.Tick + 1
+	return in, true
+}
@@ -0,0 +1,198 @@
+package udpnet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInputRedundancy(t *testing.T) {
+	_, err := NewInputSender(0)
+	assert.Error(t, err)
+	_, err = NewInputReceiver(MaxInputRedundancy + 1)
+	assert.Error(t, err)
+
+	is, err := NewInputSender(4)
+	require.NoError(t, err)
+	ir, err := NewInputReceiver(4)
+	require.NoError(t, err)
+	assert.Nil(t, is.Encode(0), "nothing to send without inputs")
+	assert.Error(t, is.Add(1, make([]byte, MaxInputSize+1)))
+
+	// packets carry the inputs not acked yet, up to the redundancy
+	var packets [][]byte
+	for tick := uint64(10); tick < 16; tick++ {
+		require.NoError(t, is.Add(tick, []byte{byte(tick)}))
+		packets = append(packets, is.Encode(uint(tick)))
+	}
+	assert.Error(t, is.Add(15, nil), "ticks must increase")
+	assert.Equal(t, 4, is.Pending())
+	assert.Len(t, packets[0], 1+inputHeaderSize+1)
+	assert.Len(t, packets[5], 1+4*(inputHeaderSize+1))
+
+	t.Logf("check acks trim the inputs sent\n")
+	is.ProcessAcks([]uint{13, 11})
+	acked, ok := is.Acked()
+	require.True(t, ok)
+	assert.EqualValues(t, 13, acked)
+	assert.Equal(t, 2, is.Pending())
+	assert.Len(t, is.Encode(16), 1+2*(inputHeaderSize+1))
+	assert.Error(t, is.Add(12, nil))
+
+	t.Logf("check inputs are delivered once, in order\n")
+	require.NoError(t, ir.Decode(packets[0]))
+	require.NoError(t, ir.Decode(packets[2]))
+	in, ok := ir.Next()
+	require.True(t, ok)
+	assert.Equal(t, Input{Tick: 10, Data: []byte{10}}, in)
+	for tick := uint64(11); tick <= 12; tick++ {
+		in, ok = ir.Next()
+		require.True(t, ok)
+		assert.Equal(t, tick, in.Tick)
+		assert.Equal(t, uint64(0), in.Gap)
+	}
+	_, ok = ir.Next()
+	assert.False(t, ok)
+	require.NoError(t, ir.Decode(packets[1]))
+	_, ok = ir.Next()
+	assert.False(t, ok, "delivered inputs should not be delivered again")
+	duplicates, lost := ir.Stats()
+	assert.EqualValues(t, 3, duplicates)
+	assert.EqualValues(t, 0, lost)
+
+	t.Logf("check gaps are reported once the missing inputs can't arrive\n")
+	// 13 to 18 are lost, 19 is received alone
+	late, err := NewInputSender(1)
+	require.NoError(t, err)
+	require.NoError(t, late.Add(19, []byte{19}))
+	require.NoError(t, ir.Decode(late.Encode(0)))
+	in, ok = ir.Next()
+	require.True(t, ok)
+	assert.Equal(t, uint64(19), in.Tick)
+	assert.Equal(t, uint64(6), in.Gap)
+	_, lost = ir.Stats()
+	assert.EqualValues(t, 6, lost)
+
+	t.Logf("check malformed packets are refused\n")
+	assert.Error(t, ir.Decode(nil))
+	assert.Error(t, ir.Decode(packets[5][:10]))
+	assert.Error(t, ir.Decode(append(packets[5], 0)))
+	assert.Error(t, ir.Decode([]byte{5}), "more inputs than the redundancy")
+
+	t.Logf("check inputs too far ahead are refused\n")
+	bogus := []byte{1}
+	bogus = appendUint64(bogus, 1<<63)
+	bogus = appendUint16(bogus, 0)
+	assert.Error(t, ir.Decode(bogus))
+	_, ok = ir.Next()
+	assert.False(t, ok, "refused inputs should not be delivered")
+	ahead, err := NewInputSender(1)
+	require.NoError(t, err)
+	require.NoError(t, ahead.Add(20+maxInputLead, nil))
+	require.NoError(t, ir.Decode(ahead.Encode(0)), "inputs within the lead should be accepted")
+
+	t.Logf("check the inputs held are capped\n")
+	buffered, err := NewInputReceiver(1)
+	require.NoError(t, err)
+	for tick := uint64(0); tick < 2*maxBufferedInputs; tick++ {
+		in, err := NewInputSender(1)
+		require.NoError(t, err)
+		require.NoError(t, in.Add(tick, nil))
+		require.NoError(t, buffered.Decode(in.Encode(0)))
+	}
+	assert.Len(t, buffered.inputs, maxBufferedInputs)
+	var delivered int
+	for {
+		if _, ok := buffered.Next(); !ok {
+			break
+		}
+		delivered++
+	}
+	assert.Equal(t, maxBufferedInputs, delivered)
+}
+
+func TestInputRedundancyReliableConn(t *testing.T) {
+	const (
+		DeltaTime  = time.Millisecond
+		TimeOut    = time.Duration(1000) * time.Millisecond
+		Redundancy = 8
+		Inputs     = 200
+	)
+
+	client := NewReliableConn(protocolID, TimeOut, maxSequence)
+	require.True(t, client.Start(clientPort), "couldn't start client connection")
+	defer client.Stop()
+
+	server := NewReliableConn(protocolID, TimeOut, maxSequence)
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+
+	cAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	client.Connect(cAddr)
+	server.Listen()
+
+	// drop 3 client packets out of 4
+	client.SetPacketLossMask(3)
+
+	is, err := NewInputSender(Redundancy)
+	require.NoError(t, err)
+	ir, err := NewInputReceiver(Redundancy)
+	require.NoError(t, err)
+
+	var tick uint64
+	var delivered []uint64
+	maxPending := 0
+	for i := 0; i < 2000 && len(delivered) < Inputs; i++ {
+		if client.IsConnected() || client.IsConnecting() {
+			require.NoError(t, is.Add(tick, []byte(fmt.Sprintf("input %d", tick))))
+			tick++
+			client.SendPacket(is.Encode(client.ReliabilitySystem().LocalSequence()))
+			if is.Pending() > maxPending {
+				maxPending = is.Pending()
+			}
+		}
+		if server.IsConnected() {
+			server.SendPacket(serverPacket)
+		}
+
+		for {
+			var packet [1024]byte
+			n := server.ReceivePacket(packet[:])
+			if n == 0 {
+				break
+			}
+			require.NoError(t, ir.Decode(packet[:n]))
+		}
+		for {
+			in, ok := ir.Next()
+			if !ok {
+				break
+			}
+			assert.Equal(t, fmt.Sprintf("input %d", in.Tick), string(in.Data))
+			assert.Equal(t, uint64(0), in.Gap)
+			delivered = append(delivered, in.Tick)
+		}
+		for {
+			var packet [256]byte
+			if client.ReceivePacket(packet[:]) == 0 {
+				break
+			}
+		}
+		is.ProcessAcks(client.ReliabilitySystem().Acks())
+
+		client.Update(DeltaTime)
+		server.Update(DeltaTime)
+	}
+	require.True(t, len(delivered) >= Inputs, "inputs should be delivered")
+	for i, tick := range delivered {
+		assert.Equal(t, uint64(i), tick, "inputs should be delivered in order")
+	}
+	_, lost := ir.Stats()
+	assert.EqualValues(t, 0, lost)
+	assert.True(t, maxPending > 1, "lost inputs should be sent again")
+	assert.True(t, maxPending < Redundancy, "acked inputs should not be sent again")
+}
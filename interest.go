@@ -0,0 +1,350 @@
+package udpnet
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// InterestObject is a replicated object, as seen by interest management.
+type InterestObject struct {
+	ID   uint32
+	X, Y float64
+	Team int
+}
+
+// Viewer is the point of view of a connection on the replicated objects.
+type Viewer struct {
+	ID   uint32 // connection id
+	X, Y float64
+	Team int
+}
+
+// InterestPolicy decides which objects are in the area of interest of a
+// viewer.
+type InterestPolicy interface {
+	// Update is given all the objects, once per update of the interest
+	// manager, before Scope is called for every viewer.
+	Update(objects []InterestObject)
+
+	// Scope returns the ids of the objects in the area of interest of
+	// viewer. inScope tells the objects currently in scope, for policies
+	// keeping objects longer than they take them in.
+	Scope(viewer Viewer, inScope func(id uint32) bool) []uint32
+}
+
+var (
+	_ InterestPolicy = (*GridPolicy)(nil)
+	_ InterestPolicy = (*VisibilityPolicy)(nil)
+	_ InterestPolicy = (*TeamPolicy)(nil)
+	_ InterestPolicy = UnionPolicy(nil)
+)
+
+// InterestCallback is notified of the objects entering and leaving the scope
+// of the viewers, for the replication layer to create and destroy them on
+// the connections.
+type InterestCallback interface {
+	OnCreate(viewer, object uint32)
+	OnDestroy(viewer, object uint32)
+}
+
+// viewerScope is a viewer and the objects in its scope.
+type viewerScope struct {
+	viewer Viewer
+	scope  map[uint32]bool
+}
+
+// InterestManager filters, per connection, the objects to replicate. Every
+// update, the policy gives the scope of each viewer, the objects entering it
+// are created and the objects leaving it destroyed on the connection.
+type InterestManager struct {
+	policy    InterestPolicy
+	cb        InterestCallback
+	objects   map[uint32]InterestObject
+	viewers   map[uint32]*viewerScope
+	created   uint64 // number of create events
+	destroyed uint64 // number of destroy events
+}
+
+// NewInterestManager returns an interest manager filtering with policy and
+// notifying cb.
+func NewInterestManager(policy InterestPolicy, cb InterestCallback) *InterestManager {
+	return &InterestManager{
+		policy:  policy,
+		cb:      cb,
+		objects: make(map[uint32]InterestObject),
+		viewers: make(map[uint32]*viewerScope),
+	}
+}
+
+// SetObject adds an object, or updates its position and team.
+func (im *InterestManager) SetObject(obj InterestObject) {
+	im.objects[obj.ID] = obj
+}
+
+// RemoveObject removes an object. It is destroyed on the connections having
+// it in scope at the next update.
+func (im *InterestManager) RemoveObject(id uint32) {
+	delete(im.objects, id)
+}
+
+// SetViewer adds a viewer, or updates its position and team.
+func (im *InterestManager) SetViewer(v Viewer) {
+	if vs, ok := im.viewers[v.ID]; ok {
+		vs.viewer = v
+		return
+	}
+	im.viewers[v.ID] = &viewerScope{viewer: v, scope: make(map[uint32]bool)}
+}
+
+// RemoveViewer removes a viewer, usually because its connection is closed.
+// No destroy events are sent.
+func (im *InterestManager) RemoveViewer(id uint32) {
+	delete(im.viewers, id)
+}
+
+// InScope indicates if an object is in the scope of a viewer.
+func (im *InterestManager) InScope(viewer, object uint32) bool {
+	vs, ok := im.viewers[viewer]
+	return ok && vs.scope[object]
+}
+
+// Scope returns the objects in the scope of a viewer, by id.
+func (im *InterestManager) Scope(viewer uint32) []uint32 {
+	vs, ok := im.viewers[viewer]
+	if !ok {
+		return nil
+	}
+	ids := make([]uint32, 0, len(vs.scope))
+	for id := range vs.scope {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+	return ids
+}
+
+// Stats returns the number of create and destroy events sent.
+func (im *InterestManager) Stats() (created, destroyed uint64) {
+	return im.created, im.destroyed
+}
+
+// Update computes the scope of every viewer and sends the create and destroy
+// events of the objects entering and leaving it, by viewer then object id.
+func (im *InterestManager) Update() {
+	objects := make([]InterestObject, 0, len(im.objects))
+	for _, obj := range im.objects {
+		objects = append(objects, obj)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].ID < objects[j].ID })
+	im.policy.Update(objects)
+
+	viewers := make([]uint32, 0, len(im.viewers))
+	for id := range im.viewers {
+		viewers = append(viewers, id)
+	}
+	sortIDs(viewers)
+	for _, id := range viewers {
+		vs := im.viewers[id]
+		inScope := func(obj uint32) bool { return vs.scope[obj] }
+		scope := make(map[uint32]bool, len(vs.scope))
+		for _, obj := range im.policy.Scope(vs.viewer, inScope) {
+			if _, ok := im.objects[obj]; ok {
+				scope[obj] = true
+			}
+		}
+
+		var left, entered []uint32
+		for obj := range vs.scope {
+			if !scope[obj] {
+				left = append(left, obj)
+			}
+		}
+		for obj := range scope {
+			if !vs.scope[obj] {
+				entered = append(entered, obj)
+			}
+		}
+		vs.scope = scope
+		sortIDs(left)
+		sortIDs(entered)
+		for _, obj := range left {
+			im.destroyed++
+			if im.cb != nil {
+				im.cb.OnDestroy(id, obj)
+			}
+		}
+		for _, obj := range entered {
+			im.created++
+			if im.cb != nil {
+				im.cb.OnCreate(id, obj)
+			}
+		}
+	}
+}
+
+func sortIDs(ids []uint32) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
+
+// gridCell is the coordinates of a cell of a GridPolicy.
+type gridCell struct{ x, y int }
+
+// GridPolicy is the interest policy of the objects within a distance of the
+// viewer. Objects are indexed in a grid, only the cells within the distance
+// are searched. Objects in scope leave it farther than they enter it, so
+// that objects moving on the edge don't enter and leave it every update.
+type GridPolicy struct {
+	cellSize    float64
+	radius      float64 // distance objects enter the scope at
+	leaveRadius float64 // distance objects leave the scope at
+	cells       map[gridCell][]InterestObject
+}
+
+// NewGridPolicy returns a policy of the objects within radius, indexed in
+// cells of cellSize.
+func NewGridPolicy(cellSize, radius float64) (*GridPolicy, error) {
+	if cellSize <= 0 || radius <= 0 {
+		return nil, errors.New("cell size and radius must be positive")
+	}
+	return &GridPolicy{
+		cellSize:    cellSize,
+		radius:      radius,
+		leaveRadius: radius,
+		cells:       make(map[gridCell][]InterestObject),
+	}, nil
+}
+
+// SetLeaveRadius sets the distance objects leave the scope at, not smaller
+// than the distance they enter it at, which is the default.
+func (gp *GridPolicy) SetLeaveRadius(radius float64) error {
+	if radius < gp.radius {
+		return errors.New("leave radius must not be smaller than the radius")
+	}
+	gp.leaveRadius = radius
+	return nil
+}
+
+func (gp *GridPolicy) cell(x, y float64) gridCell {
+	return gridCell{int(math.Floor(x / gp.cellSize)), int(math.Floor(y / gp.cellSize))}
+}
+
+// Update indexes the objects in the grid.
+func (gp *GridPolicy) Update(objects []InterestObject) {
+	for c, objs := range gp.cells {
+		gp.cells[c] = objs[:0]
+	}
+	for _, obj := range objects {
+		c := gp.cell(obj.X, obj.Y)
+		gp.cells[c] = append(gp.cells[c], obj)
+	}
+	for c, objs := range gp.cells {
+		if len(objs) == 0 {
+			delete(gp.cells, c)
+		}
+	}
+}
+
+// Scope returns the objects within the radius of the viewer, or within the
+// leave radius for the objects in scope.
+func (gp *GridPolicy) Scope(viewer Viewer, inScope func(id uint32) bool) []uint32 {
+	var ids []uint32
+	r := gp.leaveRadius
+	lo, hi := gp.cell(viewer.X-r, viewer.Y-r), gp.cell(viewer.X+r, viewer.Y+r)
+	for x := lo.x; x <= hi.x; x++ {
+		for y := lo.y; y <= hi.y; y++ {
+			for _, obj := range gp.cells[gridCell{x, y}] {
+				dx, dy := obj.X-viewer.X, obj.Y-viewer.Y
+				d := dx*dx + dy*dy
+				if d <= gp.radius*gp.radius || (d <= r*r && inScope(obj.ID)) {
+					ids = append(ids, obj.ID)
+				}
+			}
+		}
+	}
+	return ids
+}
+
+// VisibilityPolicy is the interest policy of the objects explicitly made
+// visible to each viewer, for example from a potentially visible set.
+type VisibilityPolicy struct {
+	visible map[uint32]map[uint32]bool // visible objects by viewer
+}
+
+// NewVisibilityPolicy returns a policy where no object is visible.
+func NewVisibilityPolicy() *VisibilityPolicy {
+	return &VisibilityPolicy{visible: make(map[uint32]map[uint32]bool)}
+}
+
+// SetVisible sets the objects visible to a viewer, replacing the previous
+// ones.
+func (vp *VisibilityPolicy) SetVisible(viewer uint32, objects ...uint32) {
+	set := make(map[uint32]bool, len(objects))
+	for _, id := range objects {
+		set[id] = true
+	}
+	vp.visible[viewer] = set
+}
+
+// Update does nothing, visibility doesn't depend on the objects state.
+func (vp *VisibilityPolicy) Update(objects []InterestObject) {}
+
+// Scope returns the objects visible to the viewer.
+func (vp *VisibilityPolicy) Scope(viewer Viewer, inScope func(id uint32) bool) []uint32 {
+	set := vp.visible[viewer.ID]
+	ids := make([]uint32, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// TeamPolicy is the interest policy of the objects of the viewer team.
+type TeamPolicy struct {
+	teams map[int][]uint32 // objects by team
+}
+
+// NewTeamPolicy returns a team policy.
+func NewTeamPolicy() *TeamPolicy {
+	return &TeamPolicy{teams: make(map[int][]uint32)}
+}
+
+// Update groups the objects by team.
+func (tp *TeamPolicy) Update(objects []InterestObject) {
+	for team := range tp.teams {
+		delete(tp.teams, team)
+	}
+	for _, obj := range objects {
+		tp.teams[obj.Team] = append(tp.teams[obj.Team], obj.ID)
+	}
+}
+
+// Scope returns the objects of the viewer team.
+func (tp *TeamPolicy) Scope(viewer Viewer, inScope func(id uint32) bool) []uint32 {
+	return tp.teams[viewer.Team]
+}
+
+// UnionPolicy is the interest policy of the objects in the scope of any of
+// its policies, for example the objects nearby and the objects of the team.
+type UnionPolicy []InterestPolicy
+
+// Update updates every policy.
+func (up UnionPolicy) Update(objects []InterestObject) {
+	for _, p := range up {
+		p.Update(objects)
+	}
+}
+
+// Scope returns the objects in the scope of any policy.
+func (up UnionPolicy) Scope(viewer Viewer, inScope func(id uint32) bool) []uint32 {
+	seen := make(map[uint32]bool)
+	var ids []uint32
+	for _, p := range up {
+		for _, id := range p.Scope(viewer, inScope) {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
@@ -0,0 +1,207 @@
+package udpnet
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replicas records the objects created on each viewer by interest events.
+type replicas struct {
+	objects map[uint32]map[uint32]bool // objects by viewer
+	errors  int                        // objects created or destroyed twice
+}
+
+func newReplicas() *replicas {
+	return &replicas{objects: make(map[uint32]map[uint32]bool)}
+}
+
+func (r *replicas) OnCreate(viewer, object uint32) {
+	if r.objects[viewer] == nil {
+		r.objects[viewer] = make(map[uint32]bool)
+	}
+	if r.objects[viewer][object] {
+		r.errors++
+	}
+	r.objects[viewer][object] = true
+}
+
+func (r *replicas) OnDestroy(viewer, object uint32) {
+	if !r.objects[viewer][object] {
+		r.errors++
+	}
+	delete(r.objects[viewer], object)
+}
+
+func (r *replicas) ids(viewer uint32) []uint32 {
+	ids := []uint32{}
+	for id := range r.objects[viewer] {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+	return ids
+}
+
+func TestInterestGrid(t *testing.T) {
+	const (
+		Objects  = 5000
+		Viewers  = 20
+		Size     = 2000.0
+		Radius   = 100.0
+		CellSize = 50.0
+	)
+
+	_, err := NewGridPolicy(0, Radius)
+	assert.Error(t, err)
+	grid, err := NewGridPolicy(CellSize, Radius)
+	require.NoError(t, err)
+	rep := newReplicas()
+	im := NewInterestManager(grid, rep)
+
+	r := rand.New(rand.NewSource(1))
+	objects := make([]InterestObject, Objects)
+	for i := range objects {
+		objects[i] = InterestObject{ID: uint32(i), X: r.Float64() * Size, Y: r.Float64() * Size}
+		im.SetObject(objects[i])
+	}
+	viewers := make([]Viewer, Viewers)
+	for i := range viewers {
+		viewers[i] = Viewer{ID: uint32(i), X: r.Float64() * Size, Y: r.Float64() * Size}
+		im.SetViewer(viewers[i])
+	}
+
+	// check compares the scopes with the objects within the radius
+	check := func() {
+		for _, v := range viewers {
+			want := []uint32{}
+			for _, obj := range objects {
+				if _, ok := im.objects[obj.ID]; !ok {
+					continue
+				}
+				dx, dy := obj.X-v.X, obj.Y-v.Y
+				if dx*dx+dy*dy <= Radius*Radius {
+					want = append(want, obj.ID)
+				}
+			}
+			got := im.Scope(v.ID)
+			if got == nil {
+				got = []uint32{}
+			}
+			require.Equal(t, want, got)
+			require.Equal(t, want, rep.ids(v.ID), "replicas should follow the scope")
+		}
+	}
+
+	im.Update()
+	check()
+	created, _ := im.Stats()
+	assert.True(t, created > 0, "objects should be created")
+
+	t.Logf("check objects and viewers moving\n")
+	for step := 0; step < 20; step++ {
+		for i := range objects {
+			objects[i].X += r.Float64()*20 - 10
+			objects[i].Y += r.Float64()*20 - 10
+			im.SetObject(objects[i])
+		}
+		for i := range viewers {
+			viewers[i].X += r.Float64()*40 - 20
+			viewers[i].Y += r.Float64()*40 - 20
+			im.SetViewer(viewers[i])
+		}
+		im.Update()
+		check()
+	}
+	_, destroyed := im.Stats()
+	assert.True(t, destroyed > 0, "objects leaving the scope should be destroyed")
+
+	t.Logf("check removed objects are destroyed\n")
+	for id := uint32(0); id < Objects; id += 2 {
+		im.RemoveObject(id)
+	}
+	im.Update()
+	check()
+	assert.Equal(t, 0, rep.errors)
+
+	t.Logf("check removed viewers\n")
+	im.RemoveViewer(0)
+	assert.Nil(t, im.Scope(0))
+	assert.False(t, im.InScope(0, 1))
+}
+
+func TestInterestGridHysteresis(t *testing.T) {
+	grid, err := NewGridPolicy(4, 10)
+	require.NoError(t, err)
+	assert.Error(t, grid.SetLeaveRadius(5))
+	require.NoError(t, grid.SetLeaveRadius(15))
+	rep := newReplicas()
+	im := NewInterestManager(grid, rep)
+	im.SetViewer(Viewer{ID: 1})
+
+	var tests = []struct {
+		x       float64
+		inScope bool
+	}{
+		{12, false},
+		{9, true},
+		{-12, true},
+		{14, true},
+		{16, false},
+		{12, false},
+	}
+	for _, tt := range tests {
+		im.SetObject(InterestObject{ID: 7, X: tt.x})
+		im.Update()
+		assert.Equal(t, tt.inScope, im.InScope(1, 7))
+		assert.Equal(t, tt.inScope, rep.objects[1][7])
+	}
+	created, destroyed := im.Stats()
+	assert.EqualValues(t, 1, created)
+	assert.EqualValues(t, 1, destroyed)
+}
+
+func TestInterestPolicies(t *testing.T) {
+	grid, err := NewGridPolicy(10, 10)
+	require.NoError(t, err)
+	teams := NewTeamPolicy()
+	visibility := NewVisibilityPolicy()
+	rep := newReplicas()
+	im := NewInterestManager(UnionPolicy{grid, teams, visibility}, rep)
+
+	// objects 1 and 2 are near the viewer, 1 and 3 in its team, 4 far
+	im.SetObject(InterestObject{ID: 1, Team: 1})
+	im.SetObject(InterestObject{ID: 2, X: 5, Team: 2})
+	im.SetObject(InterestObject{ID: 3, X: 500, Team: 1})
+	im.SetObject(InterestObject{ID: 4, X: 500, Team: 2})
+	im.SetObject(InterestObject{ID: 5, X: 800, Team: 2})
+	im.SetViewer(Viewer{ID: 1, Team: 1})
+	im.SetViewer(Viewer{ID: 2, X: 800, Team: 3})
+	visibility.SetVisible(1, 4, 42)
+
+	im.Update()
+	assert.Equal(t, []uint32{1, 2, 3, 4}, im.Scope(1), "unknown objects should be ignored")
+	assert.Equal(t, []uint32{5}, im.Scope(2))
+
+	t.Logf("check policies alone\n")
+	teamOnly := NewInterestManager(teams, nil)
+	teamOnly.objects = im.objects
+	teamOnly.SetViewer(Viewer{ID: 1, Team: 1})
+	teamOnly.Update()
+	assert.Equal(t, []uint32{1, 3}, teamOnly.Scope(1))
+
+	visibleOnly := NewInterestManager(visibility, nil)
+	visibleOnly.objects = im.objects
+	visibleOnly.SetViewer(Viewer{ID: 1})
+	visibleOnly.Update()
+	assert.Equal(t, []uint32{4}, visibleOnly.Scope(1))
+
+	t.Logf("check objects leaving the scope of every policy\n")
+	visibility.SetVisible(1)
+	im.SetObject(InterestObject{ID: 2, X: 50, Team: 2})
+	im.Update()
+	assert.Equal(t, []uint32{1, 3}, im.Scope(1))
+	assert.Equal(t, []uint32{1, 3}, rep.ids(1))
+	assert.Equal(t, 0, rep.errors)
+}
@@ -0,0 +1,248 @@
+package udpnet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// packet types of the NAT traversal protocol
+const (
+	natRegisterPacket  byte = iota // peer -> introducer: session, peer id and private address
+	natIntroducePacket             // introducer -> peer: public address and peers of the session
+	natPunchPacket                 // peer -> peer: hole punching
+	natPunchAckPacket              // peer -> peer: hole punching answer
+	natDataPacket                  // peer -> peer: payload
+	natRelayPacket                 // peer -> introducer -> peer: relayed payload
+)
+
+const (
+	// registerRequestSize is the size registration requests are padded to,
+	// so that the introducer never answers with more than it received.
+	registerRequestSize = MinConnectionRequestSize
+
+	// maxIntroductions is the maximum number of peers introduced in answer to
+	// a registration, the others are introduced in the next ones.
+	maxIntroductions = 4
+
+	// natHeaderSize is the size of the protocol id and packet type.
+	natHeaderSize = 5
+
+	// introductionSize is the size of a peer introduction, its id and its
+	// public and private addresses.
+	introductionSize = 8 + 2*addressSize
+)
+
+// introducedPeer is a peer registered on an introducer.
+type introducedPeer struct {
+	session   uint64
+	id        uint64
+	public    *net.UDPAddr // address the introducer sees the peer at
+	private   *net.UDPAddr // address the peer is bound to
+	idle      time.Duration
+	introduce int // index of the next peer of the session to introduce
+}
+
+// Introducer introduces the peers of a session to each other, telling them
+// their public and private addresses so that they can punch holes through
+// their NATs. It also relays the packets of the peers that couldn't reach
+// each other directly. Peers not registering for longer than the timeout are
+// forgotten.
+type Introducer struct {
+	protocolID uint
+	timeout    time.Duration
+	transport  Transport
+	peers      []*introducedPeer
+	relayed    uint64 // number of relayed packets
+	relayedLen uint64 // number of relayed bytes
+}
+
+// NewIntroducer returns an introducer receiving on transport.
+func NewIntroducer(protocolID uint, timeout time.Duration, transport Transport) *Introducer {
+	return &Introducer{
+		protocolID: protocolID,
+		timeout:    timeout,
+		transport:  transport,
+	}
+}
+
+// Update processes the received packets and forgets idle peers.
+func (in *Introducer) Update(dt time.Duration) {
+	for {
+		var (
+			sender net.UDPAddr
+			packet [natHeaderSize + 8 + MaxNATPayloadSize]byte
+		)
+		n := in.transport.Receive(&sender, packet[:])
+		if n == 0 {
+			break
+		}
+		if n < natHeaderSize || !hasProtocolID(in.protocolID, packet[:n]) {
+			continue
+		}
+		body := packet[natHeaderSize:n]
+		switch packet[4] {
+		case natRegisterPacket:
+			in.processRegister(&sender, body, n)
+		case natRelayPacket:
+			in.processRelay(&sender, body)
+		}
+	}
+
+	peers := in.peers[:0]
+	for _, p := range in.peers {
+		p.idle += dt
+		if p.idle > in.timeout {
+			fmt.Printf("introducer: peer %d of session %d timed out\n", p.id, p.session)
+			continue
+		}
+		peers = append(peers, p)
+	}
+	for i := len(peers); i < len(in.peers); i++ {
+		in.peers[i] = nil
+	}
+	in.peers = peers
+}
+
+// Peers returns the number of registered peers.
+func (in *Introducer) Peers() int {
+	return len(in.peers)
+}
+
+// Relayed returns the number of packets and bytes relayed between peers.
+func (in *Introducer) Relayed() (packets, bytes uint64) {
+	return in.relayed, in.relayedLen
+}
+
+func (in *Introducer) peer(session, id uint64) *introducedPeer {
+	for _, p := range in.peers {
+		if p.session == session && p.id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (in *Introducer) peerByAddress(addr *net.UDPAddr) *introducedPeer {
+	for _, p := range in.peers {
+		if sameAddress(p.public, addr) {
+			return p
+		}
+	}
+	return nil
+}
+
+// processRegister registers a peer, or refreshes its registration, and
+// answers with its public address and up to maxIntroductions peers of its
+// session.
+func (in *Introducer) processRegister(sender *net.UDPAddr, body []byte, size int) {
+	if size < registerRequestSize || len(body) < 16+addressSize {
+		return
+	}
+	session := binary.BigEndian.Uint64(body)
+	id := binary.BigEndian.Uint64(body[8:])
+	private := readAddress(body[16:])
+
+	p := in.peer(session, id)
+	if p == nil {
+		if in.peerByAddress(sender) != nil {
+			// one peer per address, relayed packets are routed by address
+			return
+		}
+		fmt.Printf("introducer: peer %d of session %d registered from %v\n", id, session, sender.String())
+		p = &introducedPeer{session: session, id: id}
+		in.peers = append(in.peers, p)
+	} else if !sameAddress(p.public, sender) {
+		if in.peerByAddress(sender) != nil {
+			return
+		}
+		fmt.Printf("introducer: peer %d of session %d moved to %v\n", id, session, sender.String())
+	}
+	p.public = copyAddr(sender)
+	p.private = private
+	p.idle = 0
+
+	var others []*introducedPeer
+	for _, o := range in.peers {
+		if o.session == session && o != p {
+			others = append(others, o)
+		}
+	}
+	reply := appendAddress(nil, p.public)
+	count := len(others)
+	if count > maxIntroductions {
+		count = maxIntroductions
+	}
+	reply = append(reply, byte(count))
+	for i := 0; i < count; i++ {
+		o := others[(p.introduce+i)%len(others)]
+		reply = appendUint64(reply, o.id)
+		reply = appendAddress(reply, o.public)
+		reply = appendAddress(reply, o.private)
+	}
+	if len(others) > 0 {
+		p.introduce = (p.introduce + count) % len(others)
+	}
+	sendProtocolPacket(in.transport, in.protocolID, sender, natIntroducePacket, reply)
+}
+
+// processRelay forwards a packet to a peer of the sender session, replacing
+// the destination peer id by the sender one.
+func (in *Introducer) processRelay(sender *net.UDPAddr, body []byte) {
+	if len(body) < 8 {
+		return
+	}
+	from := in.peerByAddress(sender)
+	if from == nil {
+		return
+	}
+	to := in.peer(from.session, binary.BigEndian.Uint64(body))
+	if to == nil {
+		return
+	}
+	from.idle = 0
+	payload := appendUint64(nil, from.id)
+	payload = append(payload, body[8:]...)
+	if err := sendProtocolPacket(in.transport, in.protocolID, to.public, natRelayPacket, payload); err == nil {
+		in.relayed++
+		in.relayedLen += uint64(len(body) - 8)
+	}
+}
+
+// hasProtocolID indicates if packet starts with the protocol id and a packet
+// type.
+func hasProtocolID(protocolID uint, packet []byte) bool {
+	return len(packet) >= natHeaderSize &&
+		packet[0] == byte(protocolID>>24) &&
+		packet[1] == byte((protocolID>>16)&0xFF) &&
+		packet[2] == byte((protocolID>>8)&0xFF) &&
+		packet[3] == byte(protocolID&0xFF)
+}
+
+// sendProtocolPacket sends the protocol id, the packet type and body to addr.
+func sendProtocolPacket(t Transport, protocolID uint, addr *net.UDPAddr, packetType byte, body []byte) error {
+	packet := make([]byte, natHeaderSize+len(body))
+	binary.BigEndian.PutUint32(packet, uint32(protocolID))
+	packet[4] = packetType
+	copy(packet[natHeaderSize:], body)
+	return t.Send(addr, packet)
+}
+
+// appendAddress writes addr as 16 bytes IP and 2 bytes port.
+func appendAddress(buf []byte, addr *net.UDPAddr) []byte {
+	ip := addr.IP.To16()
+	if ip == nil {
+		ip = net.IPv6zero
+	}
+	buf = append(buf, ip...)
+	return appendUint16(buf, uint16(addr.Port))
+}
+
+// readAddress reads an address written by appendAddress.
+func readAddress(data []byte) *net.UDPAddr {
+	return &net.UDPAddr{
+		IP:   append(net.IP(nil), data[:16]...),
+		Port: int(binary.BigEndian.Uint16(data[16:])),
+	}
+}
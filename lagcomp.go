@@ -0,0 +1,157 @@
+package udpnet
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultMaxRewind is the default maximum time a LagCompensator rewinds.
+const defaultMaxRewind = 500 * time.Millisecond
+
+// LagCompensator keeps, on the server, the history of the entity states by
+// tick, to check the actions of clients against the world as they saw it.
+// A client sees the world late: the snapshots take half a round trip to
+// reach it, then are rendered an interpolation delay in the past. Its
+// actions take another half round trip to reach the server.
+//
+// The rewind is limited, so that clients with a high latency can't act too
+// far in the past. A LagCompensator is safe for concurrent use, to record
+// states from the simulation while checking actions from other goroutines.
+type LagCompensator struct {
+	mu           sync.Mutex
+	tickDuration time.Duration
+	capacity     int
+	maxRewind    time.Duration
+	frames       []Snapshot // entity states by tick, oldest first
+	clamped      uint64     // number of view times clamped to the max rewind
+}
+
+// NewLagCompensator returns a lag compensator keeping the states of the last
+// capacity ticks of a server ticking every tickDuration.
+func NewLagCompensator(capacity int, tickDuration time.Duration) (*LagCompensator, error) {
+	if capacity < 1 {
+		return nil, errors.New("capacity must be at least 1")
+	}
+	if tickDuration <= 0 {
+		return nil, errors.New("tick duration must be positive")
+	}
+	return &LagCompensator{
+		tickDuration: tickDuration,
+		capacity:     capacity,
+		maxRewind:    defaultMaxRewind,
+	}, nil
+}
+
+// SetMaxRewind sets how far in the past the view time of a client may be,
+// 500 milliseconds by default.
+func (lc *LagCompensator) SetMaxRewind(max time.Duration) error {
+	if max < 0 {
+		return errors.New("max rewind must not be negative")
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.maxRewind = max
+	return nil
+}
+
+// Clamped returns the number of view times limited by the max rewind.
+func (lc *LagCompensator) Clamped() uint64 {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.clamped
+}
+
+// Len returns the number of ticks in the history.
+func (lc *LagCompensator) Len() int {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return len(lc.frames)
+}
+
+// Record adds the entity states of a tick, by entity id. Ticks must
+// increase. The map is copied, not the states.
+func (lc *LagCompensator) Record(tick uint64, entities map[uint32]interface{}) error {
+	frame := make(map[uint32]interface{}, len(entities))
+	for id, state := range entities {
+		frame[id] = state
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if n := len(lc.frames); n > 0 && tick <= lc.frames[n-1].Tick {
+		return errors.New("ticks must increase")
+	}
+	if len(lc.frames) == lc.capacity {
+		copy(lc.frames, lc.frames[1:])
+		lc.frames = lc.frames[:lc.capacity-1]
+	}
+	lc.frames = append(lc.frames, Snapshot{Tick: tick, Data: frame})
+	return nil
+}
+
+// ViewTime returns the server time a client was seeing when it sent an
+// action received at serverTime: serverTime minus the round trip time, half
+// for the snapshots to reach the client and half for the action to reach the
+// server, and the client interpolation delay, limited by the max rewind.
+func (lc *LagCompensator) ViewTime(serverTime, rtt, interpolationDelay time.Duration) time.Duration {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	view := serverTime - rtt - interpolationDelay
+	if view < serverTime-lc.maxRewind {
+		view = serverTime - lc.maxRewind
+		lc.clamped++
+	}
+	return view
+}
+
+// Rewind returns the recorded states surrounding viewTime and the
+// interpolation alpha. The Data of the snapshots are the entity states by id,
+// that must not be modified. View times out of the history are given the
+// oldest or newest states. It returns false if nothing was recorded.
+func (lc *LagCompensator) Rewind(viewTime time.Duration) (Interpolation, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	n := len(lc.frames)
+	if n == 0 {
+		return Interpolation{}, false
+	}
+	first, last := lc.frames[0], lc.frames[n-1]
+	if viewTime <= lc.tickTime(first.Tick) {
+		return Interpolation{From: first, To: first}, true
+	}
+	if viewTime >= lc.tickTime(last.Tick) {
+		return Interpolation{From: last, To: last}, true
+	}
+	i := sort.Search(n, func(i int) bool { return lc.tickTime(lc.frames[i].Tick) > viewTime })
+	from, to := lc.frames[i-1], lc.frames[i]
+	return Interpolation{
+		From:  from,
+		To:    to,
+		Alpha: float64(viewTime-lc.tickTime(from.Tick)) / float64(lc.tickTime(to.Tick-from.Tick)),
+	}, true
+}
+
+// RewindEntity returns the states of an entity surrounding viewTime, and the
+// interpolation alpha. It returns false if the entity didn't exist then.
+func (lc *LagCompensator) RewindEntity(id uint32, viewTime time.Duration) (from, to interface{}, alpha float64, ok bool) {
+	ip, ok := lc.Rewind(viewTime)
+	if !ok {
+		return nil, nil, 0, false
+	}
+	from, okFrom := ip.From.Data.(map[uint32]interface{})[id]
+	to, okTo := ip.To.Data.(map[uint32]interface{})[id]
+	switch {
+	case okFrom && okTo:
+		return from, to, ip.Alpha, true
+	case okFrom:
+		return from, from, 0, true
+	case okTo:
+		return to, to, 0, true
+	}
+	return nil, nil, 0, false
+}
+
+func (lc *LagCompensator) tickTime(tick uint64) time.Duration {
+	return time.Duration(tick) * lc.tickDuration
+}
@@ -0,0 +1,109 @@
+package udpnet
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLagCompensator(t *testing.T) {
+	const TickDuration = time.Duration(10) * time.Millisecond
+
+	_, err := NewLagCompensator(0, TickDuration)
+	assert.Error(t, err)
+	_, err = NewLagCompensator(8, 0)
+	assert.Error(t, err)
+
+	lc, err := NewLagCompensator(8, TickDuration)
+	require.NoError(t, err)
+	_, ok := lc.Rewind(0)
+	assert.False(t, ok)
+
+	// entity 1 moves 10 units a tick, entity 2 spawns at tick 5
+	entities := make(map[uint32]interface{})
+	for tick := uint64(0); tick < 10; tick++ {
+		entities[1] = float64(tick * 10)
+		if tick >= 5 {
+			entities[2] = 0.0
+		}
+		require.NoError(t, lc.Record(tick, entities))
+	}
+	assert.Error(t, lc.Record(9, entities), "ticks must increase")
+	assert.Equal(t, 8, lc.Len())
+
+	t.Logf("check the view time of clients\n")
+	view := lc.ViewTime(90*time.Millisecond, 20*time.Millisecond, 30*time.Millisecond)
+	assert.Equal(t, 40*time.Millisecond, view)
+	from, to, alpha, ok := lc.RewindEntity(1, view)
+	require.True(t, ok)
+	assert.Equal(t, 40.0, from)
+	assert.Equal(t, 50.0, to)
+	assert.Equal(t, float64(0), alpha)
+
+	ip, ok := lc.Rewind(view + 5*time.Millisecond)
+	require.True(t, ok)
+	assert.Equal(t, uint64(4), ip.From.Tick)
+	assert.Equal(t, uint64(5), ip.To.Tick)
+	assert.InDelta(t, 0.5, ip.Alpha, 1e-9)
+
+	t.Logf("check entities are rewound to when they existed\n")
+	from, to, alpha, ok = lc.RewindEntity(2, 45*time.Millisecond)
+	require.True(t, ok)
+	assert.Equal(t, from, to)
+	assert.Equal(t, float64(0), alpha)
+	_, _, _, ok = lc.RewindEntity(2, 30*time.Millisecond)
+	assert.False(t, ok)
+	_, _, _, ok = lc.RewindEntity(3, view)
+	assert.False(t, ok)
+
+	t.Logf("check view times out of the history\n")
+	ip, _ = lc.Rewind(0)
+	assert.Equal(t, uint64(2), ip.From.Tick, "oldest ticks should be forgotten")
+	ip, _ = lc.Rewind(time.Second)
+	assert.Equal(t, uint64(9), ip.To.Tick)
+
+	t.Logf("check the max rewind\n")
+	assert.Error(t, lc.SetMaxRewind(-time.Millisecond))
+	require.NoError(t, lc.SetMaxRewind(100*time.Millisecond))
+	assert.Equal(t, -10*time.Millisecond, lc.ViewTime(90*time.Millisecond, 400*time.Millisecond, 100*time.Millisecond))
+	assert.EqualValues(t, 1, lc.Clamped())
+}
+
+func TestLagCompensatorConcurrency(t *testing.T) {
+	const (
+		TickDuration = time.Duration(10) * time.Millisecond
+		Ticks        = 1000
+		Readers      = 4
+	)
+
+	lc, err := NewLagCompensator(64, TickDuration)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for tick := uint64(0); tick < Ticks; tick++ {
+			assert.NoError(t, lc.Record(tick, map[uint32]interface{}{1: tick}))
+		}
+	}()
+	for i := 0; i < Readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < Ticks; j++ {
+				now := time.Duration(j) * TickDuration
+				view := lc.ViewTime(now, 50*time.Millisecond, 2*TickDuration)
+				from, to, _, ok := lc.RewindEntity(1, view)
+				if ok {
+					assert.True(t, from.(uint64) <= to.(uint64))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 64, lc.Len())
+}
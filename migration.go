@@ -0,0 +1,155 @@
+package udpnet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// size of the session id prefixing the packets sent by clients
+const sessionIDSize = 8
+
+// size of the challenge sent to validate a new client address
+const migrationChallengeSize = 8
+
+// MigrationCallback can be implemented by the ConnCallback of a server
+// connection to be told when a client address changes, for example after its
+// NAT mapping changed.
+type MigrationCallback interface {
+	OnClientMigrate(slot int, from, to *net.UDPAddr)
+}
+
+// migration is a client address change waiting for the client to prove it
+// receives the packets sent to its new address.
+type migration struct {
+	address   *net.UDPAddr
+	challenge []byte
+	age       time.Duration // time since the migration started
+	resend    time.Duration // time left before resending the challenge
+}
+
+// newSessionID returns a random session id not used by a connected client.
+// Session ids identify the clients packets instead of their address, so that
+// a client that joined with a connect token keeps its session when its
+// address changes.
+func (c *Conn) newSessionID() uint64 {
+	for {
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(fmt.Sprintf("couldn't generate session id: %v", err))
+		}
+		id := binary.BigEndian.Uint64(b[:])
+		if id != 0 && c.peerBySessionID(id) == nil {
+			return id
+		}
+	}
+}
+
+func (c *Conn) peerBySessionID(sessionID uint64) *peer {
+	for _, p := range c.peers {
+		if p != nil && p.sessionID == sessionID {
+			return p
+		}
+	}
+	return nil
+}
+
+// openPeerPacket returns the client that sent a packet prefixed with its
+// session id, along with the packet body, opened if the client joined with a
+// connect token. fresh indicates the packet can't be a replay.
+func (c *Conn) openPeerPacket(packetType byte, body []byte) (p *peer, opened []byte, fresh bool) {
+	if len(body) < sessionIDSize {
+		return nil, nil, false
+	}
+	p = c.peerBySessionID(binary.BigEndian.Uint64(body))
+	if p == nil {
+		return nil, nil, false
+	}
+	body = body[sessionIDSize:]
+	if p.session == nil {
+		return p, body, true
+	}
+	opened, fresh, ok := p.session.openFresh(c.additionalData(packetType), body)
+	if !ok {
+		return nil, nil, false
+	}
+	return p, opened, fresh
+}
+
+// migratePeer handles a valid packet of p received from another address. The
+// packet is dropped, the client address only changes once the client answers
+// a challenge sent to the new address. This prevents an attacker replaying or
+// spoofing client packets from redirecting the server packets to another
+// address.
+//
+// Only clients that joined with a connect token can migrate: without a
+// session, the challenge isn't sealed and anyone knowing the session id
+// could answer it.
+func (c *Conn) migratePeer(p *peer, sender *net.UDPAddr, fresh bool) {
+	if !fresh {
+		c.guard.stats.Replayed++
+		return
+	}
+	if p.session == nil || c.peerByAddress(sender) != nil {
+		return
+	}
+	m := p.migration
+	if m == nil || !sameAddress(m.address, sender) {
+		m = &migration{
+			address:   &net.UDPAddr{IP: append(net.IP(nil), sender.IP...), Port: sender.Port, Zone: sender.Zone},
+			challenge: make([]byte, migrationChallengeSize),
+		}
+		if _, err := rand.Read(m.challenge); err != nil {
+			return
+		}
+		fmt.Printf("client in slot %d seen at %v, validating new address\n", p.slot, sender.String())
+		p.migration = m
+	}
+	if m.resend <= 0 {
+		c.sendPacket(m.address, migrationChallengePacket, m.challenge, p.session)
+		m.resend = connectRequestInterval
+	}
+}
+
+// processMigrationChallenge answers, on a client, the challenge sent by the
+// server to validate the client new address.
+func (c *Conn) processMigrationChallenge(sender *net.UDPAddr, body []byte) {
+	if c.mode != Client || (c.state != connected && c.state != resuming) || c.session == nil || !sameAddress(sender, c.address) {
+		return
+	}
+	body, ok := c.session.open(c.additionalData(migrationChallengePacket), body)
+	if !ok || len(body) != migrationChallengeSize {
+		return
+	}
+	c.sendPacket(c.address, migrationResponsePacket, body, c.session)
+}
+
+// processMigrationResponse completes, on a server, the migration of a client
+// that answered the challenge sent to its new address.
+func (c *Conn) processMigrationResponse(sender *net.UDPAddr, body []byte) {
+	if c.mode != Server {
+		return
+	}
+	p, challenge, _ := c.openPeerPacket(migrationResponsePacket, body)
+	if p == nil || p.session == nil || p.migration == nil || !sameAddress(sender, p.migration.address) {
+		return
+	}
+	if !bytes.Equal(challenge, p.migration.challenge) || c.peerByAddress(sender) != nil {
+		return
+	}
+	from := p.address
+	p.address = p.migration.address
+	p.migration = nil
+	p.timeoutAccumulator = 0
+	delete(c.budgets, sender.String())
+	fmt.Printf("client in slot %d migrated from %v to %v\n", p.slot, from.String(), sender.String())
+	if mc, ok := c.cb.(MigrationCallback); ok {
+		mc.OnClientMigrate(p.slot, from, p.address)
+	}
+	if p.suspended {
+		c.resumePeer(p)
+	}
+}
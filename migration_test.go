@@ -0,0 +1,208 @@
+package udpnet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// migrationCallback records the client address changes.
+type migrationCallback struct {
+	dummyCallback
+	migrations []string
+}
+
+func (mc *migrationCallback) OnClientMigrate(slot int, from, to *net.UDPAddr) {
+	mc.migrations = append(mc.migrations, fmt.Sprintf("%d:%v->%v", slot, from, to))
+}
+
+func TestConnectionMigration(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(100) * time.Millisecond
+	)
+
+	key, err := GenerateKey()
+	require.NoError(t, err)
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	token, err := NewTokenIssuer(protocolID, key).Issue(42, []*net.UDPAddr{sAddr}, time.Minute, nil)
+	require.NoError(t, err)
+
+	for _, secure := range []bool{false, true} {
+		t.Logf("check migration, secure: %v\n", secure)
+		cb := &migrationCallback{}
+		server := NewConn(cb, protocolID, TimeOut)
+		server.SetHandshake(true)
+		if secure {
+			server.SetPrivateKey(key)
+		}
+		require.True(t, server.Start(serverPort), "couldn't start server connection")
+		server.Listen()
+
+		client := NewConn(dummyCallback{}, protocolID, TimeOut)
+		client.SetHandshake(true)
+		require.True(t, client.Start(clientPort), "couldn't start client connection")
+		if secure {
+			require.NoError(t, client.ConnectWithToken(token))
+		} else {
+			client.Connect(sAddr)
+		}
+		updateConns(DeltaTime, 1000, func() bool {
+			return client.IsConnected() && server.IsConnected()
+		}, nil, client, server)
+		require.True(t, client.IsConnected(), "client should be connected")
+
+		// the client NAT mapping changes: same session, new port
+		client.transport.Close()
+		var socket Socket
+		require.NoError(t, socket.Open(clientPort+1))
+		client.transport = &socket
+
+		// sessions without keys can't migrate, their packets are dropped
+		iterations := 1000
+		if !secure {
+			iterations = 50
+		}
+		var received, serverReceived int
+		for i := 0; i < iterations && (len(cb.migrations) == 0 || received == 0); i++ {
+			client.SendPacket(clientPacket)
+			server.SendPacket(serverPacket)
+			for {
+				var packet [256]byte
+				n, slot := server.ReceivePacketFrom(packet[:])
+				if n == 0 {
+					break
+				}
+				assert.Equal(t, 0, slot)
+				assert.Equal(t, clientPacket, packet[:n])
+				serverReceived++
+			}
+			for {
+				var packet [256]byte
+				n := client.ReceivePacket(packet[:])
+				if n == 0 {
+					break
+				}
+				if len(cb.migrations) > 0 {
+					received++
+				}
+			}
+			client.Update(DeltaTime)
+			server.Update(DeltaTime)
+		}
+
+		peer, ok := server.PeerBySlot(0)
+		require.True(t, ok)
+		if secure {
+			assert.Equal(t, []string{fmt.Sprintf("0:127.0.0.1:%d->127.0.0.1:%d", clientPort, clientPort+1)}, cb.migrations)
+			assert.True(t, received > 0, "client should receive packets at its new address")
+			assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", clientPort+1), peer.Address.String())
+			assert.True(t, client.IsConnected(), "client should still be connected")
+		} else {
+			assert.Empty(t, cb.migrations)
+			assert.Equal(t, 0, serverReceived, "packets from the new address should be dropped")
+			assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", clientPort), peer.Address.String())
+		}
+
+		client.Stop()
+		server.Stop()
+	}
+}
+
+func TestConnectionMigrationHijack(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(100) * time.Millisecond
+	)
+
+	key, err := GenerateKey()
+	require.NoError(t, err)
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	token, err := NewTokenIssuer(protocolID, key).Issue(42, []*net.UDPAddr{sAddr}, time.Minute, nil)
+	require.NoError(t, err)
+
+	cb := &migrationCallback{}
+	server := NewConn(cb, protocolID, TimeOut)
+	server.SetPrivateKey(key)
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+	server.Listen()
+
+	client := NewConn(dummyCallback{}, protocolID, TimeOut)
+	require.True(t, client.Start(clientPort), "couldn't start client connection")
+	defer client.Stop()
+	require.NoError(t, client.ConnectWithToken(token))
+	updateConns(DeltaTime, 1000, func() bool {
+		return client.IsConnected() && server.IsConnected()
+	}, nil, client, server)
+	require.True(t, client.IsConnected(), "client should be connected")
+
+	var attacker Socket
+	require.NoError(t, attacker.Open(clientPort+1))
+	defer attacker.Close()
+	aAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", clientPort+1))
+
+	// capture returns a client packet sniffed by the attacker
+	capture := func() []byte {
+		require.NoError(t, client.sendPacket(aAddr, payloadPacket, clientPacket, client.session))
+		var buf [256]byte
+		var from net.UDPAddr
+		var n int
+		for try := 0; try < 10 && n == 0; try++ {
+			n = attacker.Receive(&from, buf[:])
+		}
+		require.True(t, n > 0, "attacker should capture a client packet")
+		return append([]byte(nil), buf[:n]...)
+	}
+	// exchange lets the client and server exchange packets
+	exchange := func() {
+		updateConns(DeltaTime, 20, func() bool { return false }, clientPacket, client, server)
+	}
+
+	t.Logf("check replayed packet doesn't migrate the session\n")
+	stale := capture()
+	exchange()
+	require.NoError(t, attacker.Send(sAddr, stale))
+	exchange()
+	assert.EqualValues(t, 1, server.DropStats().Replayed)
+
+	t.Logf("check fresh packet from the attacker doesn't migrate the session\n")
+	fresh := capture()
+	require.NoError(t, attacker.Send(sAddr, fresh))
+	var packet [256]byte
+	for try := 0; try < 10; try++ {
+		assert.Equal(t, 0, server.ReceivePacket(packet[:]), "payloads from an unvalidated address should be dropped")
+	}
+	require.NotNil(t, server.peers[0].migration, "server should challenge the new address")
+
+	// the attacker can't open the challenge, it sends garbage back
+	var from net.UDPAddr
+	var n int
+	for try := 0; try < 10 && n == 0; try++ {
+		n = attacker.Receive(&from, packet[:])
+	}
+	require.True(t, n > 0, "attacker should receive the challenge")
+	assert.Equal(t, migrationChallengePacket, packet[4])
+	response := []byte{0x11, 0x11, 0x22, 0x22, migrationResponsePacket}
+	response = appendUint64(response, client.sessionID)
+	response = append(response, make([]byte, sealedOverhead+migrationChallengeSize)...)
+	require.NoError(t, attacker.Send(sAddr, response))
+	exchange()
+
+	assert.Empty(t, cb.migrations)
+	peer, ok := server.PeerBySlot(0)
+	require.True(t, ok)
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", clientPort), peer.Address.String())
+	assert.True(t, client.IsConnected(), "client should still be connected")
+
+	t.Logf("check unknown session id is ignored\n")
+	forged := append([]byte(nil), fresh...)
+	forged[5] ^= 0xFF
+	require.NoError(t, attacker.Send(sAddr, forged))
+	exchange()
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", clientPort), server.peers[0].address.String())
+}
@@ -0,0 +1,455 @@
+package udpnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// packet types of the mesh protocol
+const (
+	nodeHelloPacket   byte = iota // join, answered by a hello
+	nodePayloadPacket             // reliability header and payload, or header only for an ack
+	nodeByePacket                 // leave
+)
+
+const (
+	// helloInterval is the interval between two hellos sent to a peer not
+	// answering yet.
+	helloInterval = 100 * time.Millisecond
+)
+
+// NodeCallback is the interface implemented by objects handling the peers
+// joining and leaving a Node.
+type NodeCallback interface {
+	OnPeerJoin(addr *net.UDPAddr)
+	OnPeerLeave(addr *net.UDPAddr)
+}
+
+// PeerStats holds the statistics of the reliable connection to a peer.
+type PeerStats struct {
+	RoundTripTime   time.Duration
+	SentPackets     uint
+	ReceivedPackets uint
+	LostPackets     uint
+	AckedPackets    uint
+	SentBandwidth   float64
+	AckedBandwidth  float64
+}
+
+// meshPeer is a peer of a Node.
+type meshPeer struct {
+	address            *net.UDPAddr
+	joined             bool // the peer answered
+	reliabilitySystem  *ReliabilitySystem
+	timeoutAccumulator time.Duration
+	sinceLastSend      time.Duration // time since the last packet sent to the peer
+	hello              time.Duration // time left before the next hello
+}
+
+// Node is a peer of a mesh, it keeps a reliable connection to each of its
+// peers on a single socket. Peers are added explicitly with AddPeer, or join
+// by saying hello if the node accepts them. A peer leaves when it says bye or
+// times out.
+//
+// Payloads to a peer carry the same reliability header as a ReliableConn, in
+// the node header format and followed by the ack extension if the ack window
+// or ack ranges are set. All the nodes of a mesh must use the same framing,
+// header format and acks settings.
+type Node struct {
+	protocolID   uint
+	timeout      time.Duration
+	maxSequence  uint
+	maxPeers     int
+	accept       bool // accept the peers saying hello
+	framing      Framing
+	headerFormat HeaderFormat
+	ackWindow    uint // ack window of the peers reliability systems
+	maxAckRanges int  // max ack ranges of the peers reliability systems
+	socket       Socket
+	running      bool
+	peers        []*meshPeer
+	cb           NodeCallback
+}
+
+// NewNode returns a new node using given protocol id, timeout and maximum
+// sequence number for its reliable connections.
+func NewNode(cb NodeCallback, protocolID uint, timeout time.Duration, maxSequence uint) *Node {
+	return &Node{
+		protocolID:  protocolID,
+		timeout:     timeout,
+		maxSequence: maxSequence,
+		maxPeers:    16,
+		ackWindow:   32,
+		cb:          cb,
+	}
+}
+
+// SetMaxPeers sets the maximum number of peers, 16 by default.
+func (n *Node) SetMaxPeers(max int) error {
+	if max < 1 {
+		return errors.New("max peers must be at least 1")
+	}
+	if max < len(n.peers) {
+		return errors.New("node has more peers than that")
+	}
+	n.maxPeers = max
+	return nil
+}
+
+// SetAcceptPeers sets if unknown peers saying hello join the node, false by
+// default so that only the peers added with AddPeer join. Hellos are not
+// authenticated, anyone reaching the node can join it when it accepts peers.
+func (n *Node) SetAcceptPeers(accept bool) {
+	n.accept = accept
+}
+
+// SetFraming sets the packet framing, ProtocolIDFraming by default.
+func (n *Node) SetFraming(framing Framing) {
+	n.framing = framing
+}
+
+// Framing returns the packet framing.
+func (n *Node) Framing() Framing {
+	return n.framing
+}
+
+// SetHeaderFormat sets the format of the reliability header, FixedHeader by
+// default. It can't change once peers are added. CompactHeader requires a
+// maximum sequence lower or equal to MaxCompactSequence.
+func (n *Node) SetHeaderFormat(format HeaderFormat) error {
+	if len(n.peers) > 0 {
+		return errors.New("header format can't change once peers are added")
+	}
+	if format == CompactHeader && n.maxSequence > MaxCompactSequence {
+		return errors.New("compact header requires maxSequence <= MaxCompactSequence")
+	}
+	n.headerFormat = format
+	return nil
+}
+
+// HeaderFormat returns the format of the reliability header.
+func (n *Node) HeaderFormat() HeaderFormat {
+	return n.headerFormat
+}
+
+// SetAckWindow sets the ack window of the connections to the peers, see
+// ReliabilitySystem.SetAckWindow. It can't change once peers are added.
+func (n *Node) SetAckWindow(window uint) error {
+	if len(n.peers) > 0 {
+		return errors.New("ack window can't change once peers are added")
+	}
+	if err := NewReliabilitySystem(n.maxSequence).SetAckWindow(window); err != nil {
+		return err
+	}
+	n.ackWindow = window
+	return nil
+}
+
+// SetMaxAckRanges sets the maximum number of ack ranges of the connections to
+// the peers, see ReliabilitySystem.SetMaxAckRanges. It can't change once
+// peers are added.
+func (n *Node) SetMaxAckRanges(max int) error {
+	if len(n.peers) > 0 {
+		return errors.New("max ack ranges can't change once peers are added")
+	}
+	if err := NewReliabilitySystem(n.maxSequence).SetMaxAckRanges(max); err != nil {
+		return err
+	}
+	n.maxAckRanges = max
+	return nil
+}
+
+// Start starts the node on given port.
+func (n *Node) Start(port int) bool {
+	if err := n.socket.Open(port); err != nil {
+		return false
+	}
+	n.running = true
+	return true
+}
+
+// Stop says bye to all peers and stops the node.
+func (n *Node) Stop() {
+	if !n.running {
+		return
+	}
+	for len(n.peers) > 0 {
+		n.RemovePeer(n.peers[0].address)
+	}
+	n.socket.Close()
+	n.running = false
+}
+
+// IsRunning indicates if the node is running.
+func (n *Node) IsRunning() bool {
+	return n.running
+}
+
+// AddPeer starts to join the peer at addr. The peer joins once it answers.
+func (n *Node) AddPeer(addr *net.UDPAddr) error {
+	if n.peer(addr) != nil {
+		return fmt.Errorf("peer %v already added", addr)
+	}
+	if len(n.peers) >= n.maxPeers {
+		return errors.New("too many peers")
+	}
+	n.peers = append(n.peers, n.newPeer(addr))
+	return nil
+}
+
+// RemovePeer says bye to the peer at addr and removes it.
+func (n *Node) RemovePeer(addr *net.UDPAddr) error {
+	p := n.peer(addr)
+	if p == nil {
+		return fmt.Errorf("unknown peer %v", addr)
+	}
+	n.sendPacket(p.address, nodeByePacket, nil)
+	n.removePeer(p)
+	return nil
+}
+
+// Peers returns the addresses of the joined peers.
+func (n *Node) Peers() []*net.UDPAddr {
+	var addrs []*net.UDPAddr
+	for _, p := range n.peers {
+		if p.joined {
+			addrs = append(addrs, p.address)
+		}
+	}
+	return addrs
+}
+
+// PeerStats returns the statistics of the connection to the peer at addr.
+func (n *Node) PeerStats(addr *net.UDPAddr) (PeerStats, bool) {
+	p := n.peer(addr)
+	if p == nil || !p.joined {
+		return PeerStats{}, false
+	}
+	rs := p.reliabilitySystem
+	return PeerStats{
+		RoundTripTime:   rs.RoundTripTime(),
+		SentPackets:     rs.SentPackets(),
+		ReceivedPackets: rs.ReceivedPackets(),
+		LostPackets:     rs.LostPackets(),
+		AckedPackets:    rs.AckedPackets(),
+		SentBandwidth:   rs.SentBandwidth(),
+		AckedBandwidth:  rs.AckedBandwidth(),
+	}, true
+}
+
+// ReliabilitySystem returns the reliability system of the connection to the
+// peer at addr, or nil.
+func (n *Node) ReliabilitySystem(addr *net.UDPAddr) *ReliabilitySystem {
+	if p := n.peer(addr); p != nil {
+		return p.reliabilitySystem
+	}
+	return nil
+}
+
+// SendPacketTo sends a slice of data to the peer at addr.
+func (n *Node) SendPacketTo(addr *net.UDPAddr, data []byte) error {
+	p := n.peer(addr)
+	if p == nil || !p.joined {
+		return fmt.Errorf("peer %v not joined", addr)
+	}
+	return n.sendPayload(p, data)
+}
+
+// Broadcast sends a slice of data to all joined peers.
+func (n *Node) Broadcast(data []byte) error {
+	var err error
+	for _, p := range n.peers {
+		if !p.joined {
+			continue
+		}
+		if e := n.sendPayload(p, data); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ReceivePacket receives a slice of data sent by a peer, returns its size and
+// the peer address, or 0 if there is none.
+func (n *Node) ReceivePacket(data []byte) (int, *net.UDPAddr) {
+	if !n.running {
+		return 0, nil
+	}
+	packet := make([]byte, 5+n.maxHeaderSize()+len(data))
+	for {
+		var sender net.UDPAddr
+		bytesRead := n.socket.Receive(&sender, packet)
+		if bytesRead == 0 {
+			return 0, nil
+		}
+		if !hasFraming(packet[:bytesRead], n.framing, n.protocolID) {
+			continue
+		}
+		body := packet[5:bytesRead]
+		p := n.peer(&sender)
+		switch packet[4] {
+		case nodeHelloPacket:
+			n.processHello(p, &sender)
+		case nodeByePacket:
+			if p != nil {
+				n.removePeer(p)
+			}
+		case nodePayloadPacket:
+			if p == nil {
+				continue
+			}
+			header := processReliabilityHeader(body, p.reliabilitySystem, n.headerFormat)
+			if header == 0 {
+				continue
+			}
+			n.join(p)
+			p.timeoutAccumulator = 0
+			if len(body) == header {
+				// ack-only packet
+				continue
+			}
+			return copy(data, body[header:]), p.address
+		}
+	}
+}
+
+// Update sends the hellos and keep alive packets, and times out the peers.
+func (n *Node) Update(dt time.Duration) {
+	if !n.running {
+		return
+	}
+	for i := 0; i < len(n.peers); i++ {
+		p := n.peers[i]
+		p.timeoutAccumulator += dt
+		if p.timeoutAccumulator > n.timeout {
+			n.removePeer(p)
+			i--
+			continue
+		}
+		if !p.joined {
+			p.hello -= dt
+			if p.hello <= 0 {
+				n.sendPacket(p.address, nodeHelloPacket, nil)
+				p.hello = helloInterval
+			}
+			continue
+		}
+		p.reliabilitySystem.Update(dt)
+		p.sinceLastSend += dt
+		if p.sinceLastSend >= n.timeout/4 {
+			// keep alive, carrying the acks
+			n.sendHeader(p, nil)
+		}
+	}
+}
+
+func (n *Node) newPeer(addr *net.UDPAddr) *meshPeer {
+	rs := NewReliabilitySystem(n.maxSequence)
+	// validated by SetAckWindow and SetMaxAckRanges
+	rs.SetAckWindow(n.ackWindow)
+	rs.SetMaxAckRanges(n.maxAckRanges)
+	return &meshPeer{
+		address:           copyAddr(addr),
+		reliabilitySystem: rs,
+	}
+}
+
+// maxHeaderSize returns the maximum size of the reliability header of the
+// node payloads.
+func (n *Node) maxHeaderSize() int {
+	size := 12
+	if n.headerFormat == CompactHeader {
+		size = maxCompactHeaderSize
+	}
+	if n.ackWindow > 32 || n.maxAckRanges > 0 {
+		size += maxAckExtensionSize(n.ackWindow, n.maxAckRanges)
+	}
+	return size
+}
+
+func (n *Node) peer(addr *net.UDPAddr) *meshPeer {
+	for _, p := range n.peers {
+		if sameAddress(p.address, addr) {
+			return p
+		}
+	}
+	return nil
+}
+
+// processHello answers the hello of a peer, unknown peers join if the node
+// accepts them.
+func (n *Node) processHello(p *meshPeer, sender *net.UDPAddr) {
+	if p == nil {
+		if !n.accept || len(n.peers) >= n.maxPeers {
+			return
+		}
+		p = n.newPeer(sender)
+		n.peers = append(n.peers, p)
+	}
+	p.timeoutAccumulator = 0
+	if !p.joined {
+		n.sendPacket(p.address, nodeHelloPacket, nil)
+		n.join(p)
+	} else if p.sinceLastSend > helloInterval {
+		// the peer didn't get our hello yet
+		n.sendPacket(p.address, nodeHelloPacket, nil)
+	}
+}
+
+func (n *Node) join(p *meshPeer) {
+	if p.joined {
+		return
+	}
+	p.joined = true
+	p.sinceLastSend = 0
+	if n.cb != nil {
+		n.cb.OnPeerJoin(p.address)
+	}
+}
+
+func (n *Node) removePeer(p *meshPeer) {
+	for i, q := range n.peers {
+		if q == p {
+			copy(n.peers[i:], n.peers[i+1:])
+			n.peers[len(n.peers)-1] = nil
+			n.peers = n.peers[:len(n.peers)-1]
+			break
+		}
+	}
+	if p.joined && n.cb != nil {
+		n.cb.OnPeerLeave(p.address)
+	}
+}
+
+// sendPayload sends data to a peer, accounting for it in the reliability
+// system.
+func (n *Node) sendPayload(p *meshPeer, data []byte) error {
+	if err := n.sendHeader(p, data); err != nil {
+		return err
+	}
+	p.reliabilitySystem.PacketSent(len(data))
+	return nil
+}
+
+// sendHeader sends the reliability header followed by data to a peer.
+func (n *Node) sendHeader(p *meshPeer, data []byte) error {
+	rs := p.reliabilitySystem
+	body := make([]byte, maxReliabilityHeaderSize(rs, n.headerFormat)+len(data))
+	header := encodeReliabilityHeader(body, rs, n.headerFormat, rs.LocalSequence(), rs.RemoteSequence(), rs.GenerateAckBits())
+	copy(body[header:], data)
+	p.sinceLastSend = 0
+	return n.sendPacket(p.address, nodePayloadPacket, body[:header+len(data)])
+}
+
+func (n *Node) sendPacket(addr *net.UDPAddr, packetType byte, body []byte) error {
+	if !n.running {
+		return errors.New("node not running")
+	}
+	packet := make([]byte, 5+len(body))
+	packet[4] = packetType
+	copy(packet[5:], body)
+	writeFraming(packet, n.framing, n.protocolID)
+	return n.socket.Send(addr, packet)
+}
@@ -0,0 +1,219 @@
+package udpnet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nodeCallback records the peers joining and leaving a node.
+type nodeCallback struct {
+	joined []string
+	left   []string
+}
+
+func (nc *nodeCallback) OnPeerJoin(addr *net.UDPAddr)  { nc.joined = append(nc.joined, addr.String()) }
+func (nc *nodeCallback) OnPeerLeave(addr *net.UDPAddr) { nc.left = append(nc.left, addr.String()) }
+
+// updateNodes updates nodes until done returns true. It returns the payloads
+// each node received, formatted as "from:payload".
+func updateNodes(dt time.Duration, maxIterations int, done func() bool, nodes ...*Node) [][]string {
+	received := make([][]string, len(nodes))
+	for i := 0; i < maxIterations && !done(); i++ {
+		for j, n := range nodes {
+			for {
+				var data [256]byte
+				size, from := n.ReceivePacket(data[:])
+				if size == 0 {
+					break
+				}
+				received[j] = append(received[j], fmt.Sprintf("%d:%s", from.Port, data[:size]))
+			}
+			n.Update(dt)
+		}
+	}
+	return received
+}
+
+func TestNodeMesh(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(200) * time.Millisecond
+	)
+
+	var (
+		nodes []*Node
+		cbs   []*nodeCallback
+		addrs []*net.UDPAddr
+	)
+	for i := 0; i < 3; i++ {
+		cb := &nodeCallback{}
+		n := NewNode(cb, protocolID, TimeOut, maxSequence)
+		require.True(t, n.Start(serverPort+i), "couldn't start node")
+		defer n.Stop()
+		addr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort+i))
+		nodes, cbs, addrs = append(nodes, n), append(cbs, cb), append(addrs, addr)
+	}
+
+	// every node adds the others, nodes don't accept unknown peers
+	for i, n := range nodes {
+		for j, addr := range addrs {
+			if i != j {
+				require.NoError(t, n.AddPeer(addr))
+			}
+		}
+	}
+	assert.Error(t, nodes[0].AddPeer(addrs[1]), "peer should already be added")
+	meshed := func() bool {
+		for _, n := range nodes {
+			if len(n.Peers()) != 2 {
+				return false
+			}
+		}
+		return true
+	}
+	updateNodes(DeltaTime, 1000, meshed, nodes...)
+	require.True(t, meshed(), "nodes should form a mesh")
+	for _, cb := range cbs {
+		assert.Len(t, cb.joined, 2, "node should see 2 peers joining")
+	}
+
+	t.Logf("check broadcast and send to one peer\n")
+	require.NoError(t, nodes[0].Broadcast([]byte("all")))
+	require.NoError(t, nodes[2].SendPacketTo(addrs[1], []byte("one")))
+	received := updateNodes(DeltaTime, 20, func() bool { return false }, nodes...)
+	assert.Empty(t, received[0])
+	assert.Equal(t, []string{fmt.Sprintf("%d:all", serverPort), fmt.Sprintf("%d:one", serverPort+2)}, received[1])
+	assert.Equal(t, []string{fmt.Sprintf("%d:all", serverPort)}, received[2])
+
+	t.Logf("check per-peer stats\n")
+	for i := 0; i < 50; i++ {
+		nodes[0].Broadcast(clientPacket)
+		nodes[1].Broadcast(clientPacket)
+		nodes[2].Broadcast(clientPacket)
+		updateNodes(DeltaTime, 1, func() bool { return false }, nodes...)
+	}
+	stats, ok := nodes[0].PeerStats(addrs[1])
+	require.True(t, ok)
+	assert.EqualValues(t, 51, stats.SentPackets)
+	assert.True(t, stats.AckedPackets > 0, "packets should be acked")
+	assert.True(t, stats.ReceivedPackets > 0, "packets should be received")
+	stats2, ok := nodes[0].PeerStats(addrs[2])
+	require.True(t, ok)
+	assert.EqualValues(t, 51, stats2.SentPackets)
+
+	t.Logf("check peer leaving\n")
+	nodes[2].Stop()
+	updateNodes(DeltaTime, 20, func() bool { return len(nodes[0].Peers()) == 1 }, nodes[:2]...)
+	assert.Equal(t, []string{addrs[2].String()}, cbs[0].left)
+	assert.Equal(t, []string{addrs[2].String()}, cbs[1].left)
+	_, ok = nodes[0].PeerStats(addrs[2])
+	assert.False(t, ok)
+
+	t.Logf("check peer timing out\n")
+	updateNodes(DeltaTime, 1000, func() bool { return len(cbs[0].left) == 2 }, nodes[0])
+	assert.Equal(t, []string{addrs[2].String(), addrs[1].String()}, cbs[0].left)
+	assert.Empty(t, nodes[0].Peers())
+}
+
+func TestNodeAcceptPeers(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(200) * time.Millisecond
+	)
+
+	closed := NewNode(nil, protocolID, TimeOut, maxSequence)
+	require.True(t, closed.Start(serverPort), "couldn't start node")
+	defer closed.Stop()
+	open := NewNode(nil, protocolID, TimeOut, maxSequence)
+	open.SetAcceptPeers(true)
+	require.True(t, open.Start(clientPort+2), "couldn't start node")
+	defer open.Stop()
+	full := NewNode(nil, protocolID, TimeOut, maxSequence)
+	require.NoError(t, full.SetMaxPeers(1))
+	assert.Error(t, full.SetMaxPeers(0))
+	require.True(t, full.Start(serverPort+1), "couldn't start node")
+	defer full.Stop()
+	joiner := NewNode(nil, protocolID, TimeOut, maxSequence)
+	require.True(t, joiner.Start(clientPort+1), "couldn't start node")
+	defer joiner.Stop()
+
+	cAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	fAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort+1))
+	oAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", clientPort+2))
+	require.NoError(t, full.AddPeer(cAddr))
+	assert.Error(t, full.AddPeer(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}), "node should be full")
+	require.NoError(t, joiner.AddPeer(cAddr))
+	require.NoError(t, joiner.AddPeer(fAddr))
+	require.NoError(t, joiner.AddPeer(oAddr))
+	updateNodes(DeltaTime, 100, func() bool { return false }, closed, full, open, joiner)
+	assert.Empty(t, closed.Peers(), "nodes should not accept unknown peers by default")
+	assert.Empty(t, full.Peers())
+	assert.Len(t, open.Peers(), 1, "open node should accept the joiner")
+	require.Len(t, joiner.Peers(), 1)
+	assert.Equal(t, oAddr.String(), joiner.Peers()[0].String())
+}
+
+func TestNodeHeaderOptions(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(200) * time.Millisecond
+	)
+
+	wide := NewNode(nil, protocolID, TimeOut, maxSequence)
+	assert.Error(t, wide.SetHeaderFormat(CompactHeader), "compact header requires 16-bit sequences")
+	assert.Error(t, wide.SetAckWindow(40))
+	assert.Error(t, NewNode(nil, protocolID, TimeOut, 0xFF).SetAckWindow(512), "ack window should fit in the sequence space")
+	assert.Error(t, wide.SetMaxAckRanges(-1))
+
+	var (
+		nodes []*Node
+		addrs []*net.UDPAddr
+	)
+	for i := 0; i < 2; i++ {
+		n := NewNode(nil, protocolID, TimeOut, MaxCompactSequence)
+		n.SetFraming(ChecksumFraming)
+		require.NoError(t, n.SetHeaderFormat(CompactHeader))
+		require.NoError(t, n.SetAckWindow(64))
+		require.NoError(t, n.SetMaxAckRanges(2))
+		require.True(t, n.Start(serverPort+i), "couldn't start node")
+		defer n.Stop()
+		addr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort+i))
+		nodes, addrs = append(nodes, n), append(addrs, addr)
+	}
+	// a node with the default framing can't talk to them
+	other := NewNode(nil, protocolID, TimeOut, MaxCompactSequence)
+	require.True(t, other.Start(clientPort+1), "couldn't start node")
+	defer other.Stop()
+	require.NoError(t, other.AddPeer(addrs[0]))
+	require.NoError(t, nodes[0].AddPeer(addrs[1]))
+	require.NoError(t, nodes[1].AddPeer(addrs[0]))
+	assert.Error(t, nodes[0].SetHeaderFormat(FixedHeader), "header format can't change once peers are added")
+	assert.Error(t, nodes[0].SetAckWindow(32), "ack window can't change once peers are added")
+
+	updateNodes(DeltaTime, 1000, func() bool {
+		return len(nodes[0].Peers()) == 1 && len(nodes[1].Peers()) == 1
+	}, nodes[0], nodes[1], other)
+	require.Len(t, nodes[0].Peers(), 1)
+	require.Len(t, nodes[1].Peers(), 1)
+	assert.Empty(t, other.Peers(), "nodes with another framing should not join")
+
+	t.Logf("check payloads and acks go through the compact header and ack extension\n")
+	var received int
+	for i := 0; i < 50; i++ {
+		require.NoError(t, nodes[0].Broadcast(clientPacket))
+		require.NoError(t, nodes[1].Broadcast(serverPacket))
+		r := updateNodes(DeltaTime, 1, func() bool { return false }, nodes...)
+		received += len(r[0]) + len(r[1])
+	}
+	assert.True(t, received >= 98, "payloads should be received")
+	stats, ok := nodes[0].PeerStats(addrs[1])
+	require.True(t, ok)
+	assert.EqualValues(t, 50, stats.SentPackets)
+	assert.True(t, stats.AckedPackets >= 48, "packets should be acked")
+	assert.EqualValues(t, 0, stats.LostPackets)
+}
@@ -438,3 +438,100 @@ func TestSequenceWrapAround(t *testing.T) {
 	assert.True(t, client.IsConnected(), "client should be connected")
 	assert.True(t, server.IsConnected(), "server should be connected")
 }
+
+func TestAckWindow(t *testing.T) {
+	const (
+		DeltaTime   = time.Millisecond
+		TimeOut     = time.Duration(100) * time.Millisecond
+		PacketCount = 200
+		Burst       = 48 // client packets sent per server packet
+	)
+
+	configs := []struct {
+		window    uint
+		maxRanges int
+	}{
+		{64, 0},
+		{32, 4},
+	}
+
+	for _, cfg := range configs {
+		t.Logf("check ack window %d, max ack ranges %d\n", cfg.window, cfg.maxRanges)
+
+		client := NewReliableConn(protocolID, TimeOut, maxSequence)
+		require.NoError(t, client.ReliabilitySystem().SetAckWindow(cfg.window))
+		require.NoError(t, client.ReliabilitySystem().SetMaxAckRanges(cfg.maxRanges))
+		require.True(t, client.Start(clientPort), "couldn't start client connection")
+
+		server := NewReliableConn(protocolID, TimeOut, maxSequence)
+		require.NoError(t, server.ReliabilitySystem().SetAckWindow(cfg.window))
+		require.NoError(t, server.ReliabilitySystem().SetMaxAckRanges(cfg.maxRanges))
+		require.True(t, server.Start(serverPort), "couldn't start server connection")
+
+		cAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+		client.Connect(cAddr)
+		server.Listen()
+
+		var (
+			clientAckedPackets [PacketCount]bool
+			allPacketsAcked    bool
+		)
+
+		for iter := 0; !allPacketsAcked && iter < 100; iter++ {
+			if !client.IsConnecting() && client.ConnectFailed() {
+				break
+			}
+
+			var ackPacket [256]byte
+			for i := range ackPacket {
+				ackPacket[i] = byte(i)
+			}
+
+			// more packets than the 32 ack bits can cover between two acks
+			for i := 0; i < Burst; i++ {
+				client.SendPacket(ackPacket[:])
+				for {
+					var packet [256]byte
+					if server.ReceivePacket(packet[:]) == 0 {
+						break
+					}
+				}
+			}
+
+			server.SendPacket(ackPacket[:])
+			for {
+				var packet [256]byte
+				if client.ReceivePacket(packet[:]) == 0 {
+					break
+				}
+			}
+
+			for _, ack := range client.ReliabilitySystem().Acks() {
+				if ack < PacketCount {
+					assert.False(t, clientAckedPackets[ack])
+					clientAckedPackets[ack] = true
+				}
+			}
+
+			var clientAckCount uint
+			for i := 0; i < PacketCount; i++ {
+				if clientAckedPackets[i] {
+					clientAckCount++
+				}
+			}
+			allPacketsAcked = clientAckCount == PacketCount
+
+			client.Update(DeltaTime)
+			validateReliabilitySystem(t, client.reliabilitySystem)
+			server.Update(DeltaTime)
+			validateReliabilitySystem(t, server.reliabilitySystem)
+		}
+
+		assert.True(t, allPacketsAcked, "all client packets should be acked")
+		assert.True(t, client.IsConnected(), "client should be connected")
+		assert.True(t, server.IsConnected(), "server should be connected")
+
+		client.Stop()
+		server.Stop()
+	}
+}
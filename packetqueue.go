@@ -1,6 +1,9 @@
 package udpnet
 
-import "time"
+import (
+	"sort"
+	"time"
+)
 
 // packet queue to store information about sent and received packets sorted in
 // sequence order + we define ordering using the "sequenceMoreRecent" function,
@@ -60,8 +63,8 @@ func bitIndexForSequence(sequence, ack, maxSequence uint) uint {
 		panic("assert(!sequenceMoreRecent(sequence, ack, maxSequence))")
 	}
 	if sequence > ack {
-		if ack >= 33 {
-			panic("assert(ack < 33)")
+		if ack >= maxAckHistory {
+			panic("assert(ack < maxAckHistory)")
 		}
 		if maxSequence < sequence {
 			panic("assert(maxSequence >= sequence)")
@@ -128,3 +131,126 @@ func processAck(ack, ackBits uint,
 		}
 	}
 }
+
+// ackRange is a run of consecutive received sequences, older than the ack
+// bits window. offset is the distance from ack to the most recent sequence of
+// the run, count is the run length.
+type ackRange struct {
+	offset uint
+	count  uint
+}
+
+// ackExtension holds the ack information sent in addition to the 32 ack bits.
+type ackExtension struct {
+	bits   []byte     // ack bits 32 and above, 8 per byte, least significant first
+	ranges []ackRange // received sequences older than the ack window
+}
+
+// generateAckExtension returns the ack bits 32 to window-1 for the sequences
+// before ack, and up to maxRanges runs of received sequences older than the
+// window, most recent first.
+func generateAckExtension(ack, window uint, maxRanges int, receivedQueue *PacketQueue, maxSequence uint) ackExtension {
+	var ext ackExtension
+	if window > 32 {
+		ext.bits = make([]byte, (window-32)/8)
+	}
+	for itor := 0; itor < len(*receivedQueue); itor++ {
+		iseq := (*receivedQueue)[itor].sequence
+		if iseq == ack || sequenceMoreRecent(iseq, ack, maxSequence) {
+			continue
+		}
+		bitIndex := bitIndexForSequence(iseq, ack, maxSequence)
+		if bitIndex >= 32 && bitIndex < window {
+			ext.bits[(bitIndex-32)/8] |= 1 << ((bitIndex - 32) % 8)
+		}
+	}
+	if maxRanges == 0 {
+		return ext
+	}
+	for _, offset := range olderOffsets(ack, window, receivedQueue, maxSequence) {
+		n := len(ext.ranges)
+		if n > 0 && ext.ranges[n-1].offset+ext.ranges[n-1].count == offset {
+			ext.ranges[n-1].count++
+			continue
+		}
+		if n == maxRanges {
+			break
+		}
+		ext.ranges = append(ext.ranges, ackRange{offset: offset, count: 1})
+	}
+	return ext
+}
+
+// olderOffsets returns the offsets from ack of the received sequences older
+// than the ack window, most recent first.
+func olderOffsets(ack, window uint, receivedQueue *PacketQueue, maxSequence uint) []uint {
+	var older []uint
+	for itor := 0; itor < len(*receivedQueue); itor++ {
+		iseq := (*receivedQueue)[itor].sequence
+		if iseq == ack || sequenceMoreRecent(iseq, ack, maxSequence) {
+			continue
+		}
+		if bitIndex := bitIndexForSequence(iseq, ack, maxSequence); bitIndex >= window {
+			older = append(older, bitIndex+1)
+		}
+	}
+	sort.Slice(older, func(i, j int) bool { return older[i] < older[j] })
+	return older
+}
+
+// countAckRanges returns the number of ack ranges generateAckExtension would
+// generate, without generating them.
+func countAckRanges(ack, window uint, maxRanges int, receivedQueue *PacketQueue, maxSequence uint) int {
+	var n int
+	older := olderOffsets(ack, window, receivedQueue, maxSequence)
+	for i, offset := range older {
+		if i > 0 && older[i-1]+1 == offset {
+			continue
+		}
+		if n == maxRanges {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// processAckExtension acks the pending packets covered by the ack extension,
+// it complements processAck which handles the 32 first ack bits.
+func processAckExtension(ack uint, ext ackExtension,
+	pendingAckQueue, ackedQueue *PacketQueue,
+	acks *[]uint, ackedPackets *uint,
+	rtt *time.Duration, maxSequence uint) {
+	window := uint(32 + 8*len(ext.bits))
+	i := 0
+	for i < len(*pendingAckQueue) {
+		var acked bool
+		itor := &(*pendingAckQueue)[i]
+
+		if itor.sequence != ack && !sequenceMoreRecent(itor.sequence, ack, maxSequence) {
+			bitIndex := bitIndexForSequence(itor.sequence, ack, maxSequence)
+			if bitIndex >= 32 && bitIndex < window {
+				acked = (ext.bits[(bitIndex-32)/8]>>((bitIndex-32)%8))&1 != 0
+			} else if bitIndex >= window {
+				offset := bitIndex + 1
+				for _, r := range ext.ranges {
+					if offset >= r.offset && offset < r.offset+r.count {
+						acked = true
+						break
+					}
+				}
+			}
+		}
+
+		if acked {
+			(*rtt) += (itor.time - *rtt) / 10
+
+			ackedQueue.InsertSorted(*itor, maxSequence)
+			*acks = append(*acks, itor.sequence)
+			*ackedPackets++
+			*pendingAckQueue = append((*pendingAckQueue)[:i], (*pendingAckQueue)[i+1:]...)
+		} else {
+			i++
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package udpnet
+
+import (
+	"errors"
+)
+
+// SimulateFunc advances a state by one tick with an input, returning the new
+// state. States must be values: the state given must not be modified.
+type SimulateFunc func(state interface{}, input Input) interface{}
+
+// DistanceFunc returns the magnitude of the difference between two states,
+// for example the distance between two positions.
+type DistanceFunc func(a, b interface{}) float64
+
+// prediction is the state predicted after applying the input of a tick.
+type prediction struct {
+	input Input
+	state interface{}
+}
+
+// Predictor predicts, on a client, the state of the objects it controls by
+// applying its inputs locally, without waiting for the server. Predicted
+// states are kept by input tick, until the server sends the authoritative
+// state for that tick. If the prediction was wrong, the authoritative state
+// replaces it and the inputs of the following ticks, not processed by the
+// server yet, are applied again on top of it.
+type Predictor struct {
+	simulate    SimulateFunc
+	distance    DistanceFunc
+	tolerance   float64
+	capacity    int
+	state       interface{}  // current predicted state
+	history     []prediction // predictions not confirmed yet, oldest first
+	lastTick    uint64       // tick of the last authoritative state reconciled
+	reconciled  bool         // an authoritative state was reconciled
+	corrections uint64       // number of mispredictions corrected
+	lastError   float64      // magnitude of the last misprediction
+}
+
+// NewPredictor returns a predictor starting from state, remembering up to
+// capacity predictions.
+func NewPredictor(state interface{}, capacity int, simulate SimulateFunc, distance DistanceFunc) (*Predictor, error) {
+	if capacity < 1 {
+		return nil, errors.New("capacity must be at least 1")
+	}
+	if simulate == nil || distance == nil {
+		return nil, errors.New("missing simulate or distance function")
+	}
+	return &Predictor{
+		simulate: simulate,
+		distance: distance,
+		capacity: capacity,
+		state:    state,
+	}, nil
+}
+
+// SetTolerance sets the difference between predicted and authoritative
+// states under which predictions are considered right, 0 by default.
+func (p *Predictor) SetTolerance(tolerance float64) {
+	p.tolerance = tolerance
+}
+
+// State returns the current predicted state.
+func (p *Predictor) State() interface{} {
+	return p.state
+}
+
+// Pending returns the number of predictions not confirmed by the server yet.
+func (p *Predictor) Pending() int {
+	return len(p.history)
+}
+
+// Stats returns the number of mispredictions corrected, and the magnitude of
+// the last one.
+func (p *Predictor) Stats() (corrections uint64, lastError float64) {
+	return p.corrections, p.lastError
+}
+
+// Predict applies the input of the next tick to the current state and
+// returns the predicted state. Ticks must increase, and be newer than the
+// last authoritative state reconciled.
+func (p *Predictor) Predict(input Input) (interface{}, error) {
+	if n := len(p.history); n > 0 && input.Tick <= p.history[n-1].input.Tick {
+		return nil, errors.New("input ticks must increase")
+	}
+	if p.reconciled && input.Tick <= p.lastTick {
+		return nil, errors.New("input tick already reconciled")
+	}
+	p.state = p.simulate(p.state, input)
+	if len(p.history) == p.capacity {
+		copy(p.history, p.history[1:])
+		p.history = p.history[:p.capacity-1]
+	}
+	p.history = append(p.history, prediction{input: input, state: p.state})
+	return p.state, nil
+}
+
+// Reconcile compares the authoritative state of a tick, received from the
+// server, with the state predicted for that tick. If they differ by more
+// than the tolerance, it rewinds to the authoritative state and replays the
+// inputs of the following ticks. It returns the magnitude of the difference
+// and whether the state was corrected.
+//
+// States of ticks older than the predictions kept, or than the last state
+// reconciled, are ignored. States of ticks newer than the last prediction
+// replace the current state.
+func (p *Predictor) Reconcile(tick uint64, authoritative interface{}) (float64, bool) {
+	if p.reconciled && tick <= p.lastTick {
+		// late or duplicated state
+		return 0, false
+	}
+	if len(p.history) == 0 || tick > p.history[len(p.history)-1].input.Tick {
+		magnitude := p.distance(p.state, authoritative)
+		p.history = p.history[:0]
+		p.state = authoritative
+		p.setLastTick(tick)
+		return magnitude, p.corrected(magnitude)
+	}
+	i := 0
+	for i < len(p.history) && p.history[i].input.Tick < tick {
+		i++
+	}
+	if p.history[i].input.Tick != tick {
+		// too old, or the prediction of that tick was forgotten
+		return 0, false
+	}
+	magnitude := p.distance(p.history[i].state, authoritative)
+	replay := p.history[i+1:]
+	p.history = p.history[:copy(p.history, replay)]
+	p.setLastTick(tick)
+	if magnitude <= p.tolerance {
+		return magnitude, false
+	}
+	p.state = authoritative
+	for j := range p.history {
+		p.state = p.simulate(p.state, p.history[j].input)
+		p.history[j].state = p.state
+	}
+	return magnitude, p.corrected(magnitude)
+}
+
+// setLastTick records tick as the last authoritative state reconciled.
+func (p *Predictor) setLastTick(tick uint64) {
+	p.lastTick = tick
+	p.reconciled = true
+}
+
+// corrected records a misprediction and returns true, if magnitude is over
+// the tolerance.
+func (p *Predictor) corrected(magnitude float64) bool {
+	if magnitude <= p.tolerance {
+		return false
+	}
+	p.corrections++
+	p.lastError = magnitude
+	return true
+}
@@ -0,0 +1,108 @@
+package udpnet
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPredictor(t *testing.T) {
+	// the state is a position, inputs are velocities
+	simulate := func(state interface{}, input Input) interface{} {
+		return state.(float64) + float64(int8(input.Data[0]))
+	}
+	distance := func(a, b interface{}) float64 {
+		return math.Abs(a.(float64) - b.(float64))
+	}
+	move := func(tick uint64, v int8) Input {
+		return Input{Tick: tick, Data: []byte{byte(v)}}
+	}
+
+	_, err := NewPredictor(0.0, 0, simulate, distance)
+	assert.Error(t, err)
+	_, err = NewPredictor(0.0, 8, nil, distance)
+	assert.Error(t, err)
+
+	p, err := NewPredictor(0.0, 8, simulate, distance)
+	require.NoError(t, err)
+	for tick := uint64(0); tick < 10; tick++ {
+		state, err := p.Predict(move(tick, 1))
+		require.NoError(t, err)
+		assert.Equal(t, float64(tick+1), state)
+	}
+	_, err = p.Predict(move(5, 1))
+	assert.Error(t, err, "ticks must increase")
+	assert.Equal(t, 8, p.Pending(), "oldest predictions should be forgotten")
+
+	t.Logf("check right predictions are confirmed\n")
+	magnitude, corrected := p.Reconcile(3, 4.0)
+	assert.False(t, corrected)
+	assert.Equal(t, float64(0), magnitude)
+	assert.Equal(t, 6, p.Pending())
+	assert.Equal(t, 10.0, p.State())
+
+	t.Logf("check mispredictions are corrected and inputs replayed\n")
+	// the server blocked the move of tick 5
+	magnitude, corrected = p.Reconcile(5, 5.0)
+	assert.True(t, corrected)
+	assert.Equal(t, 1.0, magnitude)
+	assert.Equal(t, 4, p.Pending())
+	assert.Equal(t, 9.0, p.State())
+	corrections, lastError := p.Stats()
+	assert.EqualValues(t, 1, corrections)
+	assert.Equal(t, 1.0, lastError)
+
+	// replayed predictions are confirmed by the server
+	magnitude, corrected = p.Reconcile(7, 7.0)
+	assert.False(t, corrected)
+	assert.Equal(t, float64(0), magnitude)
+
+	t.Logf("check small mispredictions are tolerated\n")
+	p.SetTolerance(0.5)
+	magnitude, corrected = p.Reconcile(8, 8.25)
+	assert.False(t, corrected)
+	assert.Equal(t, 0.25, magnitude)
+	assert.Equal(t, 9.0, p.State())
+
+	t.Logf("check old states are ignored\n")
+	magnitude, corrected = p.Reconcile(2, 100.0)
+	assert.False(t, corrected)
+	assert.Equal(t, float64(0), magnitude)
+	assert.Equal(t, 9.0, p.State())
+
+	t.Logf("check states newer than the predictions replace them\n")
+	magnitude, corrected = p.Reconcile(20, 15.0)
+	assert.True(t, corrected)
+	assert.Equal(t, 6.0, magnitude)
+	assert.Equal(t, 15.0, p.State())
+	assert.Equal(t, 0, p.Pending())
+	state, err := p.Predict(move(21, -2))
+	require.NoError(t, err)
+	assert.Equal(t, 13.0, state)
+
+	t.Logf("check stale states are ignored once the predictions are confirmed\n")
+	magnitude, corrected = p.Reconcile(21, 13.0)
+	assert.False(t, corrected)
+	assert.Equal(t, float64(0), magnitude)
+	assert.Equal(t, 0, p.Pending())
+	for _, tick := range []uint64{21, 20, 8} {
+		magnitude, corrected = p.Reconcile(tick, 100.0)
+		assert.False(t, corrected, "stale state should be ignored")
+		assert.Equal(t, float64(0), magnitude)
+		assert.Equal(t, 13.0, p.State())
+	}
+	corrections, _ = p.Stats()
+	assert.EqualValues(t, 2, corrections)
+
+	t.Logf("check inputs of reconciled ticks are rejected\n")
+	_, err = p.Predict(move(21, 1))
+	assert.Error(t, err, "input of a reconciled tick should be rejected")
+	_, err = p.Predict(move(15, 1))
+	assert.Error(t, err, "input older than the last reconciled tick should be rejected")
+	assert.Equal(t, 13.0, p.State())
+	state, err = p.Predict(move(22, 1))
+	require.NoError(t, err)
+	assert.Equal(t, 14.0, state)
+}
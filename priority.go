@@ -0,0 +1,123 @@
+package udpnet
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// prioritizedObject is an object scheduled by a PriorityScheduler.
+type prioritizedObject struct {
+	id          uint32
+	priority    float64 // accumulated per second
+	accumulator float64
+	size        int // bytes the object takes in a packet
+}
+
+// PriorityScheduler chooses, for a connection, the objects to send in each
+// packet. Every object has a priority accumulator, increased every update by
+// the object priority. Packets are filled with the objects of highest
+// accumulators, whose accumulators are then reset, so that objects of lower
+// priority are sent less often but still sent.
+//
+// The byte budget of the packets follows the send rate of the connection
+// flow control: it is replenished by one packet size per packet the
+// connection may send, up to a packet size.
+type PriorityScheduler struct {
+	flow       *FlowControl
+	packetSize int
+	budget     float64 // bytes available for the next packet
+	objects    map[uint32]*prioritizedObject
+}
+
+// NewPriorityScheduler returns a scheduler filling packets of up to
+// packetSize bytes at the send rate of flow.
+func NewPriorityScheduler(flow *FlowControl, packetSize int) (*PriorityScheduler, error) {
+	if flow == nil {
+		return nil, errors.New("missing flow control")
+	}
+	if packetSize <= 0 {
+		return nil, errors.New("packet size must be positive")
+	}
+	return &PriorityScheduler{
+		flow:       flow,
+		packetSize: packetSize,
+		objects:    make(map[uint32]*prioritizedObject),
+	}, nil
+}
+
+// Set adds an object, or updates its priority and size. The priority is the
+// amount its accumulator increases by per second.
+func (ps *PriorityScheduler) Set(id uint32, priority float64, size int) {
+	o, ok := ps.objects[id]
+	if !ok {
+		o = &prioritizedObject{id: id}
+		ps.objects[id] = o
+	}
+	o.priority = priority
+	o.size = size
+}
+
+// Remove removes an object.
+func (ps *PriorityScheduler) Remove(id uint32) {
+	delete(ps.objects, id)
+}
+
+// Len returns the number of objects.
+func (ps *PriorityScheduler) Len() int {
+	return len(ps.objects)
+}
+
+// Accumulator returns the priority accumulated by an object since it was
+// last sent.
+func (ps *PriorityScheduler) Accumulator(id uint32) float64 {
+	if o, ok := ps.objects[id]; ok {
+		return o.accumulator
+	}
+	return 0
+}
+
+// Budget returns the bytes available for the next packet.
+func (ps *PriorityScheduler) Budget() int {
+	return int(ps.budget)
+}
+
+// Update increases the accumulators of the objects and the packet budget.
+func (ps *PriorityScheduler) Update(dt time.Duration) {
+	for _, o := range ps.objects {
+		o.accumulator += o.priority * dt.Seconds()
+	}
+	ps.budget += float64(ps.flow.SendRate()*ps.packetSize) * dt.Seconds()
+	if ps.budget > float64(ps.packetSize) {
+		ps.budget = float64(ps.packetSize)
+	}
+}
+
+// Fill returns the objects to send in the next packet, by decreasing
+// accumulator, within the budget. Objects not fitting in what is left of the
+// budget are skipped for smaller ones. The accumulators of the returned
+// objects are reset and their sizes consumed from the budget.
+func (ps *PriorityScheduler) Fill() []uint32 {
+	candidates := make([]*prioritizedObject, 0, len(ps.objects))
+	for _, o := range ps.objects {
+		if o.accumulator > 0 && float64(o.size) <= ps.budget {
+			candidates = append(candidates, o)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].accumulator != candidates[j].accumulator {
+			return candidates[i].accumulator > candidates[j].accumulator
+		}
+		return candidates[i].id < candidates[j].id
+	})
+	var ids []uint32
+	for _, o := range candidates {
+		if float64(o.size) > ps.budget {
+			continue
+		}
+		ps.budget -= float64(o.size)
+		o.accumulator = 0
+		ids = append(ids, o.id)
+	}
+	return ids
+}
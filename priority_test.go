@@ -0,0 +1,102 @@
+package udpnet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPriorityScheduler(t *testing.T) {
+	const PacketSize = 100
+
+	_, err := NewPriorityScheduler(nil, PacketSize)
+	assert.Error(t, err)
+	_, err = NewPriorityScheduler(NewFlowControl(), 0)
+	assert.Error(t, err)
+
+	// flow control starts in bad mode, 10 packets per second
+	ps, err := NewPriorityScheduler(NewFlowControl(), PacketSize)
+	require.NoError(t, err)
+	ps.Set(1, 10, 40)
+	ps.Set(2, 5, 40)
+	ps.Set(3, 1, 40)
+	ps.Set(4, 0.5, 10)
+	ps.Set(5, 0, 10)
+	assert.Equal(t, 5, ps.Len())
+	assert.Empty(t, ps.Fill(), "nothing should be sent without budget")
+
+	ps.Update(100 * time.Millisecond)
+	assert.Equal(t, PacketSize, ps.Budget())
+	assert.InDelta(t, 1, ps.Accumulator(1), 1e-9)
+	assert.Equal(t, []uint32{1, 2, 4}, ps.Fill(), "object 3 doesn't fit, object 5 has no priority")
+	assert.Equal(t, 10, ps.Budget())
+	assert.Equal(t, float64(0), ps.Accumulator(1), "accumulators of sent objects should be reset")
+	assert.InDelta(t, 0.1, ps.Accumulator(3), 1e-9)
+
+	ps.Update(50 * time.Millisecond)
+	assert.Equal(t, []uint32{1, 4}, ps.Fill())
+
+	ps.Remove(3)
+	assert.Equal(t, 4, ps.Len())
+	assert.Equal(t, float64(0), ps.Accumulator(3))
+
+	ps.Update(time.Hour)
+	assert.Equal(t, PacketSize, ps.Budget(), "budget should not exceed a packet")
+}
+
+func TestPrioritySchedulerSendRate(t *testing.T) {
+	const (
+		DeltaTime  = time.Duration(10) * time.Millisecond
+		PacketSize = 1200
+		Objects    = 1000
+		ObjectSize = 30
+	)
+
+	// sendFor updates the scheduler for d, returning the bytes sent and the
+	// number of times each object was sent
+	sendFor := func(ps *PriorityScheduler, d time.Duration) (int, []int) {
+		var bytes int
+		sent := make([]int, Objects)
+		for elapsed := time.Duration(0); elapsed < d; elapsed += DeltaTime {
+			ps.Update(DeltaTime)
+			for _, id := range ps.Fill() {
+				bytes += ObjectSize
+				sent[id]++
+			}
+		}
+		return bytes, sent
+	}
+
+	fc := NewFlowControl()
+	ps, err := NewPriorityScheduler(fc, PacketSize)
+	require.NoError(t, err)
+	// the first tenth of the objects have 10 times the priority
+	for id := uint32(0); id < Objects; id++ {
+		priority := 1.0
+		if id < Objects/10 {
+			priority = 10
+		}
+		ps.Set(id, priority, ObjectSize)
+	}
+
+	bytes, sent := sendFor(ps, 10*time.Second)
+	assert.InDelta(t, 10*fc.SendRate()*PacketSize, bytes, PacketSize, "bytes sent should follow the send rate")
+	var high, low int
+	for id, n := range sent {
+		assert.True(t, n > 0, "every object should be sent")
+		if id < Objects/10 {
+			high += n
+		} else {
+			low += n
+		}
+	}
+	assert.True(t, high/(Objects/10) > 5*low/(Objects-Objects/10), "high priority objects should be sent more often")
+
+	t.Logf("check the budget grows with the send rate\n")
+	fc.Update(5*time.Second, 0)
+	require.Equal(t, 30, fc.SendRate())
+	goodBytes, _ := sendFor(ps, 10*time.Second)
+	assert.InDelta(t, 3*bytes, goodBytes, 2*PacketSize)
+}
@@ -0,0 +1,463 @@
+package udpnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// MaxRelayPayloadSize is the maximum size of the payloads relayed between the
+// members of a relay session.
+const MaxRelayPayloadSize = 1024
+
+// BroadcastID is the member id that sends relayed payloads to every other
+// member of the session. Member ids are client ids, connect tokens used to
+// join a relay shouldn't be issued for client id 0.
+const BroadcastID = 0
+
+// relay messages, first byte of the payloads exchanged with the relay
+const (
+	relayJoinMessage    byte = iota // client -> relay: session id
+	relayMembersMessage             // relay -> client: session id, own id and member ids
+	relayDataMessage                // client -> relay: destination id and payload, relay -> client: source id and payload
+)
+
+const (
+	// relayKeepAliveInterval is the interval between two members lists sent
+	// by the relay, and between two join messages sent by its clients. They
+	// keep the connections alive when no payload is relayed.
+	relayKeepAliveInterval = 250 * time.Millisecond
+
+	// maxRelayMembers is the maximum number of members listed in a members
+	// message.
+	maxRelayMembers = (MaxRelayPayloadSize - 19) / 8
+)
+
+// RelayStats holds the relay counters.
+type RelayStats struct {
+	Forwarded uint64 // payloads forwarded to a member
+	Throttled uint64 // payloads dropped because the sender exceeded its bandwidth cap
+	Unrouted  uint64 // payloads dropped because the sender or its destination isn't in a session
+	Expired   uint64 // members kicked after staying idle
+}
+
+// relayMember is a client of the relay that joined a session.
+type relayMember struct {
+	session   uint64
+	id        uint64        // client id of the member
+	idle      time.Duration // time since the member sent its last payload
+	allowance float64       // bytes the member can still send
+}
+
+// Relay forwards payloads between the clients of a server connection that
+// joined the same session. Clients are relayed only to the members of their
+// session, each member sends at most its bandwidth cap, and members not
+// sending payloads for longer than the idle timeout are kicked.
+//
+// Clients join and exchange payloads through a RelayClient.
+type Relay struct {
+	conn        *Conn
+	members     []*relayMember // by slot
+	bandwidth   int            // bytes per second each member can send, 0 for no cap
+	idleTimeout time.Duration
+	keepAlive   time.Duration // time left before sending the members lists
+	stats       RelayStats
+}
+
+// NewRelay returns a relay hosting up to maxClients clients. Clients join
+// through the connection handshake.
+func NewRelay(protocolID uint, timeout time.Duration, maxClients int) (*Relay, error) {
+	r := &Relay{idleTimeout: timeout}
+	r.conn = NewConn(r, protocolID, timeout)
+	r.conn.SetHandshake(true)
+	if err := r.conn.SetMaxClients(maxClients); err != nil {
+		return nil, err
+	}
+	r.members = make([]*relayMember, maxClients)
+	return r, nil
+}
+
+// Conn returns the server connection of the relay, to configure it before
+// starting the relay.
+func (r *Relay) Conn() *Conn {
+	return r.conn
+}
+
+// SetBandwidth sets the number of payload bytes per second each member can
+// send, 0 by default for no cap. Members can burst up to one second worth of
+// bytes.
+func (r *Relay) SetBandwidth(bytesPerSecond int) error {
+	if bytesPerSecond < 0 {
+		return errors.New("bandwidth can't be negative")
+	}
+	r.bandwidth = bytesPerSecond
+	for _, m := range r.members {
+		if m != nil {
+			m.allowance = float64(bytesPerSecond)
+		}
+	}
+	return nil
+}
+
+// SetIdleTimeout sets the time after which members that don't send payloads
+// are kicked, they are told they are disconnected. It defaults to the
+// connection timeout, 0 never kicks idle members.
+func (r *Relay) SetIdleTimeout(timeout time.Duration) {
+	r.idleTimeout = timeout
+}
+
+// Stats returns the relay counters.
+func (r *Relay) Stats() RelayStats {
+	return r.stats
+}
+
+// Members returns the ids of the members of a session.
+func (r *Relay) Members(session uint64) []uint64 {
+	var ids []uint64
+	for _, m := range r.members {
+		if m != nil && m.session == session {
+			ids = append(ids, m.id)
+		}
+	}
+	return ids
+}
+
+// Start starts the relay on given port, on the loopback address.
+func (r *Relay) Start(port int) bool {
+	if !r.conn.Start(port) {
+		return false
+	}
+	r.conn.Listen()
+	return true
+}
+
+// StartAddr starts the relay on given local address, use the unspecified
+// address to be reachable by remote clients.
+func (r *Relay) StartAddr(addr *net.UDPAddr) bool {
+	if !r.conn.StartAddr(addr) {
+		return false
+	}
+	r.conn.Listen()
+	return true
+}
+
+// Stop stops the relay.
+func (r *Relay) Stop() {
+	r.conn.Stop()
+}
+
+// Update forwards the received payloads, expires idle members and updates the
+// connection.
+func (r *Relay) Update(dt time.Duration) {
+	for {
+		var packet [1 + 8 + MaxRelayPayloadSize]byte
+		n, slot := r.conn.ReceivePacketFrom(packet[:])
+		if n == 0 {
+			break
+		}
+		r.process(slot, packet[:n])
+	}
+
+	r.keepAlive -= dt
+	keepAlive := r.keepAlive <= 0
+	if keepAlive {
+		r.keepAlive = relayKeepAliveInterval
+	}
+	for slot, m := range r.members {
+		if m == nil {
+			continue
+		}
+		m.idle += dt
+		if r.idleTimeout > 0 && m.idle > r.idleTimeout {
+			fmt.Printf("relay: member %d of session %d idle, kicked\n", m.id, m.session)
+			r.stats.Expired++
+			r.conn.Kick(slot)
+			continue
+		}
+		if r.bandwidth > 0 {
+			// fractions of bytes add up at low rates and short frames
+			m.allowance += float64(r.bandwidth) * dt.Seconds()
+			if m.allowance > float64(r.bandwidth) {
+				m.allowance = float64(r.bandwidth)
+			}
+		}
+		if keepAlive {
+			r.sendMembers(slot)
+		}
+	}
+	r.conn.Update(dt)
+}
+
+func (r *Relay) process(slot int, msg []byte) {
+	switch msg[0] {
+	case relayJoinMessage:
+		if len(msg) < 9 {
+			return
+		}
+		r.join(slot, binary.BigEndian.Uint64(msg[1:]))
+	case relayDataMessage:
+		if len(msg) < 9 {
+			return
+		}
+		r.forward(slot, binary.BigEndian.Uint64(msg[1:]), msg[9:])
+	}
+}
+
+// join adds the client in slot to a session, or refreshes its membership.
+// Members switching session leave the previous one.
+func (r *Relay) join(slot int, session uint64) {
+	peer, ok := r.conn.PeerBySlot(slot)
+	if !ok {
+		return
+	}
+	m := r.members[slot]
+	if m != nil && m.session == session {
+		r.sendMembers(slot)
+		return
+	}
+	if m != nil {
+		r.leave(slot)
+	}
+	fmt.Printf("relay: member %d joined session %d\n", peer.ClientID, session)
+	r.members[slot] = &relayMember{session: session, id: peer.ClientID, allowance: float64(r.bandwidth)}
+	r.broadcastMembers(session)
+}
+
+// leave removes the client in slot from its session.
+func (r *Relay) leave(slot int) {
+	m := r.members[slot]
+	if m == nil {
+		return
+	}
+	fmt.Printf("relay: member %d left session %d\n", m.id, m.session)
+	r.members[slot] = nil
+	r.broadcastMembers(m.session)
+}
+
+// forward sends a payload of the client in slot to a member of its session,
+// or to all of them.
+func (r *Relay) forward(slot int, to uint64, payload []byte) {
+	from := r.members[slot]
+	if from == nil {
+		r.stats.Unrouted++
+		return
+	}
+	from.idle = 0
+	if r.bandwidth > 0 {
+		if from.allowance < float64(len(payload)) {
+			r.stats.Throttled++
+			return
+		}
+		from.allowance -= float64(len(payload))
+	}
+	msg := make([]byte, 0, 9+len(payload))
+	msg = append(msg, relayDataMessage)
+	msg = appendUint64(msg, from.id)
+	msg = append(msg, payload...)
+	routed := false
+	for s, m := range r.members {
+		if m == nil || m == from || m.session != from.session || (to != BroadcastID && m.id != to) {
+			continue
+		}
+		routed = true
+		if err := r.conn.SendPacketTo(s, msg); err == nil {
+			r.stats.Forwarded++
+		}
+	}
+	if !routed {
+		r.stats.Unrouted++
+	}
+}
+
+// sendMembers sends the members of its session to the client in slot.
+func (r *Relay) sendMembers(slot int) {
+	m := r.members[slot]
+	if m == nil {
+		return
+	}
+	ids := r.Members(m.session)
+	if len(ids) > maxRelayMembers {
+		ids = ids[:maxRelayMembers]
+	}
+	msg := []byte{relayMembersMessage}
+	msg = appendUint64(msg, m.session)
+	msg = appendUint64(msg, m.id)
+	msg = appendUint16(msg, uint16(len(ids)))
+	for _, id := range ids {
+		msg = appendUint64(msg, id)
+	}
+	r.conn.SendPacketTo(slot, msg)
+}
+
+func (r *Relay) broadcastMembers(session uint64) {
+	for slot, m := range r.members {
+		if m != nil && m.session == session {
+			r.sendMembers(slot)
+		}
+	}
+}
+
+// OnStart is called when the relay connection starts.
+func (r *Relay) OnStart() {}
+
+// OnStop is called when the relay connection stops.
+func (r *Relay) OnStop() {}
+
+// OnConnect is called when a client connects to the relay.
+func (r *Relay) OnConnect() {}
+
+// OnDisconnect is called when a client disconnects from the relay.
+func (r *Relay) OnDisconnect() {}
+
+// OnClientConnect is called when a client connects in slot.
+func (r *Relay) OnClientConnect(slot int) {}
+
+// OnClientDisconnect removes the client in slot from its session.
+func (r *Relay) OnClientDisconnect(slot int) {
+	r.leave(slot)
+}
+
+// RelayClient joins a session on a relay and exchanges payloads with the
+// other members of the session.
+type RelayClient struct {
+	conn      *Conn
+	session   uint64
+	id        uint64   // own member id, 0 until joined
+	members   []uint64 // other members of the session
+	keepAlive time.Duration
+}
+
+// NewRelayClient returns a client joining session on a relay, through the
+// connection handshake.
+func NewRelayClient(protocolID uint, timeout time.Duration, session uint64) *RelayClient {
+	rc := &RelayClient{session: session}
+	rc.conn = NewConn(rc, protocolID, timeout)
+	rc.conn.SetHandshake(true)
+	return rc
+}
+
+// Conn returns the client connection to the relay.
+func (rc *RelayClient) Conn() *Conn {
+	return rc.conn
+}
+
+// Start starts the client on given port.
+func (rc *RelayClient) Start(port int) bool {
+	return rc.conn.Start(port)
+}
+
+// Stop stops the client.
+func (rc *RelayClient) Stop() {
+	rc.conn.Stop()
+	rc.id = 0
+	rc.members = nil
+}
+
+// Connect connects to the relay at addr and joins the session.
+func (rc *RelayClient) Connect(addr *net.UDPAddr) {
+	rc.conn.Connect(addr)
+}
+
+// IsJoined indicates if the relay acknowledged our membership.
+func (rc *RelayClient) IsJoined() bool {
+	return rc.conn.IsConnected() && rc.id != 0
+}
+
+// ID returns our member id, 0 until joined.
+func (rc *RelayClient) ID() uint64 {
+	return rc.id
+}
+
+// Members returns the ids of the other members of the session.
+func (rc *RelayClient) Members() []uint64 {
+	return rc.members
+}
+
+// SendTo sends data to a member of the session, or to all of them if id is
+// BroadcastID.
+func (rc *RelayClient) SendTo(id uint64, data []byte) error {
+	if len(data) > MaxRelayPayloadSize {
+		return fmt.Errorf("payload too large, %d bytes max", MaxRelayPayloadSize)
+	}
+	if !rc.IsJoined() {
+		return errors.New("not joined")
+	}
+	msg := make([]byte, 0, 9+len(data))
+	msg = append(msg, relayDataMessage)
+	msg = appendUint64(msg, id)
+	return rc.conn.SendPacket(append(msg, data...))
+}
+
+// Receive copies the next payload relayed from a member into data and
+// returns its size and the member id, or 0 if there is none.
+func (rc *RelayClient) Receive(data []byte) (int, uint64) {
+	for {
+		var packet [1 + 8 + MaxRelayPayloadSize]byte
+		n := rc.conn.ReceivePacket(packet[:])
+		if n == 0 {
+			return 0, 0
+		}
+		if n < 9 {
+			continue
+		}
+		switch packet[0] {
+		case relayMembersMessage:
+			rc.processMembers(packet[1:n])
+		case relayDataMessage:
+			return copy(data, packet[9:n]), binary.BigEndian.Uint64(packet[1:])
+		}
+	}
+}
+
+// Update joins the session, keeps the connection alive and updates it.
+func (rc *RelayClient) Update(dt time.Duration) {
+	if rc.conn.IsConnected() {
+		rc.keepAlive -= dt
+		if rc.keepAlive <= 0 {
+			msg := appendUint64([]byte{relayJoinMessage}, rc.session)
+			rc.conn.SendPacket(msg)
+			rc.keepAlive = relayKeepAliveInterval
+		}
+	} else {
+		rc.id = 0
+		rc.members = nil
+		rc.keepAlive = 0
+	}
+	rc.conn.Update(dt)
+}
+
+func (rc *RelayClient) processMembers(body []byte) {
+	if len(body) < 18 || binary.BigEndian.Uint64(body) != rc.session {
+		return
+	}
+	rc.id = binary.BigEndian.Uint64(body[8:])
+	count := int(binary.BigEndian.Uint16(body[16:]))
+	if len(body) < 18+count*8 {
+		return
+	}
+	members := make([]uint64, 0, count)
+	for i := 0; i < count; i++ {
+		if id := binary.BigEndian.Uint64(body[18+i*8:]); id != rc.id {
+			members = append(members, id)
+		}
+	}
+	rc.members = members
+}
+
+// OnStart is called when the client connection starts.
+func (rc *RelayClient) OnStart() {}
+
+// OnStop is called when the client connection stops.
+func (rc *RelayClient) OnStop() {}
+
+// OnConnect is called when the client connects to the relay.
+func (rc *RelayClient) OnConnect() {}
+
+// OnDisconnect is called when the client disconnects from the relay, or is
+// kicked by it. The client leaves the session.
+func (rc *RelayClient) OnDisconnect() {
+	rc.id = 0
+	rc.members = nil
+}
@@ -0,0 +1,147 @@
+package udpnet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// updateRelay updates a relay and its clients until done returns true. It
+// returns the payloads each client received, formatted as "from:payload".
+func updateRelay(dt time.Duration, maxIterations int, done func() bool, r *Relay, clients ...*RelayClient) [][]string {
+	received := make([][]string, len(clients))
+	for i := 0; i < maxIterations && !done(); i++ {
+		r.Update(dt)
+		for j, c := range clients {
+			for {
+				var data [256]byte
+				n, from := c.Receive(data[:])
+				if n == 0 {
+					break
+				}
+				received[j] = append(received[j], fmt.Sprintf("%d:%s", from, data[:n]))
+			}
+			c.Update(dt)
+		}
+	}
+	return received
+}
+
+func TestRelay(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Second
+	)
+
+	r, err := NewRelay(protocolID, TimeOut, 4)
+	require.NoError(t, err)
+	r.SetIdleTimeout(0)
+	require.True(t, r.StartAddr(&net.UDPAddr{IP: net.IPv4zero, Port: serverPort}), "couldn't start relay")
+	defer r.Stop()
+	rAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+
+	// a and b join session 1, c joins session 2
+	sessions := []uint64{1, 1, 2}
+	var clients []*RelayClient
+	for i, session := range sessions {
+		c := NewRelayClient(protocolID, TimeOut, session)
+		require.True(t, c.Start(clientPort+i), "couldn't start relay client")
+		defer c.Stop()
+		clients = append(clients, c)
+	}
+	a, b, c := clients[0], clients[1], clients[2]
+	for _, c := range clients {
+		c.Connect(rAddr)
+		updateRelay(DeltaTime, 1000, c.IsJoined, r, clients...)
+		require.True(t, c.IsJoined(), "client should join")
+	}
+	updateRelay(DeltaTime, 1000, func() bool {
+		return len(a.Members()) == 1 && len(b.Members()) == 1
+	}, r, clients...)
+	assert.Equal(t, []uint64{b.ID()}, a.Members())
+	assert.Equal(t, []uint64{a.ID()}, b.Members())
+	assert.Empty(t, c.Members())
+	assert.Equal(t, []uint64{a.ID(), b.ID()}, r.Members(1))
+
+	t.Logf("check payloads are routed within sessions\n")
+	require.NoError(t, a.SendTo(BroadcastID, []byte("broadcast")))
+	require.NoError(t, b.SendTo(a.ID(), []byte("to a")))
+	require.NoError(t, c.SendTo(a.ID(), []byte("from other session")))
+	received := updateRelay(DeltaTime, 20, func() bool { return false }, r, clients...)
+	assert.Equal(t, []string{fmt.Sprintf("%d:to a", b.ID())}, received[0])
+	assert.Equal(t, []string{fmt.Sprintf("%d:broadcast", a.ID())}, received[1])
+	assert.Empty(t, received[2])
+	stats := r.Stats()
+	assert.EqualValues(t, 2, stats.Forwarded)
+	assert.EqualValues(t, 1, stats.Unrouted)
+
+	t.Logf("check members leaving are removed from their session\n")
+	b.Stop()
+	updateRelay(DeltaTime, 2000, func() bool { return len(a.Members()) == 0 }, r, a, c)
+	assert.Empty(t, a.Members())
+	assert.Equal(t, []uint64{a.ID()}, r.Members(1))
+}
+
+func TestRelayLimits(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Second
+		Bandwidth = 500
+	)
+
+	r, err := NewRelay(protocolID, TimeOut, 2)
+	require.NoError(t, err)
+	require.NoError(t, r.SetBandwidth(Bandwidth))
+	assert.Error(t, r.SetBandwidth(-1))
+	r.SetIdleTimeout(time.Duration(300) * time.Millisecond)
+	require.True(t, r.Start(serverPort), "couldn't start relay")
+	defer r.Stop()
+	rAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+
+	var clients []*RelayClient
+	for i := 0; i < 2; i++ {
+		c := NewRelayClient(protocolID, TimeOut, 1)
+		require.True(t, c.Start(clientPort+i), "couldn't start relay client")
+		defer c.Stop()
+		c.Connect(rAddr)
+		clients = append(clients, c)
+	}
+	a, b := clients[0], clients[1]
+	updateRelay(DeltaTime, 1000, func() bool {
+		return len(a.Members()) == 1 && len(b.Members()) == 1
+	}, r, clients...)
+	require.Len(t, a.Members(), 1)
+
+	t.Logf("check bandwidth cap\n")
+	payload := make([]byte, 100)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, a.SendTo(b.ID(), payload))
+	}
+	received := updateRelay(DeltaTime, 5, func() bool { return false }, r, clients...)
+	assert.Len(t, received[1], Bandwidth/len(payload), "one second worth of bytes should be relayed")
+	assert.EqualValues(t, 20-Bandwidth/len(payload), r.Stats().Throttled)
+
+	t.Logf("check bandwidth allowance refills below one byte per update\n")
+	updateRelay(DeltaTime, 210, func() bool { return false }, r, clients...)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, a.SendTo(b.ID(), payload))
+	}
+	received = updateRelay(DeltaTime, 5, func() bool { return false }, r, clients...)
+	assert.Len(t, received[1], 1, "the allowance should refill at half a byte per update")
+
+	t.Logf("check idle members are kicked\n")
+	updateRelay(DeltaTime, 1000, func() bool { return r.Stats().Expired == 2 }, r, clients...)
+	assert.EqualValues(t, 2, r.Stats().Expired)
+	assert.Empty(t, r.Members(1))
+	assert.Empty(t, r.Conn().ConnectedSlots())
+	updateRelay(DeltaTime, 10, func() bool {
+		return !a.Conn().IsConnected() && !b.Conn().IsConnected()
+	}, r, clients...)
+	assert.False(t, a.Conn().IsConnected(), "kicked members should be told they are disconnected")
+	assert.False(t, b.Conn().IsConnected(), "kicked members should be told they are disconnected")
+	assert.False(t, a.IsJoined())
+}
@@ -1,10 +1,24 @@
 package udpnet
 
 import (
+	"errors"
 	"fmt"
 	"time"
 )
 
+const (
+	// maxAckWindow is the maximum number of sequences covered by ack bits.
+	maxAckWindow = 512
+
+	// maxAckRangeHistory is the number of sequences older than the ack window
+	// for which received packets are remembered when ack ranges are enabled.
+	maxAckRangeHistory = 1024
+
+	// maxAckHistory is the maximum number of sequences before the most recent
+	// received sequence for which received packets are remembered.
+	maxAckHistory = maxAckWindow + 2 + maxAckRangeHistory
+)
+
 // reliability system to support reliable connection
 //  + manages sent, received, pending ack and acked packet queues
 //  + separated out from reliable connection so they can be unit-tested
@@ -23,11 +37,14 @@ type ReliabilitySystem struct {
 	rtt            time.Duration // estimated round trip time
 	rttMax         time.Duration // maximum expected round trip time (hard coded to one second for the moment)
 
+	ackWindow    uint // number of sequences before remote sequence covered by ack bits
+	maxAckRanges int  // maximum number of ranges of older received sequences sent with acks
+
 	acks []uint // acked packets from last set of packet receives. cleared each update!
 
 	sentQueue       PacketQueue // sent packets used to calculate sent bandwidth (kept until rttMax)
 	pendingAckQueue PacketQueue // sent packets which have not been acked yet (kept until rttMax * 2 )
-	receivedQueue   PacketQueue // received packets for determining acks to send (kept up to most recent recv sequence - 32)
+	receivedQueue   PacketQueue // received packets for determining acks to send (kept up to most recent recv sequence - ack history)
 	ackedQueue      PacketQueue // acked packets (kept until rttMax * 2)
 }
 
@@ -36,6 +53,7 @@ func NewReliabilitySystem(maxSequence uint) *ReliabilitySystem {
 	rs := &ReliabilitySystem{
 		rttMax:      1 * time.Second,
 		maxSequence: maxSequence,
+		ackWindow:   32,
 	}
 	rs.Reset()
 	return rs
@@ -109,6 +127,83 @@ func (rs *ReliabilitySystem) ProcessAck(ack, ackBits uint) {
 	processAck(ack, ackBits, &rs.pendingAckQueue, &rs.ackedQueue, &rs.acks, &rs.ackedPackets, &rs.rtt, rs.maxSequence)
 }
 
+// SetAckWindow sets the number of sequences before the remote sequence that
+// are acked by the ack bits of each packet. window must be a multiple of 32,
+// from 32 (the default) to 512, and window+2 must not exceed half the maximum
+// sequence. Ack bits beyond the 32 first ones are sent in an ack extension,
+// both ends must use the same window.
+func (rs *ReliabilitySystem) SetAckWindow(window uint) error {
+	if window < 32 || window > maxAckWindow || window%32 != 0 {
+		return errors.New("ack window must be a multiple of 32 in [32, 512]")
+	}
+	if window+2 > rs.maxSequence/2 {
+		return fmt.Errorf("ack window too large for max sequence %d", rs.maxSequence)
+	}
+	rs.ackWindow = window
+	return nil
+}
+
+// AckWindow returns the number of sequences covered by the ack bits.
+func (rs *ReliabilitySystem) AckWindow() uint {
+	return rs.ackWindow
+}
+
+// SetMaxAckRanges sets the maximum number of ranges of received sequences,
+// older than the ack window, sent in the ack extension of each packet. That
+// redundancy allows acks to survive long bursts of packet loss. 0, the
+// default, disables ack ranges. Both ends must use the same value.
+func (rs *ReliabilitySystem) SetMaxAckRanges(n int) error {
+	if n < 0 || n > 255 {
+		return errors.New("max ack ranges must be in [0, 255]")
+	}
+	rs.maxAckRanges = n
+	return nil
+}
+
+// MaxAckRanges returns the maximum number of ack ranges sent in each packet.
+func (rs *ReliabilitySystem) MaxAckRanges() int {
+	return rs.maxAckRanges
+}
+
+// hasAckExtension indicates if acks don't fit in the 32 ack bits.
+func (rs *ReliabilitySystem) hasAckExtension() bool {
+	return rs.ackWindow > 32 || rs.maxAckRanges > 0
+}
+
+func (rs *ReliabilitySystem) generateAckExtension() ackExtension {
+	return generateAckExtension(rs.remoteSequence, rs.ackWindow, rs.maxAckRanges, &rs.receivedQueue, rs.maxSequence)
+}
+
+// ackExtensionSize returns the size of the ack extension of the next packet.
+func (rs *ReliabilitySystem) ackExtensionSize() int {
+	size := int(rs.ackWindow-32) / 8
+	if rs.maxAckRanges > 0 {
+		size += 1 + 4*countAckRanges(rs.remoteSequence, rs.ackWindow, rs.maxAckRanges, &rs.receivedQueue, rs.maxSequence)
+	}
+	return size
+}
+
+func (rs *ReliabilitySystem) processAckExtension(ack uint, ext ackExtension) {
+	processAckExtension(ack, ext, &rs.pendingAckQueue, &rs.ackedQueue, &rs.acks, &rs.ackedPackets, &rs.rtt, rs.maxSequence)
+}
+
+// ackHistory returns the number of sequences before the most recent received
+// sequence that are kept to generate acks.
+func (rs *ReliabilitySystem) ackHistory() uint {
+	history := rs.ackWindow + 2
+	if rs.maxAckRanges > 0 {
+		history += maxAckRangeHistory
+		// keep received sequences ordered by sequenceMoreRecent
+		if history > rs.maxSequence/2 {
+			history = rs.maxSequence / 2
+		}
+		if history < rs.ackWindow+2 {
+			history = rs.ackWindow + 2
+		}
+	}
+	return history
+}
+
 func (rs *ReliabilitySystem) Update(deltaTime time.Duration) {
 	rs.acks = []uint{}
 	rs.advanceQueueTime(deltaTime)
@@ -191,12 +286,13 @@ func (rs *ReliabilitySystem) updateQueues() {
 
 	if len(rs.receivedQueue) > 0 {
 		latestSequence := rs.receivedQueue[len(rs.receivedQueue)-1].sequence
+		history := rs.ackHistory()
 
 		var minSequence uint
-		if latestSequence >= 34 {
-			minSequence = (latestSequence - 34)
+		if latestSequence >= history {
+			minSequence = (latestSequence - history)
 		} else {
-			minSequence = rs.maxSequence - (34 - latestSequence)
+			minSequence = rs.maxSequence - (history - latestSequence)
 		}
 
 		for len(rs.receivedQueue) > 0 && !sequenceMoreRecent(rs.receivedQueue[0].sequence, minSequence, rs.maxSequence) {
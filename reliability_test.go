@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func validateReliabilitySystem(t *testing.T, rs *ReliabilitySystem) {
@@ -255,3 +256,90 @@ func TestReliabilitySystem(t *testing.T) {
 		}
 	}
 }
+
+func TestAckExtension(t *testing.T) {
+	const MaximumSequence = 0xFFFF
+
+	t.Logf("check ack window of 64\n")
+	var receivedQueue PacketQueue
+	for i := 0; i < 64; i++ {
+		var data PacketData
+		data.sequence = uint(i)
+		receivedQueue.InsertSorted(data, MaximumSequence)
+	}
+	ext := generateAckExtension(64, 64, 0, &receivedQueue, MaximumSequence)
+	assert.Equal(t, []byte{0xFF, 0xFF, 0xFF, 0xFF}, ext.bits)
+	assert.Len(t, ext.ranges, 0)
+	ext = generateAckExtension(48, 64, 0, &receivedQueue, MaximumSequence)
+	assert.Equal(t, []byte{0xFF, 0xFF, 0, 0}, ext.bits)
+
+	t.Logf("check ack ranges\n")
+	receivedQueue = PacketQueue{}
+	for _, seq := range []uint{10, 11, 12, 20, 30, 31, 100} {
+		var data PacketData
+		data.sequence = seq
+		receivedQueue.InsertSorted(data, MaximumSequence)
+	}
+	ext = generateAckExtension(100, 32, 2, &receivedQueue, MaximumSequence)
+	assert.Len(t, ext.bits, 0)
+	// most recent ranges first, offset measured from ack
+	assert.Equal(t, []ackRange{{offset: 69, count: 2}, {offset: 80, count: 1}}, ext.ranges)
+	ext = generateAckExtension(100, 32, 8, &receivedQueue, MaximumSequence)
+	assert.Equal(t, []ackRange{{offset: 69, count: 2}, {offset: 80, count: 1}, {offset: 88, count: 3}}, ext.ranges)
+	assert.Equal(t, 2, countAckRanges(100, 32, 2, &receivedQueue, MaximumSequence))
+	assert.Equal(t, 3, countAckRanges(100, 32, 8, &receivedQueue, MaximumSequence))
+
+	t.Logf("check the ack extension size is computed without generating it\n")
+	rs := NewReliabilitySystem(MaximumSequence)
+	require.NoError(t, rs.SetAckWindow(64))
+	require.NoError(t, rs.SetMaxAckRanges(2))
+	for _, seq := range []uint{10, 11, 12, 20, 30, 31, 200} {
+		rs.PacketReceived(seq, 0)
+	}
+	assert.Equal(t, ackExtensionSize(rs.generateAckExtension(), 2), rs.ackExtensionSize())
+	assert.Equal(t, 4+1+4*2, rs.ackExtensionSize())
+
+	t.Logf("check bit indexes past the ack history are refused\n")
+	assert.Panics(t, func() { bitIndexForSequence(MaximumSequence, maxAckHistory, MaximumSequence) })
+	assert.Equal(t, uint(maxAckHistory-1), bitIndexForSequence(MaximumSequence, maxAckHistory-1, MaximumSequence))
+
+	t.Logf("check process ack extension\n")
+	var pendingAckQueue PacketQueue
+	for i := 0; i < 100; i++ {
+		var data PacketData
+		data.sequence = uint(i)
+		pendingAckQueue.InsertSorted(data, MaximumSequence)
+	}
+	var (
+		ackedQueue   PacketQueue
+		acks         []uint
+		rtt          time.Duration
+		ackedPackets uint
+	)
+	ext = ackExtension{
+		bits:   []byte{0x01, 0, 0, 0x80},
+		ranges: []ackRange{{offset: 69, count: 2}, {offset: 88, count: 3}},
+	}
+	processAckExtension(100, ext, &pendingAckQueue, &ackedQueue, &acks, &ackedPackets, &rtt, MaximumSequence)
+	assert.Equal(t, []uint{10, 11, 12, 30, 31, 36, 67}, acks)
+	assert.EqualValues(t, 7, ackedPackets)
+	assert.Len(t, pendingAckQueue, 93)
+}
+
+func TestAckWindowSettings(t *testing.T) {
+	rs := NewReliabilitySystem(0xFFFF)
+	assert.EqualValues(t, 32, rs.AckWindow())
+	assert.False(t, rs.hasAckExtension())
+	assert.Error(t, rs.SetAckWindow(16))
+	assert.Error(t, rs.SetAckWindow(80))
+	assert.NoError(t, rs.SetAckWindow(64))
+	small := NewReliabilitySystem(0xFF)
+	assert.Error(t, small.SetAckWindow(512), "ack window should fit in the sequence space")
+	assert.Error(t, small.SetAckWindow(128))
+	assert.NoError(t, small.SetAckWindow(96))
+	assert.True(t, rs.hasAckExtension())
+	assert.EqualValues(t, 66, rs.ackHistory())
+	assert.Error(t, rs.SetMaxAckRanges(-1))
+	assert.NoError(t, rs.SetMaxAckRanges(4))
+	assert.EqualValues(t, 66+maxAckRangeHistory, rs.ackHistory())
+}
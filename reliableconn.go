@@ -1,6 +1,7 @@
 package udpnet
 
 import (
+	"errors"
 	"fmt"
 	"time"
 )
@@ -14,6 +15,15 @@ type ReliableConn struct {
 	// stats etc.
 	reliabilitySystem *ReliabilitySystem
 
+	// format of the reliability header written at the start of each packet
+	headerFormat HeaderFormat
+
+	ackDelay      time.Duration // send an ack-only packet after that idle time (0 disables)
+	sinceLastSend time.Duration // time elapsed since the last packet was sent
+	ackOnlySent   uint          // number of ack-only packets sent
+	lastSentAck   uint          // remote sequence acked by the last packet sent
+	hasSentAck    bool          // a packet acking a remote sequence was sent
+
 	// TODO: this is for unit test only
 	packetLossMask uint // mask sequence number, if non-zero, drop packet
 }
@@ -37,6 +47,7 @@ func NewReliableConn(protocolID uint, timeout time.Duration, maxSequence uint) *
 		reliabilitySystem: NewReliabilitySystem(maxSequence),
 	}
 
+	c.Conn.init()
 	c.clearData()
 	// provide a callback that calls clearData on stop/disconnect
 	c.Conn.cb = &clearDataCB{c}
@@ -45,6 +56,8 @@ func NewReliableConn(protocolID uint, timeout time.Duration, maxSequence uint) *
 
 func (c *ReliableConn) clearData() {
 	c.reliabilitySystem.Reset()
+	c.sinceLastSend = 0
+	c.hasSentAck = false
 }
 
 func (c *ReliableConn) SendPacket(data []byte) bool {
@@ -52,51 +65,153 @@ func (c *ReliableConn) SendPacket(data []byte) bool {
 	//#ifdef NET_UNIT_TEST
 	if (c.reliabilitySystem.LocalSequence() & c.packetLossMask) != 0 {
 		c.reliabilitySystem.PacketSent(len(data))
+		c.sinceLastSend = 0
 		return true
 	}
 	//#endif
-	const header = 12
-	packet := make([]byte, header+len(data))
-	seq := c.reliabilitySystem.LocalSequence()
-	ack := c.reliabilitySystem.RemoteSequence()
-	ackBits := c.reliabilitySystem.GenerateAckBits()
-	c.WriteHeader(packet, seq, ack, ackBits)
+	if !c.sendPacket(data) {
+		return false
+	}
+	c.reliabilitySystem.PacketSent(len(data))
+	return true
+}
+
+// sendPacket writes the reliability header followed by data and sends the
+// packet, without accounting for it in the reliability system.
+func (c *ReliableConn) sendPacket(data []byte) bool {
+	rs := c.reliabilitySystem
+	packet := make([]byte, maxReliabilityHeaderSize(rs, c.headerFormat)+len(data))
+	seq := rs.LocalSequence()
+	ack := rs.RemoteSequence()
+	header := encodeReliabilityHeader(packet, rs, c.headerFormat, seq, ack, rs.GenerateAckBits())
 	copy(packet[header:], data)
+	packet = packet[:header+len(data)]
 	if err := c.Conn.SendPacket(packet); err != nil {
 		fmt.Printf("couldn't send packet, %v\n", err)
 		return false
 	}
-	c.reliabilitySystem.PacketSent(len(data))
+	c.sinceLastSend = 0
+	if c.reliabilitySystem.ReceivedPackets() > 0 {
+		c.lastSentAck = ack
+		c.hasSentAck = true
+	}
 	return true
 }
 
-func (c *ReliableConn) ReceivePacket(data []byte) int {
-	const header = 12
-	if len(data) <= header {
-		return 0
+// acksPending indicates if the remote sequence advanced since the last
+// packet sent, so that the remote end is missing acks.
+func (c *ReliableConn) acksPending() bool {
+	rs := c.reliabilitySystem
+	if rs.ReceivedPackets() == 0 {
+		return false
 	}
-	packet := make([]byte, header+len(data))
-	receivedBytes := c.Conn.ReceivePacket(packet)
-	if receivedBytes == 0 {
-		return 0
+	return !c.hasSentAck || sequenceMoreRecent(rs.RemoteSequence(), c.lastSentAck, rs.MaxSequence())
+}
+
+// sendAckOnly sends a packet made of the reliability header only. Ack-only
+// packets carry the current acks but do not consume a sequence number, so
+// they are never acked nor counted as lost.
+func (c *ReliableConn) sendAckOnly() bool {
+	if !c.sendPacket(nil) {
+		return false
 	}
-	if receivedBytes <= header {
+	c.ackOnlySent++
+	return true
+}
+
+func (c *ReliableConn) ReceivePacket(data []byte) int {
+	maxHeader := maxReliabilityHeaderSize(c.reliabilitySystem, c.headerFormat)
+	if len(data) <= maxHeader {
 		return 0
 	}
-	var packetSequence, packetAck, packetAckBits uint
-	packetSequence, packetAck, packetAckBits = c.ReadHeader(packet)
-	c.reliabilitySystem.PacketReceived(packetSequence, receivedBytes-header)
-	c.reliabilitySystem.ProcessAck(packetAck, packetAckBits)
-	copy(data, packet[header:receivedBytes])
-	return receivedBytes - header
+	packet := make([]byte, maxHeader+len(data))
+	for {
+		receivedBytes := c.Conn.ReceivePacket(packet)
+		if receivedBytes == 0 {
+			return 0
+		}
+		header := processReliabilityHeader(packet[:receivedBytes], c.reliabilitySystem, c.headerFormat)
+		if header == 0 {
+			return 0
+		}
+		if receivedBytes == header {
+			// ack-only packet, read the next packet
+			continue
+		}
+		copy(data, packet[header:receivedBytes])
+		return receivedBytes - header
+	}
 }
+
 func (c *ReliableConn) Update(deltaTime time.Duration) {
 	c.Conn.Update(deltaTime)
 	c.reliabilitySystem.Update(deltaTime)
+	if c.ackDelay > 0 && c.IsConnected() {
+		c.sinceLastSend += deltaTime
+		// without new acks, ack-only packets still keep the connection alive
+		if (c.sinceLastSend >= c.ackDelay && c.acksPending()) || c.sinceLastSend >= c.keepAliveInterval() {
+			c.sendAckOnly()
+		}
+	}
+}
+
+// SetAckDelay sets the delay after which an ack-only packet is automatically
+// sent by Update if no packet has been sent in the meantime and packets were
+// received since the last one sent. Ack-only packets deliver the pending acks
+// to the remote end when there is no outgoing data. Without new acks, an
+// ack-only packet is still sent after a quarter of the timeout, as a keep
+// alive. A delay of 0, the default, disables them.
+func (c *ReliableConn) SetAckDelay(delay time.Duration) {
+	c.ackDelay = delay
+}
+
+// keepAliveInterval returns the time without sending after which an ack-only
+// packet is sent even if there are no new acks.
+func (c *ReliableConn) keepAliveInterval() time.Duration {
+	return c.timeout / 4
+}
+
+// AckDelay returns the delay after which an ack-only packet is sent.
+func (c *ReliableConn) AckDelay() time.Duration {
+	return c.ackDelay
 }
 
+// AckOnlyPackets returns the number of ack-only packets sent.
+func (c *ReliableConn) AckOnlyPackets() uint {
+	return c.ackOnlySent
+}
+
+// HeaderSize returns the size of the headers of the next packet sent on the
+// connection. With CompactHeader or an ack extension, the size depends on the
+// current acks.
 func (c *ReliableConn) HeaderSize() int {
-	return c.Conn.HeaderSize() + c.reliabilitySystem.HeaderSize()
+	return c.Conn.HeaderSize() + reliabilityHeaderSize(c.reliabilitySystem, c.headerFormat)
+}
+
+// SetHeaderFormat sets the format of the reliability header, both ends of the
+// connection must use the same format. CompactHeader requires a maximum
+// sequence lower or equal to MaxCompactSequence.
+func (c *ReliableConn) SetHeaderFormat(format HeaderFormat) error {
+	if format == CompactHeader && c.reliabilitySystem.MaxSequence() > MaxCompactSequence {
+		return errors.New("compact header requires maxSequence <= MaxCompactSequence")
+	}
+	c.headerFormat = format
+	return nil
+}
+
+// HeaderFormat returns the format of the reliability header.
+func (c *ReliableConn) HeaderFormat() HeaderFormat {
+	return c.headerFormat
+}
+
+// SetMaxClients sets the number of clients a server connection can host. A
+// ReliableConn has a single reliability system, shared by all its clients, so
+// it can only host one.
+func (c *ReliableConn) SetMaxClients(n int) error {
+	if n > 1 {
+		return errors.New("a reliable connection can't host more than one client")
+	}
+	return c.Conn.SetMaxClients(n)
 }
 
 func (c *ReliableConn) ReliabilitySystem() *ReliabilitySystem {
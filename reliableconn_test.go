@@ -401,3 +401,127 @@ func TestReliableConnectionPayload(t *testing.T) {
 	assert.True(t, client.IsConnected(), "client should be connected")
 	assert.True(t, server.IsConnected(), "server should be connected")
 }
+
+func TestReliableConnectionAckOnly(t *testing.T) {
+	const (
+		DeltaTime   = time.Millisecond
+		TimeOut     = time.Duration(100) * time.Millisecond
+		AckDelay    = 5 * time.Millisecond
+		PacketCount = 100
+	)
+
+	client := NewReliableConn(protocolID, TimeOut, maxSequence)
+	client.SetAckDelay(AckDelay)
+	require.True(t, client.Start(clientPort), "couldn't start client connection")
+	defer client.Stop()
+
+	server := NewReliableConn(protocolID, TimeOut, maxSequence)
+	server.SetAckDelay(AckDelay)
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+
+	cAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	client.Connect(cAddr)
+	server.Listen()
+
+	var (
+		clientAckedPackets [PacketCount]bool
+		allPacketsAcked    bool
+	)
+
+	// only the client sends data, the server acks with ack-only packets
+	for {
+		if !client.IsConnecting() && client.ConnectFailed() {
+			break
+		}
+		if allPacketsAcked {
+			break
+		}
+
+		if client.ReliabilitySystem().SentPackets() < PacketCount {
+			client.SendPacket(clientPacket)
+		}
+
+		for {
+			var packet [256]byte
+			bytesRead := client.ReceivePacket(packet[:])
+			if bytesRead == 0 {
+				break
+			}
+			t.Fatalf("client should only receive ack-only packets")
+		}
+
+		for {
+			var packet [256]byte
+			bytesRead := server.ReceivePacket(packet[:])
+			if bytesRead == 0 {
+				break
+			}
+			assert.Equal(t, "client to server", string(packet[:bytesRead]))
+		}
+
+		for _, ack := range client.ReliabilitySystem().Acks() {
+			if ack < PacketCount {
+				assert.False(t, clientAckedPackets[ack])
+				clientAckedPackets[ack] = true
+			}
+		}
+
+		var clientAckCount uint
+		for i := 0; i < PacketCount; i++ {
+			if clientAckedPackets[i] {
+				clientAckCount++
+			}
+		}
+		allPacketsAcked = clientAckCount == PacketCount
+
+		client.Update(DeltaTime)
+		validateReliabilitySystem(t, client.reliabilitySystem)
+		server.Update(DeltaTime)
+		validateReliabilitySystem(t, server.reliabilitySystem)
+	}
+
+	assert.True(t, allPacketsAcked, "all client packets should be acked")
+	assert.True(t, server.AckOnlyPackets() > 0, "server should have sent ack-only packets")
+	assert.EqualValues(t, 0, server.ReliabilitySystem().SentPackets(), "ack-only packets don't consume sequence numbers")
+	assert.EqualValues(t, 0, client.ReliabilitySystem().LostPackets())
+
+	// once everything is acked, no more ack-only packets are sent until the
+	// keep alive interval
+	for i := 0; i < 2; i++ {
+		for {
+			var packet [256]byte
+			if server.ReceivePacket(packet[:]) == 0 {
+				break
+			}
+		}
+		server.Update(AckDelay)
+	}
+	ackOnly := server.AckOnlyPackets()
+	for server.sinceLastSend+AckDelay < server.keepAliveInterval() {
+		server.Update(AckDelay)
+	}
+	assert.Equal(t, ackOnly, server.AckOnlyPackets(), "ack-only packets should only be sent for new acks")
+
+	// no data at all, ack-only packets keep the connection alive
+	for elapsed := time.Duration(0); elapsed < 3*TimeOut; elapsed += DeltaTime {
+		for {
+			var packet [256]byte
+			if client.ReceivePacket(packet[:]) == 0 {
+				break
+			}
+		}
+		for {
+			var packet [256]byte
+			if server.ReceivePacket(packet[:]) == 0 {
+				break
+			}
+		}
+		client.Update(DeltaTime)
+		server.Update(DeltaTime)
+	}
+	assert.True(t, server.AckOnlyPackets() > ackOnly, "keep alive ack-only packets should be sent")
+
+	assert.True(t, client.IsConnected(), "client should be connected")
+	assert.True(t, server.IsConnected(), "server should be connected")
+}
@@ -0,0 +1,185 @@
+package udpnet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// size of the resume ticket a server gives to its clients
+const resumeTicketSize = 16
+
+// ResumeCallback can be implemented by the ConnCallback of a server
+// connection to be told when a client times out and its session is kept for
+// the resume grace period, and when the client resumes it.
+type ResumeCallback interface {
+	OnClientSuspend(slot int)
+	OnClientResume(slot int)
+}
+
+// SetResumeGracePeriod sets, on a server, how long the session of a client
+// that timed out is kept, 0 by default. The client keeps its slot and can
+// resume its session with the ticket it received when it joined, its
+// sequence numbers and pending acks are preserved. A grace period of 0
+// disconnects clients as soon as they time out.
+func (c *Conn) SetResumeGracePeriod(grace time.Duration) error {
+	if grace < 0 {
+		return errors.New("resume grace period can't be negative")
+	}
+	c.resumeGrace = grace
+	return nil
+}
+
+// ResumeGracePeriod returns how long the session of a client that timed out
+// is kept by a server.
+func (c *Conn) ResumeGracePeriod() time.Duration {
+	return c.resumeGrace
+}
+
+// IsResuming indicates if a client connection timed out and is trying to
+// resume its session with the server.
+func (c *Conn) IsResuming() bool {
+	return c.state == resuming
+}
+
+// newResumeTicket returns a random resume ticket.
+func newResumeTicket() []byte {
+	ticket := make([]byte, resumeTicketSize)
+	if _, err := rand.Read(ticket); err != nil {
+		panic(fmt.Sprintf("couldn't generate resume ticket: %v", err))
+	}
+	return ticket
+}
+
+// suspend starts, on a client that timed out, to resume the session if the
+// server granted a resume ticket. It returns false otherwise.
+func (c *Conn) suspend() bool {
+	if c.resumeTicket == nil || c.ticketGrace <= 0 {
+		return false
+	}
+	fmt.Printf("connection timed out, resuming session\n")
+	c.state = resuming
+	c.resumeLeft = c.ticketGrace
+	c.requestAccumulator = 0
+	return true
+}
+
+// updateResume sends the resume requests of a client resuming its session,
+// and gives up once the grace period is over.
+func (c *Conn) updateResume(dt time.Duration) {
+	if c.requestAccumulator <= 0 {
+		c.sendResumeRequest()
+		c.requestAccumulator = connectRequestInterval
+	}
+	c.requestAccumulator -= dt
+	c.resumeLeft -= dt
+	if c.resumeLeft <= 0 {
+		fmt.Printf("couldn't resume session\n")
+		c.clearData()
+		c.cb.OnDisconnect()
+	}
+}
+
+// sendResumeRequest sends the session id and the resume ticket, sealed if the
+// client joined with a token. Like connection requests, resume requests are
+// padded.
+func (c *Conn) sendResumeRequest() {
+	ticket := c.resumeTicket
+	if c.session != nil {
+		ticket = c.session.seal(nil, c.additionalData(resumeRequestPacket), ticket)
+	}
+	body := appendUint64(nil, c.sessionID)
+	body = appendUint16(body, uint16(len(ticket)))
+	body = append(body, ticket...)
+	if padding := MinConnectionRequestSize - 5 - len(body); padding > 0 {
+		body = append(body, make([]byte, padding)...)
+	}
+	if err := c.sendPacket(c.address, resumeRequestPacket, body, nil); err != nil {
+		fmt.Printf("couldn't send resume request, %v\n", err)
+	}
+}
+
+// processResumeRequest resumes, on a server, the session of a client
+// presenting its resume ticket. A resume request from another address
+// migrates the session first.
+func (c *Conn) processResumeRequest(sender *net.UDPAddr, body []byte) {
+	if c.mode != Server || len(body) < sessionIDSize+2 {
+		return
+	}
+	p := c.peerBySessionID(binary.BigEndian.Uint64(body))
+	if p == nil {
+		c.sendConnectionDenied(sender, DenySessionExpired, nil)
+		return
+	}
+	size := int(binary.BigEndian.Uint16(body[sessionIDSize:]))
+	if len(body) < sessionIDSize+2+size {
+		return
+	}
+	ticket := body[sessionIDSize+2 : sessionIDSize+2+size]
+	fresh := true
+	if p.session != nil {
+		var ok bool
+		if ticket, fresh, ok = p.session.openFresh(c.additionalData(resumeRequestPacket), ticket); !ok {
+			return
+		}
+	}
+	if !bytes.Equal(ticket, p.resumeTicket) {
+		return
+	}
+	if sameAddress(sender, p.address) {
+		c.resumePeer(p)
+		return
+	}
+	// the session resumes once the new address is validated
+	c.migratePeer(p, sender, fresh)
+}
+
+// suspendPeer keeps the slot of a client that timed out for the grace period.
+func (c *Conn) suspendPeer(p *peer) {
+	fmt.Printf("client in slot %d suspended\n", p.slot)
+	p.suspended = true
+	p.graceLeft = c.resumeGrace
+	p.migration = nil
+	c.updateServerState()
+	if rc, ok := c.cb.(ResumeCallback); ok {
+		rc.OnClientSuspend(p.slot)
+	}
+}
+
+// resumePeer resumes the session of a suspended client, and tells the client
+// its session is resumed.
+func (c *Conn) resumePeer(p *peer) {
+	p.timeoutAccumulator = 0
+	if p.suspended {
+		fmt.Printf("client in slot %d resumed\n", p.slot)
+		p.suspended = false
+		c.updateServerState()
+		if rc, ok := c.cb.(ResumeCallback); ok {
+			rc.OnClientResume(p.slot)
+		}
+	}
+	c.sendPacket(p.address, sessionResumedPacket, nil, p.session)
+}
+
+// processSessionResumed completes, on a client, the resumption of its session.
+func (c *Conn) processSessionResumed(sender *net.UDPAddr, body []byte) {
+	if c.mode != Client || c.state != resuming || !sameAddress(sender, c.address) {
+		return
+	}
+	if c.session != nil {
+		if _, ok := c.session.open(c.additionalData(sessionResumedPacket), body); !ok {
+			return
+		}
+	}
+	c.resumeSession()
+}
+
+func (c *Conn) resumeSession() {
+	fmt.Printf("client resumed session with server\n")
+	c.state = connected
+	c.timeoutAccumulator = 0
+}
@@ -0,0 +1,177 @@
+package udpnet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resumeCallback records the slots suspended and resumed.
+type resumeCallback struct {
+	dummyCallback
+	suspended []int
+	resumed   []int
+}
+
+func (rc *resumeCallback) OnClientSuspend(slot int) { rc.suspended = append(rc.suspended, slot) }
+func (rc *resumeCallback) OnClientResume(slot int)  { rc.resumed = append(rc.resumed, slot) }
+
+// updateReliableConns is updateConns for reliable connections.
+func updateReliableConns(dt time.Duration, maxIterations int, done func() bool, payload []byte, conns ...*ReliableConn) {
+	for i := 0; i < maxIterations && !done(); i++ {
+		for _, c := range conns {
+			if c.IsConnected() && payload != nil {
+				c.SendPacket(payload)
+			}
+		}
+		for _, c := range conns {
+			for {
+				var packet [256]byte
+				if c.ReceivePacket(packet[:]) == 0 {
+					break
+				}
+			}
+		}
+		for _, c := range conns {
+			c.Update(dt)
+		}
+	}
+}
+
+func TestReliableConnectionResume(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(100) * time.Millisecond
+		Grace     = time.Second
+	)
+
+	key, err := GenerateKey()
+	require.NoError(t, err)
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	token, err := NewTokenIssuer(protocolID, key).Issue(42, []*net.UDPAddr{sAddr}, time.Minute, nil)
+	require.NoError(t, err)
+
+	for _, secure := range []bool{false, true} {
+		t.Logf("check session resume, secure: %v\n", secure)
+		server := NewReliableConn(protocolID, TimeOut, maxSequence)
+		server.SetHandshake(true)
+		require.NoError(t, server.SetResumeGracePeriod(Grace))
+		if secure {
+			server.SetPrivateKey(key)
+		}
+		require.True(t, server.Start(serverPort), "couldn't start server connection")
+		server.Listen()
+
+		client := NewReliableConn(protocolID, TimeOut, maxSequence)
+		client.SetHandshake(true)
+		require.True(t, client.Start(clientPort), "couldn't start client connection")
+		if secure {
+			require.NoError(t, client.ConnectWithToken(token))
+		} else {
+			client.Connect(sAddr)
+		}
+		updateReliableConns(DeltaTime, 1000, func() bool {
+			return client.IsConnected() && server.IsConnected()
+		}, nil, client, server)
+		require.True(t, client.IsConnected(), "client should be connected")
+
+		// exchange packets, leaving some unacked
+		updateReliableConns(DeltaTime, 20, func() bool { return false }, clientPacket, client, server)
+		client.SendPacket(clientPacket)
+		server.SendPacket(serverPacket)
+		clientSequence := client.ReliabilitySystem().LocalSequence()
+		serverSequence := server.ReliabilitySystem().LocalSequence()
+		require.True(t, clientSequence > 0 && serverSequence > 0)
+		require.NotEmpty(t, client.ReliabilitySystem().pendingAckQueue)
+		peer, ok := server.PeerBySlot(0)
+		require.True(t, ok)
+
+		t.Logf("check both ends keep the session when the link drops\n")
+		updateReliableConns(DeltaTime, 1000, func() bool {
+			return !server.IsConnected()
+		}, nil, server)
+		updateReliableConns(DeltaTime, 1000, func() bool {
+			return client.IsResuming()
+		}, nil, client)
+		assert.True(t, client.IsResuming(), "client should be resuming")
+		assert.False(t, server.IsConnected(), "server should not be connected")
+		suspended, ok := server.PeerBySlot(0)
+		assert.True(t, ok, "server should keep the slot")
+		assert.True(t, suspended.Suspended)
+		assert.Empty(t, server.ConnectedSlots())
+		assert.Equal(t, clientSequence, client.ReliabilitySystem().LocalSequence())
+		assert.Equal(t, serverSequence, server.ReliabilitySystem().LocalSequence())
+
+		t.Logf("check session resumes when the link is back\n")
+		updateReliableConns(DeltaTime, 1000, func() bool {
+			return client.IsConnected() && server.IsConnected()
+		}, nil, client, server)
+		assert.True(t, client.IsConnected(), "client should be connected")
+		assert.True(t, server.IsConnected(), "server should be connected")
+		resumed, ok := server.PeerBySlot(0)
+		require.True(t, ok)
+		assert.False(t, resumed.Suspended)
+		assert.Equal(t, peer.ClientID, resumed.ClientID)
+		assert.Equal(t, peer.ClientID, client.ClientID())
+		assert.Equal(t, clientSequence, client.ReliabilitySystem().LocalSequence())
+		assert.NotEmpty(t, client.ReliabilitySystem().pendingAckQueue, "pending acks should be kept")
+
+		// sequence numbers carry on
+		updateReliableConns(DeltaTime, 20, func() bool { return false }, clientPacket, client, server)
+		assert.True(t, client.ReliabilitySystem().LocalSequence() > clientSequence)
+		assert.True(t, client.ReliabilitySystem().AckedPackets() > 0)
+
+		client.Stop()
+		server.Stop()
+	}
+}
+
+func TestConnectionResumeExpired(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(100) * time.Millisecond
+		Grace     = time.Duration(50) * time.Millisecond
+	)
+
+	cb := &resumeCallback{}
+	server := NewConn(cb, protocolID, TimeOut)
+	server.SetHandshake(true)
+	require.NoError(t, server.SetResumeGracePeriod(Grace))
+	assert.Error(t, server.SetResumeGracePeriod(-time.Second))
+	assert.Equal(t, Grace, server.ResumeGracePeriod())
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+	server.Listen()
+
+	client := NewConn(dummyCallback{}, protocolID, TimeOut)
+	client.SetHandshake(true)
+	require.True(t, client.Start(clientPort), "couldn't start client connection")
+	defer client.Stop()
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	client.Connect(sAddr)
+	updateConns(DeltaTime, 1000, func() bool {
+		return client.IsConnected() && server.IsConnected()
+	}, nil, client, server)
+	require.True(t, client.IsConnected(), "client should be connected")
+
+	t.Logf("check suspended slot is freed after the grace period\n")
+	updateConns(DeltaTime, 1000, func() bool {
+		_, ok := server.PeerBySlot(0)
+		return !ok
+	}, nil, server)
+	assert.Equal(t, []int{0}, cb.suspended)
+	assert.Empty(t, cb.resumed)
+	_, ok := server.PeerBySlot(0)
+	assert.False(t, ok, "slot should be freed")
+
+	t.Logf("check resuming an expired session is denied\n")
+	updateConns(DeltaTime, 1000, func() bool {
+		return !client.IsConnected() && !client.IsResuming()
+	}, nil, client, server)
+	assert.Equal(t, DenySessionExpired, client.DenyReason())
+	assert.False(t, client.IsConnected(), "client should not be connected")
+}
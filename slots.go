@@ -0,0 +1,263 @@
+package udpnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// number of copies of the disconnect packet sent to a kicked client
+const disconnectRedundancy = 3
+
+// SlotCallback can be implemented by the ConnCallback of a server connection
+// to be told which slot a client connects to or disconnects from. OnConnect
+// and OnDisconnect are still called for every client.
+type SlotCallback interface {
+	OnClientConnect(slot int)
+	OnClientDisconnect(slot int)
+}
+
+// PeerInfo describes a client connected to a server connection.
+type PeerInfo struct {
+	Slot     int          // index of the slot the client occupies
+	ClientID uint64       // id of the client, from its connect token or assigned by the server
+	Address  *net.UDPAddr // address of the client
+	UserData []byte       // user data of the client connect token, if any
+	Version  uint16       // negotiated protocol version
+	Features uint32       // negotiated feature flags
+
+	// Suspended is set when the client timed out and the server keeps its
+	// session for the resume grace period.
+	Suspended bool
+}
+
+// peer is a client connected to a server connection.
+type peer struct {
+	slot               int
+	clientID           uint64
+	sessionID          uint64
+	address            *net.UDPAddr
+	session            *session
+	negotiated         negotiation
+	timeoutAccumulator time.Duration
+	migration          *migration    // address change waiting for validation
+	resumeTicket       []byte        // ticket the client presents to resume its session
+	suspended          bool          // the client timed out, its session is kept
+	graceLeft          time.Duration // time left before a suspended client is disconnected
+}
+
+func (p *peer) info() PeerInfo {
+	info := PeerInfo{
+		Slot:      p.slot,
+		ClientID:  p.clientID,
+		Address:   p.address,
+		Version:   p.negotiated.version,
+		Features:  p.negotiated.features,
+		Suspended: p.suspended,
+	}
+	if p.session != nil {
+		info.UserData = p.session.userData
+	}
+	return info
+}
+
+// SetMaxClients sets the number of clients a server connection can host, 1 by
+// default. It can't be changed while clients are connected. ReliableConn keeps
+// a single reliability system and can't host more than one client.
+func (c *Conn) SetMaxClients(n int) error {
+	if n < 1 {
+		return errors.New("max clients must be at least 1")
+	}
+	if c.mode == Server && c.firstPeer() != nil {
+		return errors.New("can't change max clients while clients are connected")
+	}
+	c.maxClients = n
+	c.peers = make([]*peer, n)
+	return nil
+}
+
+// MaxClients returns the number of clients a server connection can host.
+func (c *Conn) MaxClients() int {
+	return c.maxClients
+}
+
+// ConnectedSlots returns the slots of the connected clients, in increasing
+// order. Suspended clients are not included.
+func (c *Conn) ConnectedSlots() []int {
+	var slots []int
+	for slot, p := range c.peers {
+		if p != nil && !p.suspended {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+// PeerBySlot returns the client connected in slot.
+func (c *Conn) PeerBySlot(slot int) (PeerInfo, bool) {
+	if slot < 0 || slot >= len(c.peers) || c.peers[slot] == nil {
+		return PeerInfo{}, false
+	}
+	return c.peers[slot].info(), true
+}
+
+// PeerByClientID returns the connected client with given id.
+func (c *Conn) PeerByClientID(clientID uint64) (PeerInfo, bool) {
+	if p := c.peerByClientID(clientID); p != nil {
+		return p.info(), true
+	}
+	return PeerInfo{}, false
+}
+
+// Kick disconnects the client connected in slot. With the handshake, the
+// client is told it is disconnected, otherwise its connection times out.
+func (c *Conn) Kick(slot int) error {
+	if slot < 0 || slot >= len(c.peers) || c.peers[slot] == nil {
+		return fmt.Errorf("no client in slot %d", slot)
+	}
+	fmt.Printf("server kicks client in slot %d\n", slot)
+	if p := c.peers[slot]; c.handshake && !p.suspended {
+		// the packet may be lost, send a few copies
+		for i := 0; i < disconnectRedundancy; i++ {
+			c.sendPacket(p.address, disconnectPacket, nil, p.session)
+		}
+	}
+	c.disconnectPeer(slot)
+	return nil
+}
+
+// processDisconnect disconnects, on a client, the connection kicked by the
+// server.
+func (c *Conn) processDisconnect(sender *net.UDPAddr, body []byte) {
+	if c.mode != Client || (c.state != connected && c.state != resuming) || !sameAddress(sender, c.address) {
+		return
+	}
+	if c.session != nil {
+		if _, ok := c.session.open(c.additionalData(disconnectPacket), body); !ok {
+			return
+		}
+	}
+	fmt.Printf("client disconnected by server\n")
+	c.clearData()
+	c.cb.OnDisconnect()
+}
+
+// SendPacketTo sends a slice of data to the client connected in slot.
+func (c *Conn) SendPacketTo(slot int, data []byte) error {
+	if c.mode != Server {
+		return errors.New("not a server")
+	}
+	if slot < 0 || slot >= len(c.peers) || c.peers[slot] == nil {
+		return fmt.Errorf("no client in slot %d", slot)
+	}
+	p := c.peers[slot]
+	if p.suspended {
+		return fmt.Errorf("client in slot %d is suspended", slot)
+	}
+	return c.sendPacket(p.address, payloadPacket, data, p.session)
+}
+
+// ReceivePacketFrom receives a slice of data from the connection, like
+// ReceivePacket, and returns the slot of the client that sent it, or -1 if
+// nothing was received. The slot is always 0 on a client connection.
+func (c *Conn) ReceivePacketFrom(data []byte) (int, int) {
+	n := c.ReceivePacket(data)
+	if n == 0 {
+		return 0, -1
+	}
+	return n, c.lastSlot
+}
+
+// freeSlot returns the first free slot, or -1 if the server is full.
+func (c *Conn) freeSlot() int {
+	for slot, p := range c.peers {
+		if p == nil {
+			return slot
+		}
+	}
+	return -1
+}
+
+func (c *Conn) peerByAddress(addr *net.UDPAddr) *peer {
+	for _, p := range c.peers {
+		if p != nil && sameAddress(addr, p.address) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (c *Conn) peerByClientID(clientID uint64) *peer {
+	for _, p := range c.peers {
+		if p != nil && p.clientID == clientID {
+			return p
+		}
+	}
+	return nil
+}
+
+// updateServerState sets a server as connected while it has clients that are
+// not suspended, and as listening otherwise.
+func (c *Conn) updateServerState() {
+	c.state = listening
+	for _, p := range c.peers {
+		if p != nil && !p.suspended {
+			c.state = connected
+		}
+	}
+}
+
+// firstPeer returns the client in the lowest connected slot, or nil.
+func (c *Conn) firstPeer() *peer {
+	for _, p := range c.peers {
+		if p != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// updatePeers disconnects the clients the server hasn't heard of for longer
+// than the timeout, or suspends them if sessions can be resumed.
+func (c *Conn) updatePeers(dt time.Duration) {
+	for slot, p := range c.peers {
+		if p == nil {
+			continue
+		}
+		if p.suspended {
+			p.graceLeft -= dt
+			if p.graceLeft <= 0 {
+				fmt.Printf("session expired for client in slot %d\n", slot)
+				c.disconnectPeer(slot)
+			}
+			continue
+		}
+		p.timeoutAccumulator += dt
+		if m := p.migration; m != nil {
+			m.age += dt
+			m.resend -= dt
+			if m.age > c.timeout {
+				p.migration = nil
+			}
+		}
+		if p.timeoutAccumulator > c.timeout {
+			fmt.Printf("connection timed out for client in slot %d\n", slot)
+			if c.resumeGrace > 0 {
+				c.suspendPeer(p)
+			} else {
+				c.disconnectPeer(slot)
+			}
+		}
+	}
+}
+
+// disconnectPeer frees slot.
+func (c *Conn) disconnectPeer(slot int) {
+	c.peers[slot] = nil
+	c.updateServerState()
+	if sc, ok := c.cb.(SlotCallback); ok {
+		sc.OnClientDisconnect(slot)
+	}
+	c.cb.OnDisconnect()
+}
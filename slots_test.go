@@ -0,0 +1,143 @@
+package udpnet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slotCallback records the slots clients connect to and disconnect from.
+type slotCallback struct {
+	dummyCallback
+	connected    []int
+	disconnected []int
+}
+
+func (sc *slotCallback) OnClientConnect(slot int)    { sc.connected = append(sc.connected, slot) }
+func (sc *slotCallback) OnClientDisconnect(slot int) { sc.disconnected = append(sc.disconnected, slot) }
+
+func TestConnectionMaxClients(t *testing.T) {
+	const (
+		DeltaTime  = time.Millisecond
+		TimeOut    = time.Duration(100) * time.Millisecond
+		MaxClients = 3
+	)
+
+	cb := &slotCallback{}
+	server := NewConn(cb, protocolID, TimeOut)
+	server.SetHandshake(true)
+	require.NoError(t, server.SetMaxClients(MaxClients))
+	assert.Equal(t, MaxClients, server.MaxClients())
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+	server.Listen()
+
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	clients := make([]*Conn, MaxClients+1)
+	for i := range clients {
+		clients[i] = NewConn(dummyCallback{}, protocolID, TimeOut)
+		clients[i].SetHandshake(true)
+		require.True(t, clients[i].Start(clientPort+i), "couldn't start client connection")
+		defer clients[i].Stop()
+	}
+
+	t.Logf("check clients fill the slots in order\n")
+	for i, client := range clients[:MaxClients] {
+		client.Connect(sAddr)
+		updateConns(DeltaTime, 1000, func() bool {
+			return client.IsConnected()
+		}, nil, client, server)
+		require.True(t, client.IsConnected(), "client should be connected")
+
+		peer, ok := server.PeerBySlot(i)
+		require.True(t, ok)
+		assert.Equal(t, i, peer.Slot)
+		assert.Equal(t, client.ClientID(), peer.ClientID)
+		assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", clientPort+i), peer.Address.String())
+		byID, ok := server.PeerByClientID(peer.ClientID)
+		assert.True(t, ok)
+		assert.Equal(t, peer, byID)
+	}
+	assert.Equal(t, []int{0, 1, 2}, server.ConnectedSlots())
+	assert.Equal(t, []int{0, 1, 2}, cb.connected)
+	assert.Error(t, server.SetMaxClients(MaxClients+1), "max clients can't change while clients are connected")
+
+	t.Logf("check extra client is denied\n")
+	extra := clients[MaxClients]
+	extra.Connect(sAddr)
+	updateConns(DeltaTime, 1000, func() bool {
+		return !extra.IsConnecting()
+	}, nil, extra, server)
+	assert.True(t, extra.ConnectFailed(), "extra client should fail to connect")
+	assert.Equal(t, DenyServerFull, extra.DenyReason())
+
+	t.Logf("check packets are addressed by slot\n")
+	var empty [256]byte
+	n, slot := server.ReceivePacketFrom(empty[:])
+	assert.Equal(t, 0, n)
+	assert.Equal(t, -1, slot, "nothing received should give no slot")
+	require.NoError(t, server.SendPacketTo(1, []byte("slot 1")))
+	assert.Error(t, server.SendPacketTo(MaxClients, []byte("no slot")))
+	for i, client := range clients[:MaxClients] {
+		var packet [256]byte
+		var n int
+		for try := 0; try < 10 && n == 0; try++ {
+			n = client.ReceivePacket(packet[:])
+		}
+		if i == 1 {
+			assert.Equal(t, "slot 1", string(packet[:n]))
+		} else {
+			assert.Equal(t, 0, n)
+		}
+	}
+	require.NoError(t, clients[2].SendPacket([]byte("from 2")))
+	var packet [256]byte
+	for try := 0; try < 10 && n == 0; try++ {
+		n, slot = server.ReceivePacketFrom(packet[:])
+	}
+	assert.Equal(t, "from 2", string(packet[:n]))
+	assert.Equal(t, 2, slot)
+
+	t.Logf("check kicked slot is reused\n")
+	require.NoError(t, server.Kick(1))
+	assert.Error(t, server.Kick(1))
+	assert.Equal(t, []int{0, 2}, server.ConnectedSlots())
+	assert.Equal(t, []int{1}, cb.disconnected)
+	_, ok := server.PeerBySlot(1)
+	assert.False(t, ok)
+	for try := 0; try < 10 && clients[1].IsConnected(); try++ {
+		clients[1].ReceivePacket(packet[:])
+	}
+	assert.False(t, clients[1].IsConnected(), "kicked client should be told it is disconnected")
+	assert.True(t, clients[0].IsConnected(), "other clients should stay connected")
+
+	extra.Connect(sAddr)
+	updateConns(DeltaTime, 1000, func() bool {
+		return extra.IsConnected()
+	}, nil, extra, server)
+	assert.True(t, extra.IsConnected(), "extra client should take the free slot")
+	peer, ok := server.PeerByClientID(extra.ClientID())
+	assert.True(t, ok)
+	assert.Equal(t, 1, peer.Slot)
+
+	t.Logf("check clients time out individually\n")
+	updateConns(DeltaTime, 1000, func() bool {
+		return len(server.ConnectedSlots()) == 1
+	}, clientPacket, server, extra)
+	assert.Equal(t, []int{1}, server.ConnectedSlots())
+	assert.True(t, server.IsConnected(), "server should still be connected")
+	require.NoError(t, server.Kick(1))
+	assert.False(t, server.IsConnected(), "server should not be connected")
+	assert.True(t, server.IsListening(), "server should be listening")
+}
+
+func TestReliableConnectionMaxClients(t *testing.T) {
+	c := NewReliableConn(protocolID, time.Second, maxSequence)
+	assert.Error(t, c.SetMaxClients(2), "clients would share the reliability system")
+	assert.NoError(t, c.SetMaxClients(1))
+	assert.Equal(t, 1, c.MaxClients())
+}
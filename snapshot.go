@@ -0,0 +1,214 @@
+package udpnet
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	// defaultMaxExtrapolation is the default time a SnapshotBuffer
+	// extrapolates past its newest snapshot.
+	defaultMaxExtrapolation = 100 * time.Millisecond
+
+	// jitterMultiple is the number of jitters added to the snapshot interval
+	// to get the interpolation delay.
+	jitterMultiple = 3
+)
+
+// Snapshot is a state of the world sent by the server at a tick.
+type Snapshot struct {
+	Tick uint64
+	Data interface{}
+}
+
+// Interpolation is the result of sampling a SnapshotBuffer at a render time.
+// The rendered state is From blended toward To by Alpha. Alpha is greater
+// than 1 when extrapolating past the newest snapshot.
+type Interpolation struct {
+	From, To     Snapshot
+	Alpha        float64
+	Extrapolated bool
+}
+
+// SnapshotBuffer holds the last snapshots received from the server, by tick,
+// for the client to render in between them. Rendering happens an
+// interpolation delay in the past so that the next snapshot has usually
+// arrived. The delay adapts to the measured arrival jitter: it is the
+// interval between snapshots plus 3 times the jitter, within bounds.
+//
+// Times are on the server timeline, where tick t is at t times the tick
+// duration. Arrival times are on any local clock.
+type SnapshotBuffer struct {
+	tickDuration     time.Duration
+	capacity         int
+	snapshots        []Snapshot // by increasing tick
+	minDelay         time.Duration
+	maxDelay         time.Duration
+	maxExtrapolation time.Duration
+
+	// arrival statistics
+	arrivals     uint64        // number of snapshots measured
+	lastTransit  time.Duration // arrival time minus snapshot time of the newest snapshot
+	lastTick     uint64        // tick of the newest snapshot
+	jitter       time.Duration // smoothed transit time variation
+	interval     time.Duration // smoothed interval between snapshots
+	extrapolated uint64        // number of samples extrapolated
+}
+
+// NewSnapshotBuffer returns a buffer holding up to capacity snapshots, sent
+// by a server ticking every tickDuration.
+func NewSnapshotBuffer(capacity int, tickDuration time.Duration) (*SnapshotBuffer, error) {
+	if capacity < 2 {
+		return nil, errors.New("snapshot buffer needs room for 2 snapshots")
+	}
+	if tickDuration <= 0 {
+		return nil, errors.New("tick duration must be positive")
+	}
+	return &SnapshotBuffer{
+		tickDuration:     tickDuration,
+		capacity:         capacity,
+		minDelay:         tickDuration,
+		maxDelay:         time.Duration(capacity-1) * tickDuration,
+		maxExtrapolation: defaultMaxExtrapolation,
+		interval:         tickDuration,
+	}, nil
+}
+
+// SetDelayBounds sets the bounds of the interpolation delay, by default from
+// one tick to as many ticks as the buffer holds snapshots, minus one.
+func (sb *SnapshotBuffer) SetDelayBounds(min, max time.Duration) error {
+	if min < 0 || max < min {
+		return errors.New("invalid delay bounds")
+	}
+	sb.minDelay, sb.maxDelay = min, max
+	return nil
+}
+
+// SetMaxExtrapolation sets how long past the newest snapshot Sample
+// extrapolates, 100 milliseconds by default. Past that the state is frozen.
+func (sb *SnapshotBuffer) SetMaxExtrapolation(max time.Duration) {
+	sb.maxExtrapolation = max
+}
+
+// Len returns the number of snapshots in the buffer.
+func (sb *SnapshotBuffer) Len() int {
+	return len(sb.snapshots)
+}
+
+// Jitter returns the measured arrival jitter.
+func (sb *SnapshotBuffer) Jitter() time.Duration {
+	return sb.jitter
+}
+
+// Extrapolated returns the number of samples that were extrapolated.
+func (sb *SnapshotBuffer) Extrapolated() uint64 {
+	return sb.extrapolated
+}
+
+// Delay returns the interpolation delay.
+func (sb *SnapshotBuffer) Delay() time.Duration {
+	delay := sb.interval + jitterMultiple*sb.jitter
+	if delay < sb.minDelay {
+		delay = sb.minDelay
+	}
+	if delay > sb.maxDelay {
+		delay = sb.maxDelay
+	}
+	return delay
+}
+
+// RenderTime returns the time to render at for a server time, the server
+// time minus the interpolation delay.
+func (sb *SnapshotBuffer) RenderTime(serverTime time.Duration) time.Duration {
+	return serverTime - sb.Delay()
+}
+
+// Add adds a snapshot received at arrival. Duplicated snapshots and
+// snapshots older than the buffer are ignored, it returns false then. When
+// the buffer is full the oldest snapshot is removed.
+func (sb *SnapshotBuffer) Add(s Snapshot, arrival time.Duration) bool {
+	i := sort.Search(len(sb.snapshots), func(i int) bool { return sb.snapshots[i].Tick >= s.Tick })
+	if i < len(sb.snapshots) && sb.snapshots[i].Tick == s.Tick {
+		return false
+	}
+	if i == 0 && len(sb.snapshots) == sb.capacity {
+		return false
+	}
+	sb.snapshots = append(sb.snapshots, Snapshot{})
+	copy(sb.snapshots[i+1:], sb.snapshots[i:])
+	sb.snapshots[i] = s
+	if len(sb.snapshots) > sb.capacity {
+		copy(sb.snapshots, sb.snapshots[1:])
+		sb.snapshots[len(sb.snapshots)-1] = Snapshot{}
+		sb.snapshots = sb.snapshots[:sb.capacity]
+	}
+	sb.measure(s.Tick, arrival)
+	return true
+}
+
+// measure updates the jitter and interval estimations with the arrival of a
+// snapshot, like the RTP interarrival jitter. Snapshots older than the newest
+// one are not measured, their transit is compared to a newer snapshot's.
+func (sb *SnapshotBuffer) measure(tick uint64, arrival time.Duration) {
+	if sb.arrivals > 0 && tick <= sb.lastTick {
+		return
+	}
+	transit := arrival - sb.tickTime(tick)
+	if sb.arrivals > 0 {
+		d := transit - sb.lastTransit
+		if d < 0 {
+			d = -d
+		}
+		sb.jitter += (d - sb.jitter) / 16
+		interval := sb.tickTime(tick - sb.lastTick)
+		sb.interval += (interval - sb.interval) / 8
+	}
+	sb.arrivals++
+	sb.lastTransit = transit
+	sb.lastTick = tick
+}
+
+func (sb *SnapshotBuffer) tickTime(tick uint64) time.Duration {
+	return time.Duration(tick) * sb.tickDuration
+}
+
+// Sample returns the snapshots surrounding renderTime and the interpolation
+// alpha. Past the newest snapshot, it extrapolates from the two newest ones
+// for up to the maximum extrapolation. It returns false if the buffer is
+// empty.
+func (sb *SnapshotBuffer) Sample(renderTime time.Duration) (Interpolation, bool) {
+	n := len(sb.snapshots)
+	if n == 0 {
+		return Interpolation{}, false
+	}
+	first, last := sb.snapshots[0], sb.snapshots[n-1]
+	if n == 1 || renderTime <= sb.tickTime(first.Tick) {
+		return Interpolation{From: first, To: first}, true
+	}
+	if renderTime >= sb.tickTime(last.Tick) {
+		from := sb.snapshots[n-2]
+		ahead := renderTime - sb.tickTime(last.Tick)
+		if ahead > sb.maxExtrapolation {
+			ahead = sb.maxExtrapolation
+		}
+		span := sb.tickTime(last.Tick - from.Tick)
+		if ahead > 0 {
+			sb.extrapolated++
+		}
+		return Interpolation{
+			From:         from,
+			To:           last,
+			Alpha:        1 + float64(ahead)/float64(span),
+			Extrapolated: ahead > 0,
+		}, true
+	}
+	i := sort.Search(n, func(i int) bool { return sb.tickTime(sb.snapshots[i].Tick) > renderTime })
+	from, to := sb.snapshots[i-1], sb.snapshots[i]
+	span := sb.tickTime(to.Tick - from.Tick)
+	return Interpolation{
+		From:  from,
+		To:    to,
+		Alpha: float64(renderTime-sb.tickTime(from.Tick)) / float64(span),
+	}, true
+}
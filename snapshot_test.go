@@ -0,0 +1,124 @@
+package udpnet
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotBufferInterpolation(t *testing.T) {
+	const TickDuration = time.Duration(10) * time.Millisecond
+
+	_, err := NewSnapshotBuffer(1, TickDuration)
+	assert.Error(t, err)
+	_, err = NewSnapshotBuffer(4, 0)
+	assert.Error(t, err)
+
+	sb, err := NewSnapshotBuffer(4, TickDuration)
+	require.NoError(t, err)
+	_, ok := sb.Sample(0)
+	assert.False(t, ok, "empty buffer can't be sampled")
+
+	// snapshots every 2 ticks, 14 arrives before 12, 10 is duplicated
+	for _, tick := range []uint64{10, 14, 12, 10} {
+		sb.Add(Snapshot{Tick: tick, Data: int(tick)}, time.Duration(tick)*TickDuration)
+	}
+	assert.Equal(t, 3, sb.Len())
+
+	var tests = []struct {
+		render       time.Duration
+		from, to     uint64
+		alpha        float64
+		extrapolated bool
+	}{
+		{50 * time.Millisecond, 10, 10, 0, false},
+		{100 * time.Millisecond, 10, 10, 0, false},
+		{105 * time.Millisecond, 10, 12, 0.25, false},
+		{130 * time.Millisecond, 12, 14, 0.5, false},
+		{140 * time.Millisecond, 12, 14, 1, false},
+		{150 * time.Millisecond, 12, 14, 1.5, true},
+		{time.Second, 12, 14, 1 + float64(defaultMaxExtrapolation)/float64(2*TickDuration), true},
+	}
+	for _, tt := range tests {
+		ip, ok := sb.Sample(tt.render)
+		require.True(t, ok)
+		assert.Equal(t, tt.from, ip.From.Tick)
+		assert.Equal(t, tt.to, ip.To.Tick)
+		assert.Equal(t, int(tt.to), ip.To.Data)
+		assert.InDelta(t, tt.alpha, ip.Alpha, 1e-9)
+		assert.Equal(t, tt.extrapolated, ip.Extrapolated)
+	}
+	assert.EqualValues(t, 2, sb.Extrapolated())
+
+	t.Logf("check capacity\n")
+	assert.True(t, sb.Add(Snapshot{Tick: 16}, 160*time.Millisecond))
+	assert.True(t, sb.Add(Snapshot{Tick: 18}, 180*time.Millisecond))
+	assert.Equal(t, 4, sb.Len())
+	assert.False(t, sb.Add(Snapshot{Tick: 8}, 190*time.Millisecond), "snapshots older than the buffer should be ignored")
+	ip, _ := sb.Sample(0)
+	assert.Equal(t, uint64(12), ip.From.Tick, "oldest snapshot should be removed")
+}
+
+func TestSnapshotBufferAdaptiveDelay(t *testing.T) {
+	const (
+		TickDuration = time.Duration(10) * time.Millisecond
+		Latency      = time.Duration(50) * time.Millisecond
+	)
+
+	// arrivals returns the arrival times of snapshots sent every 3 ticks,
+	// delayed by latency plus up to jitter
+	arrivals := func(sb *SnapshotBuffer, jitter time.Duration, loss float64) {
+		r := rand.New(rand.NewSource(1))
+		for tick := uint64(0); tick < 300; tick += 3 {
+			if r.Float64() < loss {
+				continue
+			}
+			arrival := time.Duration(tick)*TickDuration + Latency
+			if jitter > 0 {
+				arrival += time.Duration(r.Int63n(int64(jitter)))
+			}
+			sb.Add(Snapshot{Tick: tick}, arrival)
+		}
+	}
+
+	steady, err := NewSnapshotBuffer(32, TickDuration)
+	require.NoError(t, err)
+	arrivals(steady, 0, 0)
+	assert.Equal(t, time.Duration(0), steady.Jitter())
+	assert.InDelta(t, float64(3*TickDuration), float64(steady.Delay()), float64(time.Millisecond),
+		"delay should be the snapshot interval without jitter")
+
+	jittery, err := NewSnapshotBuffer(32, TickDuration)
+	require.NoError(t, err)
+	arrivals(jittery, 40*time.Millisecond, 0)
+	assert.True(t, jittery.Jitter() > 5*time.Millisecond, "jitter should be measured")
+	assert.True(t, jittery.Delay() > steady.Delay()+15*time.Millisecond, "delay should grow with jitter")
+
+	t.Logf("check reordered snapshots don't update the jitter\n")
+	reordered, err := NewSnapshotBuffer(32, TickDuration)
+	require.NoError(t, err)
+	for tick := uint64(0); tick < 30; tick += 3 {
+		reordered.Add(Snapshot{Tick: tick}, time.Duration(tick)*TickDuration+Latency)
+	}
+	jitter := reordered.Jitter()
+	require.True(t, reordered.Add(Snapshot{Tick: 25}, 30*TickDuration+Latency))
+	assert.Equal(t, jitter, reordered.Jitter())
+	reordered.Add(Snapshot{Tick: 30}, 30*TickDuration+Latency)
+	assert.Equal(t, jitter, reordered.Jitter(), "next snapshot should be compared to the newest one")
+
+	lossy, err := NewSnapshotBuffer(32, TickDuration)
+	require.NoError(t, err)
+	arrivals(lossy, 0, 0.3)
+	assert.True(t, lossy.Delay() > steady.Delay(), "delay should grow with loss")
+
+	bounded, err := NewSnapshotBuffer(32, TickDuration)
+	require.NoError(t, err)
+	require.NoError(t, bounded.SetDelayBounds(0, 50*time.Millisecond))
+	assert.Error(t, bounded.SetDelayBounds(20*time.Millisecond, 10*time.Millisecond))
+	arrivals(bounded, 200*time.Millisecond, 0)
+	assert.Equal(t, 50*time.Millisecond, bounded.Delay())
+	assert.Equal(t, time.Second-50*time.Millisecond, bounded.RenderTime(time.Second))
+}
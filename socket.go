@@ -18,9 +18,23 @@ func (s *Socket) Open(port int) error {
 		Port: port,
 		IP:   net.ParseIP("127.0.0.1"),
 	}
+	return s.OpenAddr(&addr)
+}
+
+// OpenAddr binds the socket to addr. Binding to the unspecified address
+// receives the packets sent to any local address, broadcasts included.
+func (s *Socket) OpenAddr(addr *net.UDPAddr) error {
 	// bind socket
 	var err error
-	s.conn, err = net.ListenUDP("udp", &addr)
+	s.conn, err = net.ListenUDP("udp", addr)
+	return err
+}
+
+// OpenMulticast binds the socket to the port of the multicast group and joins
+// the group on ifi, or on the system-assigned interface if ifi is nil.
+func (s *Socket) OpenMulticast(group *net.UDPAddr, ifi *net.Interface) error {
+	var err error
+	s.conn, err = net.ListenMulticastUDP("udp4", ifi, group)
 	return err
 }
 
@@ -37,6 +51,15 @@ func (s *Socket) IsOpen() bool {
 	return s.conn != nil
 }
 
+// LocalAddr returns the local address the socket is bound to, or nil if the
+// socket is not open
+func (s *Socket) LocalAddr() *net.UDPAddr {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
 // Send writes the data buffer on addr
 func (s *Socket) Send(addr *net.UDPAddr, data []byte) error {
 	var (
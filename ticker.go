@@ -0,0 +1,150 @@
+package udpnet
+
+import (
+	"errors"
+	"time"
+)
+
+// defaultMaxCatchUp is the default maximum number of ticks run by a single
+// Advance.
+const defaultMaxCatchUp = 5
+
+// Updater is implemented by the objects a TickRunner updates every tick,
+// connections, reliable connections, nodes, relays...
+type Updater interface {
+	Update(dt time.Duration)
+}
+
+// TickHook is called by a TickRunner with the number of the tick being run.
+type TickHook func(tick uint64)
+
+// TickRunner updates connections at a fixed rate. Elapsed time is
+// accumulated and consumed one tick duration at a time, so that every Update
+// is given exactly the tick duration whatever the actual time between two
+// calls. After a stall, missed ticks are caught up, up to a maximum, the rest
+// of the late time is dropped.
+//
+// Each tick runs the receive hooks, then the send hooks, then updates the
+// connections.
+type TickRunner struct {
+	tickDuration time.Duration
+	maxCatchUp   int
+	accumulator  time.Duration
+	tick         uint64        // number of ticks run
+	dropped      time.Duration // late time dropped after stalls
+	updaters     []Updater
+	receiveHooks []TickHook
+	sendHooks    []TickHook
+}
+
+// NewTickRunner returns a runner updating updaters every tickDuration.
+func NewTickRunner(tickDuration time.Duration, updaters ...Updater) (*TickRunner, error) {
+	if tickDuration <= 0 {
+		return nil, errors.New("tick duration must be positive")
+	}
+	return &TickRunner{
+		tickDuration: tickDuration,
+		maxCatchUp:   defaultMaxCatchUp,
+		updaters:     updaters,
+	}, nil
+}
+
+// SetMaxCatchUp sets the maximum number of ticks run by a single Advance, 5
+// by default.
+func (tr *TickRunner) SetMaxCatchUp(n int) error {
+	if n < 1 {
+		return errors.New("max catch up must be at least 1")
+	}
+	tr.maxCatchUp = n
+	return nil
+}
+
+// Add adds updaters, updated every tick after the others.
+func (tr *TickRunner) Add(updaters ...Updater) {
+	tr.updaters = append(tr.updaters, updaters...)
+}
+
+// OnReceive adds a hook called at the start of every tick, to receive the
+// packets of the connections.
+func (tr *TickRunner) OnReceive(hook TickHook) {
+	tr.receiveHooks = append(tr.receiveHooks, hook)
+}
+
+// OnSend adds a hook called every tick after the receive hooks, to send the
+// packets of the connections.
+func (tr *TickRunner) OnSend(hook TickHook) {
+	tr.sendHooks = append(tr.sendHooks, hook)
+}
+
+// TickDuration returns the duration of a tick.
+func (tr *TickRunner) TickDuration() time.Duration {
+	return tr.tickDuration
+}
+
+// Tick returns the number of ticks run so far, which is also the number of
+// the next tick.
+func (tr *TickRunner) Tick() uint64 {
+	return tr.tick
+}
+
+// Alpha returns the fraction of a tick accumulated and not run yet, between
+// 0 and 1, to interpolate rendering between the last two ticks.
+func (tr *TickRunner) Alpha() float64 {
+	return float64(tr.accumulator) / float64(tr.tickDuration)
+}
+
+// Dropped returns the late time dropped because it exceeded the maximum
+// number of ticks to catch up.
+func (tr *TickRunner) Dropped() time.Duration {
+	return tr.dropped
+}
+
+// Advance accumulates elapsed time and runs the ticks it covers, up to the
+// maximum catch up. It returns the number of ticks run.
+func (tr *TickRunner) Advance(elapsed time.Duration) int {
+	tr.accumulator += elapsed
+	if late := tr.accumulator - time.Duration(tr.maxCatchUp)*tr.tickDuration; late >= tr.tickDuration {
+		// keep the fraction of a tick, drop whole ticks
+		late -= late % tr.tickDuration
+		tr.dropped += late
+		tr.accumulator -= late
+	}
+	var ticks int
+	for tr.accumulator >= tr.tickDuration {
+		tr.accumulator -= tr.tickDuration
+		tr.runTick()
+		ticks++
+	}
+	return ticks
+}
+
+func (tr *TickRunner) runTick() {
+	for _, hook := range tr.receiveHooks {
+		hook(tr.tick)
+	}
+	for _, hook := range tr.sendHooks {
+		hook(tr.tick)
+	}
+	for _, u := range tr.updaters {
+		u.Update(tr.tickDuration)
+	}
+	tr.tick++
+}
+
+// Run advances the runner with the actual elapsed time, sleeping until the
+// next tick in between, until stop is closed.
+func (tr *TickRunner) Run(stop <-chan struct{}) {
+	last := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-timer.C:
+			tr.Advance(now.Sub(last))
+			last = now
+			timer.Reset(tr.tickDuration - tr.accumulator)
+		}
+	}
+}
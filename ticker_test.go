@@ -0,0 +1,123 @@
+package udpnet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordUpdater records the durations it is updated with.
+type recordUpdater struct {
+	dts []time.Duration
+}
+
+func (ru *recordUpdater) Update(dt time.Duration) { ru.dts = append(ru.dts, dt) }
+
+func TestTickRunnerAdvance(t *testing.T) {
+	const TickDuration = time.Duration(10) * time.Millisecond
+
+	_, err := NewTickRunner(0)
+	assert.Error(t, err)
+
+	ru := &recordUpdater{}
+	tr, err := NewTickRunner(TickDuration, ru)
+	require.NoError(t, err)
+	assert.Error(t, tr.SetMaxCatchUp(0))
+
+	var events []string
+	tr.OnReceive(func(tick uint64) { events = append(events, fmt.Sprintf("receive %d", tick)) })
+	tr.OnSend(func(tick uint64) { events = append(events, fmt.Sprintf("send %d", tick)) })
+
+	var tests = []struct {
+		elapsed time.Duration
+		ticks   int
+		tick    uint64
+		alpha   float64
+	}{
+		{3 * time.Millisecond, 0, 0, 0.3},
+		{7 * time.Millisecond, 1, 1, 0},
+		{12 * time.Millisecond, 1, 2, 0.2},
+		{29 * time.Millisecond, 3, 5, 0.1},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.ticks, tr.Advance(tt.elapsed))
+		assert.Equal(t, tt.tick, tr.Tick())
+		assert.InDelta(t, tt.alpha, tr.Alpha(), 1e-9)
+	}
+	require.Len(t, ru.dts, 5)
+	for _, dt := range ru.dts {
+		assert.Equal(t, TickDuration, dt, "updates should be given the tick duration")
+	}
+	assert.Equal(t, []string{"receive 0", "send 0", "receive 1", "send 1"}, events[:4])
+
+	t.Logf("check catch up is capped after a stall\n")
+	require.NoError(t, tr.SetMaxCatchUp(3))
+	assert.Equal(t, 3, tr.Advance(time.Second))
+	assert.Equal(t, uint64(8), tr.Tick())
+	assert.InDelta(t, 0.1, tr.Alpha(), 1e-9, "fraction of a tick should be kept")
+	assert.Equal(t, time.Second-3*TickDuration, tr.Dropped())
+}
+
+func TestTickRunnerRun(t *testing.T) {
+	const (
+		TickDuration = time.Duration(2) * time.Millisecond
+		TimeOut      = time.Second
+	)
+
+	server := NewReliableConn(protocolID, TimeOut, maxSequence)
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+	server.Listen()
+	client := NewReliableConn(protocolID, TimeOut, maxSequence)
+	require.True(t, client.Start(clientPort), "couldn't start client connection")
+	defer client.Stop()
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	client.Connect(sAddr)
+
+	tr, err := NewTickRunner(TickDuration, client, server)
+	require.NoError(t, err)
+	var (
+		received int
+		stopped  bool
+	)
+	stop := make(chan struct{})
+	tr.OnReceive(func(tick uint64) {
+		for _, c := range []*ReliableConn{client, server} {
+			for {
+				var packet [256]byte
+				if c.ReceivePacket(packet[:]) == 0 {
+					break
+				}
+				received++
+			}
+		}
+	})
+	tr.OnSend(func(tick uint64) {
+		if client.IsConnected() || client.IsConnecting() {
+			client.SendPacket(clientPacket)
+			server.SendPacket(serverPacket)
+		}
+		if received >= 20 && !stopped {
+			close(stop)
+			stopped = true
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		tr.Run(stop)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("connections should exchange packets")
+	}
+	assert.True(t, client.IsConnected(), "client should be connected")
+	assert.True(t, tr.Tick() > 0)
+	assert.Equal(t, time.Duration(tr.Tick())*TickDuration, client.LocalTime())
+}
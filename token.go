@@ -0,0 +1,297 @@
+package udpnet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// KeySize is the size of the keys used to seal connect tokens and packets.
+const KeySize = 32
+
+// Key is an AES-256 key used to seal connect tokens and packets.
+type Key [KeySize]byte
+
+// GenerateKey returns a new random key.
+func GenerateKey() (Key, error) {
+	var key Key
+	_, err := rand.Read(key[:])
+	return key, err
+}
+
+const (
+	// MaxTokenServers is the maximum number of server addresses in a connect
+	// token.
+	MaxTokenServers = 32
+
+	// MaxUserDataSize is the maximum size of the user data carried by a
+	// connect token.
+	MaxUserDataSize = 256
+
+	tokenNonceSize  = 12
+	tokenTagSize    = 16
+	addressSize     = 18 // 16 bytes IP and 2 bytes port
+	maxPrivateToken = 8 + 1 + MaxTokenServers*addressSize + 2*KeySize + 2 + MaxUserDataSize + tokenTagSize
+)
+
+// ConnectToken is the token a client obtains from a backend in order to join
+// a server. It holds the public information the client needs, and a private
+// part, sealed with the private key shared by the backend and the servers,
+// that only servers can read.
+type ConnectToken struct {
+	ExpireTime        time.Time      // time after which servers reject the token
+	ServerAddresses   []*net.UDPAddr // servers the token is valid for
+	ClientToServerKey Key            // key sealing packets sent by the client
+	ServerToClientKey Key            // key sealing packets sent by the server
+
+	nonce   [tokenNonceSize]byte
+	private []byte // sealed private token
+}
+
+// privateToken is the part of the connect token only readable by servers.
+type privateToken struct {
+	clientID          uint64
+	serverAddresses   []*net.UDPAddr
+	clientToServerKey Key
+	serverToClientKey Key
+	userData          []byte
+}
+
+// TokenIssuer issues connect tokens for the servers sharing its private key.
+// It is meant to run in the backend, or in process for tests.
+type TokenIssuer struct {
+	protocolID uint
+	privateKey Key
+}
+
+// NewTokenIssuer returns a token issuer for the given protocol id and private
+// key.
+func NewTokenIssuer(protocolID uint, privateKey Key) *TokenIssuer {
+	return &TokenIssuer{
+		protocolID: protocolID,
+		privateKey: privateKey,
+	}
+}
+
+// Issue returns a new connect token, valid for expiry, allowing the client
+// clientID to join one of servers. userData is handed to the server the
+// client connects to.
+func (ti *TokenIssuer) Issue(clientID uint64, servers []*net.UDPAddr, expiry time.Duration, userData []byte) (*ConnectToken, error) {
+	if len(servers) == 0 || len(servers) > MaxTokenServers {
+		return nil, errors.New("connect token needs 1 to MaxTokenServers server addresses")
+	}
+	if len(userData) > MaxUserDataSize {
+		return nil, errors.New("connect token user data is larger than MaxUserDataSize")
+	}
+	token := &ConnectToken{
+		ExpireTime:      time.Now().Add(expiry),
+		ServerAddresses: servers,
+	}
+	var err error
+	if token.ClientToServerKey, err = GenerateKey(); err != nil {
+		return nil, err
+	}
+	if token.ServerToClientKey, err = GenerateKey(); err != nil {
+		return nil, err
+	}
+	if _, err = rand.Read(token.nonce[:]); err != nil {
+		return nil, err
+	}
+
+	pt := privateToken{
+		clientID:          clientID,
+		serverAddresses:   servers,
+		clientToServerKey: token.ClientToServerKey,
+		serverToClientKey: token.ServerToClientKey,
+		userData:          userData,
+	}
+	aead, err := newAEAD(ti.privateKey)
+	if err != nil {
+		return nil, err
+	}
+	ad := tokenAdditionalData(ti.protocolID, token.ExpireTime)
+	token.private = aead.Seal(nil, token.nonce[:], pt.marshal(), ad)
+	return token, nil
+}
+
+// MarshalBinary encodes the token in order to send it to the client.
+func (t *ConnectToken) MarshalBinary() ([]byte, error) {
+	if len(t.ServerAddresses) == 0 || len(t.ServerAddresses) > MaxTokenServers {
+		return nil, errors.New("connect token needs 1 to MaxTokenServers server addresses")
+	}
+	buf := make([]byte, 0, 8+tokenNonceSize+1+len(t.ServerAddresses)*addressSize+2*KeySize+2+len(t.private))
+	buf = appendUint64(buf, uint64(t.ExpireTime.UnixNano()))
+	buf = append(buf, t.nonce[:]...)
+	buf = appendAddresses(buf, t.ServerAddresses)
+	buf = append(buf, t.ClientToServerKey[:]...)
+	buf = append(buf, t.ServerToClientKey[:]...)
+	buf = appendUint16(buf, uint16(len(t.private)))
+	buf = append(buf, t.private...)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a token encoded with MarshalBinary.
+func (t *ConnectToken) UnmarshalBinary(data []byte) error {
+	errInvalid := errors.New("invalid connect token")
+	if len(data) < 8+tokenNonceSize {
+		return errInvalid
+	}
+	t.ExpireTime = time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	copy(t.nonce[:], data[8:])
+	data = data[8+tokenNonceSize:]
+	var n int
+	t.ServerAddresses, n = readAddresses(data)
+	if n == 0 || len(data) < n+2*KeySize+2 {
+		return errInvalid
+	}
+	data = data[n:]
+	copy(t.ClientToServerKey[:], data)
+	copy(t.ServerToClientKey[:], data[KeySize:])
+	data = data[2*KeySize:]
+	size := int(binary.BigEndian.Uint16(data))
+	if size > maxPrivateToken || len(data) != 2+size {
+		return errInvalid
+	}
+	t.private = append([]byte(nil), data[2:]...)
+	return nil
+}
+
+// openPrivateToken decrypts a sealed private token and checks it hasn't
+// expired.
+func openPrivateToken(protocolID uint, key Key, expire time.Time, nonce, sealed []byte) (*privateToken, error) {
+	if !time.Now().Before(expire) {
+		return nil, errors.New("connect token expired")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, nonce, sealed, tokenAdditionalData(protocolID, expire))
+	if err != nil {
+		return nil, err
+	}
+	var pt privateToken
+	if !pt.unmarshal(plain) {
+		return nil, errors.New("invalid private connect token")
+	}
+	return &pt, nil
+}
+
+func (pt *privateToken) marshal() []byte {
+	buf := make([]byte, 0, maxPrivateToken)
+	buf = appendUint64(buf, pt.clientID)
+	buf = appendAddresses(buf, pt.serverAddresses)
+	buf = append(buf, pt.clientToServerKey[:]...)
+	buf = append(buf, pt.serverToClientKey[:]...)
+	buf = appendUint16(buf, uint16(len(pt.userData)))
+	return append(buf, pt.userData...)
+}
+
+func (pt *privateToken) unmarshal(data []byte) bool {
+	if len(data) < 8 {
+		return false
+	}
+	pt.clientID = binary.BigEndian.Uint64(data)
+	data = data[8:]
+	var n int
+	pt.serverAddresses, n = readAddresses(data)
+	if n == 0 || len(data) < n+2*KeySize+2 {
+		return false
+	}
+	data = data[n:]
+	copy(pt.clientToServerKey[:], data)
+	copy(pt.serverToClientKey[:], data[KeySize:])
+	data = data[2*KeySize:]
+	size := int(binary.BigEndian.Uint16(data))
+	if size > MaxUserDataSize || len(data) != 2+size {
+		return false
+	}
+	pt.userData = append([]byte(nil), data[2:]...)
+	return true
+}
+
+// hasAddress indicates if the token is valid for the server at addr. A
+// server bound to the unspecified address is reachable at any address on its
+// port.
+func (pt *privateToken) hasAddress(addr *net.UDPAddr) bool {
+	for _, a := range pt.serverAddresses {
+		if (addr.IP.IsUnspecified() || a.IP.Equal(addr.IP)) && a.Port == addr.Port {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenAdditionalData(protocolID uint, expire time.Time) []byte {
+	var ad [12]byte
+	binary.BigEndian.PutUint32(ad[:], uint32(protocolID))
+	binary.BigEndian.PutUint64(ad[4:], uint64(expire.UnixNano()))
+	return ad[:]
+}
+
+func appendAddresses(buf []byte, addrs []*net.UDPAddr) []byte {
+	buf = append(buf, byte(len(addrs)))
+	for _, a := range addrs {
+		buf = append(buf, a.IP.To16()...)
+		buf = appendUint16(buf, uint16(a.Port))
+	}
+	return buf
+}
+
+// readAddresses reads addresses written by appendAddresses and returns the
+// number of bytes read, or 0 if data is invalid.
+func readAddresses(data []byte) ([]*net.UDPAddr, int) {
+	if len(data) < 1 {
+		return nil, 0
+	}
+	count := int(data[0])
+	if count == 0 || count > MaxTokenServers || len(data) < 1+count*addressSize {
+		return nil, 0
+	}
+	addrs := make([]*net.UDPAddr, count)
+	for i := range addrs {
+		a := data[1+i*addressSize:]
+		addrs[i] = &net.UDPAddr{
+			IP:   append(net.IP(nil), a[:16]...),
+			Port: int(binary.BigEndian.Uint16(a[16:])),
+		}
+	}
+	return addrs, 1 + count*addressSize
+}
+
+func newAEAD(key Key) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// packetNonce returns the nonce used to seal the packet with given sequence.
+func packetNonce(sequence uint64) []byte {
+	var nonce [tokenNonceSize]byte
+	binary.BigEndian.PutUint64(nonce[4:], sequence)
+	return nonce[:]
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return append(buf, b[:]...)
+}
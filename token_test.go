@@ -0,0 +1,288 @@
+package udpnet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectToken(t *testing.T) {
+	key, err := GenerateKey()
+	require.NoError(t, err)
+	issuer := NewTokenIssuer(protocolID, key)
+
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	userData := []byte("user data")
+	token, err := issuer.Issue(42, []*net.UDPAddr{sAddr}, time.Minute, userData)
+	require.NoError(t, err)
+
+	t.Logf("check marshal/unmarshal\n")
+	buf, err := token.MarshalBinary()
+	require.NoError(t, err)
+	var decoded ConnectToken
+	require.NoError(t, decoded.UnmarshalBinary(buf))
+	assert.True(t, token.ExpireTime.Equal(decoded.ExpireTime))
+	assert.Equal(t, token.ClientToServerKey, decoded.ClientToServerKey)
+	assert.Equal(t, token.ServerToClientKey, decoded.ServerToClientKey)
+	assert.Len(t, decoded.ServerAddresses, 1)
+	assert.Equal(t, sAddr.String(), decoded.ServerAddresses[0].String())
+	assert.Error(t, decoded.UnmarshalBinary(buf[:len(buf)-1]))
+
+	t.Logf("check private token\n")
+	pt, err := openPrivateToken(protocolID, key, token.ExpireTime, token.nonce[:], token.private)
+	require.NoError(t, err)
+	assert.EqualValues(t, 42, pt.clientID)
+	assert.Equal(t, userData, pt.userData)
+	assert.Equal(t, token.ClientToServerKey, pt.clientToServerKey)
+	assert.True(t, pt.hasAddress(sAddr))
+	assert.True(t, pt.hasAddress(&net.UDPAddr{IP: net.IPv4zero, Port: sAddr.Port}), "servers bound to any address should accept the token")
+	assert.False(t, pt.hasAddress(&net.UDPAddr{IP: net.IPv4zero, Port: sAddr.Port + 1}))
+
+	t.Logf("check tampered private token is rejected\n")
+	_, err = openPrivateToken(protocolID+1, key, token.ExpireTime, token.nonce[:], token.private)
+	assert.Error(t, err)
+	_, err = openPrivateToken(protocolID, key, token.ExpireTime.Add(time.Hour), token.nonce[:], token.private)
+	assert.Error(t, err)
+	other, _ := GenerateKey()
+	_, err = openPrivateToken(protocolID, other, token.ExpireTime, token.nonce[:], token.private)
+	assert.Error(t, err)
+
+	t.Logf("check expired token is rejected\n")
+	expired, err := issuer.Issue(42, []*net.UDPAddr{sAddr}, -time.Second, nil)
+	require.NoError(t, err)
+	_, err = openPrivateToken(protocolID, key, expired.ExpireTime, expired.nonce[:], expired.private)
+	assert.Error(t, err)
+
+	t.Logf("check invalid issue parameters\n")
+	_, err = issuer.Issue(42, nil, time.Minute, nil)
+	assert.Error(t, err)
+	_, err = issuer.Issue(42, []*net.UDPAddr{sAddr}, time.Minute, make([]byte, MaxUserDataSize+1))
+	assert.Error(t, err)
+}
+
+func TestConnectTokenJoin(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(100) * time.Millisecond
+	)
+
+	key, err := GenerateKey()
+	require.NoError(t, err)
+	issuer := NewTokenIssuer(protocolID, key)
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	token, err := issuer.Issue(42, []*net.UDPAddr{sAddr}, time.Minute, []byte("user data"))
+	require.NoError(t, err)
+
+	client := NewConn(dummyCallback{}, protocolID, TimeOut)
+	require.True(t, client.Start(clientPort), "couldn't start client connection")
+	defer client.Stop()
+
+	server := NewConn(dummyCallback{}, protocolID, TimeOut)
+	server.SetPrivateKey(key)
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+
+	require.NoError(t, client.ConnectWithToken(token))
+	server.Listen()
+
+	updateConns(DeltaTime, 1000, func() bool {
+		return client.IsConnected() && server.IsConnected()
+	}, nil, client, server)
+
+	assert.True(t, client.IsConnected(), "client should be connected")
+	assert.True(t, server.IsConnected(), "server should be connected")
+	assert.EqualValues(t, 42, server.ClientID())
+	assert.EqualValues(t, 42, client.ClientID())
+	assert.Equal(t, []byte("user data"), server.UserData())
+	assert.Equal(t, 5+sessionIDSize+sealedOverhead, client.HeaderSize())
+	assert.Equal(t, 5+sealedOverhead, server.HeaderSize())
+
+	var clientReceived, serverReceived bool
+	for i := 0; i < 100 && !(clientReceived && serverReceived); i++ {
+		require.NoError(t, client.SendPacket(clientPacket))
+		require.NoError(t, server.SendPacket(serverPacket))
+		for {
+			var packet [256]byte
+			n := client.ReceivePacket(packet[:])
+			if n == 0 {
+				break
+			}
+			assert.Equal(t, string(serverPacket), string(packet[:n]))
+			clientReceived = true
+		}
+		for {
+			var packet [256]byte
+			n := server.ReceivePacket(packet[:])
+			if n == 0 {
+				break
+			}
+			assert.Equal(t, string(clientPacket), string(packet[:n]))
+			serverReceived = true
+		}
+		client.Update(DeltaTime)
+		server.Update(DeltaTime)
+	}
+	assert.True(t, clientReceived, "client should receive sealed payload")
+	assert.True(t, serverReceived, "server should receive sealed payload")
+}
+
+func TestConnectTokenDenied(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(100) * time.Millisecond
+	)
+
+	key, err := GenerateKey()
+	require.NoError(t, err)
+	issuer := NewTokenIssuer(protocolID, key)
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	otherAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort+10))
+	otherKey, err := GenerateKey()
+	require.NoError(t, err)
+
+	expired, err := issuer.Issue(1, []*net.UDPAddr{sAddr}, -time.Second, nil)
+	require.NoError(t, err)
+	wrongServer, err := issuer.Issue(2, []*net.UDPAddr{otherAddr}, time.Minute, nil)
+	require.NoError(t, err)
+	wrongKey, err := NewTokenIssuer(protocolID, otherKey).Issue(3, []*net.UDPAddr{sAddr}, time.Minute, nil)
+	require.NoError(t, err)
+
+	server := NewConn(dummyCallback{}, protocolID, TimeOut)
+	server.SetPrivateKey(key)
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+	server.Listen()
+
+	client := NewConn(dummyCallback{}, protocolID, TimeOut)
+	require.True(t, client.Start(clientPort), "couldn't start client connection")
+	defer client.Stop()
+
+	for _, tt := range []struct {
+		name   string
+		token  *ConnectToken
+		reason DenyReason
+	}{
+		// the server can't open these tokens, nor seal its denials: clients
+		// holding a token drop unsealed denials and time out
+		{"expired token", expired, DenyNone},
+		{"wrong server", wrongServer, DenyNone},
+		{"wrong private key", wrongKey, DenyNone},
+		{"no token", nil, DenyInvalidToken},
+	} {
+		t.Logf("check %s is denied\n", tt.name)
+		if tt.token != nil {
+			require.NoError(t, client.ConnectWithToken(tt.token))
+		} else {
+			client.Connect(sAddr)
+		}
+		updateConns(DeltaTime, 1000, func() bool {
+			return !client.IsConnecting()
+		}, nil, client, server)
+		assert.True(t, client.ConnectFailed(), "client.ConnectFailed() should return true")
+		assert.False(t, server.IsConnected(), "server should not be connected")
+		assert.Equal(t, tt.reason, client.DenyReason())
+	}
+
+	t.Logf("check token reused from another address is denied\n")
+	token, err := issuer.Issue(4, []*net.UDPAddr{sAddr}, time.Minute, nil)
+	require.NoError(t, err)
+	require.NoError(t, client.ConnectWithToken(token))
+	updateConns(DeltaTime, 1000, func() bool {
+		return client.IsConnected() && server.IsConnected()
+	}, nil, client, server)
+	require.True(t, server.IsConnected(), "server should be connected")
+
+	// let the first client time out, then present its token from another port
+	client.Stop()
+	updateConns(DeltaTime, 1000, func() bool {
+		return !server.IsConnected()
+	}, nil, server)
+
+	thief := NewConn(dummyCallback{}, protocolID, TimeOut)
+	require.True(t, thief.Start(clientPort+1), "couldn't start thief connection")
+	defer thief.Stop()
+	require.NoError(t, thief.ConnectWithToken(token))
+	updateConns(DeltaTime, 1000, func() bool {
+		return !thief.IsConnecting()
+	}, nil, thief, server)
+	assert.True(t, thief.ConnectFailed(), "thief.ConnectFailed() should return true")
+	assert.False(t, server.IsConnected(), "server should not be connected")
+	assert.Equal(t, DenyInvalidToken, thief.DenyReason())
+}
+
+func TestConnectTokenNextServer(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(100) * time.Millisecond
+	)
+
+	key, err := GenerateKey()
+	require.NoError(t, err)
+	deadAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort+10))
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+	token, err := NewTokenIssuer(protocolID, key).Issue(42, []*net.UDPAddr{deadAddr, sAddr}, time.Minute, nil)
+	require.NoError(t, err)
+
+	client := NewConn(dummyCallback{}, protocolID, TimeOut)
+	require.True(t, client.Start(clientPort), "couldn't start client connection")
+	defer client.Stop()
+
+	server := NewConn(dummyCallback{}, protocolID, TimeOut)
+	server.SetPrivateKey(key)
+	require.True(t, server.Start(serverPort), "couldn't start server connection")
+	defer server.Stop()
+
+	require.NoError(t, client.ConnectWithToken(token))
+	server.Listen()
+
+	updateConns(DeltaTime, 1000, func() bool {
+		return client.IsConnected() && server.IsConnected()
+	}, nil, client, server)
+
+	assert.True(t, client.IsConnected(), "client should be connected to the second server")
+	assert.True(t, server.IsConnected(), "server should be connected")
+}
+
+func TestSessionReplay(t *testing.T) {
+	k1, err := GenerateKey()
+	require.NoError(t, err)
+	k2, err := GenerateKey()
+	require.NoError(t, err)
+	sender, err := newSession(k1, k2)
+	require.NoError(t, err)
+	receiver, err := newSession(k2, k1)
+	require.NoError(t, err)
+
+	ad := []byte("ad")
+	var sealed [][]byte
+	for i := 0; i < replayWindowSize+10; i++ {
+		sealed = append(sealed, sender.seal(nil, ad, []byte{byte(i)}))
+	}
+
+	t.Logf("check packets are opened once\n")
+	body, ok := receiver.open(ad, sealed[1])
+	require.True(t, ok)
+	assert.Equal(t, []byte{1}, body)
+	_, ok = receiver.open(ad, sealed[1])
+	assert.False(t, ok, "duplicated packet should be rejected")
+
+	t.Logf("check late packets within the window are opened\n")
+	_, fresh, ok := receiver.openFresh(ad, sealed[0])
+	assert.True(t, ok, "late packet should be opened")
+	assert.False(t, fresh, "late packet should not be fresh")
+	_, fresh, ok = receiver.openFresh(ad, sealed[5])
+	assert.True(t, ok)
+	assert.True(t, fresh)
+
+	t.Logf("check packets older than the window are rejected\n")
+	_, ok = receiver.open(ad, sealed[replayWindowSize+5])
+	require.True(t, ok)
+	_, ok = receiver.open(ad, sealed[4])
+	assert.False(t, ok, "packet older than the window should be rejected")
+	_, ok = receiver.open(ad, sealed[6])
+	assert.True(t, ok, "packet at the edge of the window should be opened")
+}
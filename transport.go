@@ -0,0 +1,315 @@
+package udpnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Transport sends and receives datagrams. Socket is the UDP implementation,
+// MemNetwork provides in-process transports, optionally behind simulated
+// NATs, for local tests.
+type Transport interface {
+	// Send writes the data buffer on addr.
+	Send(addr *net.UDPAddr, data []byte) error
+
+	// Receive receives a datagram, without blocking, sets addr to its sender
+	// and returns its size, or 0 if there is none.
+	Receive(addr *net.UDPAddr, data []byte) int
+
+	// LocalAddr returns the local address of the transport.
+	LocalAddr() *net.UDPAddr
+
+	// Close closes the transport.
+	Close()
+}
+
+var _ Transport = (*Socket)(nil)
+
+// NATType indicates how a simulated NAT maps and filters packets.
+type NATType int
+
+const (
+	// FullConeNAT maps each private endpoint to a single public port and
+	// lets in packets from anyone.
+	FullConeNAT NATType = iota
+
+	// RestrictedConeNAT maps each private endpoint to a single public port
+	// and lets in packets from the IPs the endpoint sent packets to.
+	RestrictedConeNAT
+
+	// PortRestrictedNAT maps each private endpoint to a single public port
+	// and lets in packets from the IP and port pairs the endpoint sent
+	// packets to.
+	PortRestrictedNAT
+
+	// SymmetricNAT maps each private endpoint and destination pair to a
+	// different public port, and only lets in packets from that destination.
+	// Hole punching doesn't get through symmetric NATs.
+	SymmetricNAT
+)
+
+func (t NATType) String() string {
+	switch t {
+	case FullConeNAT:
+		return "full cone"
+	case RestrictedConeNAT:
+		return "restricted cone"
+	case PortRestrictedNAT:
+		return "port restricted"
+	case SymmetricNAT:
+		return "symmetric"
+	}
+	return fmt.Sprintf("unknown NAT type %d", int(t))
+}
+
+// firstNATPort is the first public port a simulated NAT allocates.
+const firstNATPort = 40000
+
+// memQueueSize is the number of datagrams a MemTransport queues, like a
+// socket receive buffer, datagrams arriving on a full queue are dropped.
+const memQueueSize = 1024
+
+// datagram is a packet queued on an in-process transport.
+type datagram struct {
+	from net.UDPAddr
+	data []byte
+}
+
+// MemNetwork is an in-process network of transports. Transports are either
+// directly reachable, or behind a simulated NAT. It is safe for concurrent
+// use.
+type MemNetwork struct {
+	mu        sync.Mutex
+	endpoints map[string]*MemTransport // directly reachable transports, by address
+	nats      map[string]*NAT          // NATs, by public IP
+}
+
+// NAT is a simulated NAT of a MemNetwork, the transports behind it share a
+// private network and its public IP.
+type NAT struct {
+	network   *MemNetwork
+	kind      NATType
+	publicIP  net.IP
+	endpoints map[string]*MemTransport // transports behind the NAT, by private address
+	mappings  map[int]*natMapping      // mappings, by public port
+	nextPort  int
+}
+
+// natMapping is a public port of a NAT, mapped to a private endpoint.
+type natMapping struct {
+	private     string          // private address
+	destination string          // symmetric NAT: the only destination of the mapping
+	allowed     map[string]bool // addresses (or IPs) packets are let in from
+}
+
+// MemTransport is an in-process Transport of a MemNetwork.
+type MemTransport struct {
+	network *MemNetwork
+	nat     *NAT // NAT the transport is behind, if any
+	addr    *net.UDPAddr
+	queue   []datagram
+	dropped uint64 // datagrams dropped on a full queue
+}
+
+// NewMemNetwork returns an empty in-process network.
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		endpoints: make(map[string]*MemTransport),
+		nats:      make(map[string]*NAT),
+	}
+}
+
+// Listen returns a transport directly reachable at addr.
+func (n *MemNetwork) Listen(addr *net.UDPAddr) (*MemTransport, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.endpoints[addr.String()]; ok {
+		return nil, fmt.Errorf("address %v already in use", addr)
+	}
+	if _, ok := n.nats[addr.IP.String()]; ok {
+		return nil, fmt.Errorf("address %v is the public IP of a NAT", addr)
+	}
+	t := &MemTransport{network: n, addr: copyAddr(addr)}
+	n.endpoints[addr.String()] = t
+	return t, nil
+}
+
+// AddNAT adds a NAT of given type, with given public IP.
+func (n *MemNetwork) AddNAT(publicIP net.IP, kind NATType) (*NAT, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.nats[publicIP.String()]; ok {
+		return nil, fmt.Errorf("NAT with public IP %v already exists", publicIP)
+	}
+	nat := &NAT{
+		network:   n,
+		kind:      kind,
+		publicIP:  append(net.IP(nil), publicIP...),
+		endpoints: make(map[string]*MemTransport),
+		mappings:  make(map[int]*natMapping),
+		nextPort:  firstNATPort,
+	}
+	n.nats[publicIP.String()] = nat
+	return nat, nil
+}
+
+// Listen returns a transport behind the NAT, at privateAddr on the NAT
+// private network.
+func (nat *NAT) Listen(privateAddr *net.UDPAddr) (*MemTransport, error) {
+	nat.network.mu.Lock()
+	defer nat.network.mu.Unlock()
+	if _, ok := nat.endpoints[privateAddr.String()]; ok {
+		return nil, fmt.Errorf("address %v already in use", privateAddr)
+	}
+	t := &MemTransport{network: nat.network, nat: nat, addr: copyAddr(privateAddr)}
+	nat.endpoints[privateAddr.String()] = t
+	return t, nil
+}
+
+// Type returns the NAT type.
+func (nat *NAT) Type() NATType {
+	return nat.kind
+}
+
+// outbound returns the public address a packet from private to dst leaves
+// the NAT with, and lets in the replies from dst.
+func (nat *NAT) outbound(private, dst *net.UDPAddr) *net.UDPAddr {
+	var port int
+	for p, m := range nat.mappings {
+		if m.private == private.String() && (nat.kind != SymmetricNAT || m.destination == dst.String()) {
+			port = p
+			break
+		}
+	}
+	if port == 0 {
+		port = nat.nextPort
+		nat.nextPort++
+		m := &natMapping{private: private.String(), allowed: make(map[string]bool)}
+		if nat.kind == SymmetricNAT {
+			m.destination = dst.String()
+		}
+		nat.mappings[port] = m
+	}
+	m := nat.mappings[port]
+	switch nat.kind {
+	case RestrictedConeNAT:
+		m.allowed[dst.IP.String()] = true
+	case PortRestrictedNAT, SymmetricNAT:
+		m.allowed[dst.String()] = true
+	}
+	return &net.UDPAddr{IP: nat.publicIP, Port: port}
+}
+
+// inbound returns the private transport a packet from src to the NAT public
+// port is let in to, or nil if the NAT drops it.
+func (nat *NAT) inbound(src *net.UDPAddr, port int) *MemTransport {
+	m, ok := nat.mappings[port]
+	if !ok {
+		return nil
+	}
+	switch nat.kind {
+	case RestrictedConeNAT:
+		if !m.allowed[src.IP.String()] {
+			return nil
+		}
+	case PortRestrictedNAT, SymmetricNAT:
+		if !m.allowed[src.String()] {
+			return nil
+		}
+	}
+	return nat.endpoints[m.private]
+}
+
+// Send writes the data buffer on addr. Packets to unknown addresses, or
+// dropped by a NAT, are silently lost.
+func (t *MemTransport) Send(addr *net.UDPAddr, data []byte) error {
+	n := t.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if t.addr == nil {
+		return errors.New("MemTransport.Send: transport closed")
+	}
+	src := t.addr
+	if t.nat != nil {
+		if dst, ok := t.nat.endpoints[addr.String()]; ok {
+			// same private network
+			dst.push(src, data)
+			return nil
+		}
+		src = t.nat.outbound(t.addr, addr)
+	}
+	if nat, ok := n.nats[addr.IP.String()]; ok {
+		if dst := nat.inbound(src, addr.Port); dst != nil {
+			dst.push(src, data)
+		}
+		return nil
+	}
+	if dst, ok := n.endpoints[addr.String()]; ok {
+		dst.push(src, data)
+	}
+	return nil
+}
+
+// Receive receives a datagram, sets addr to its sender and returns its size,
+// or 0 if there is none.
+func (t *MemTransport) Receive(addr *net.UDPAddr, data []byte) int {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	if len(t.queue) == 0 {
+		return 0
+	}
+	d := t.queue[0]
+	t.queue = t.queue[1:]
+	*addr = d.from
+	return copy(data, d.data)
+}
+
+// LocalAddr returns the address of the transport, its private address if it
+// is behind a NAT, or nil if it is closed.
+func (t *MemTransport) LocalAddr() *net.UDPAddr {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	return t.addr
+}
+
+// Dropped returns the number of datagrams dropped because the transport
+// queue was full.
+func (t *MemTransport) Dropped() uint64 {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	return t.dropped
+}
+
+// Close closes the transport, pending datagrams are dropped.
+func (t *MemTransport) Close() {
+	n := t.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if t.addr == nil {
+		return
+	}
+	if t.nat != nil {
+		delete(t.nat.endpoints, t.addr.String())
+	} else {
+		delete(n.endpoints, t.addr.String())
+	}
+	t.addr = nil
+	t.queue = nil
+}
+
+func (t *MemTransport) push(from *net.UDPAddr, data []byte) {
+	if len(t.queue) >= memQueueSize {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, datagram{
+		from: *copyAddr(from),
+		data: append([]byte(nil), data...),
+	})
+}
+
+func copyAddr(addr *net.UDPAddr) *net.UDPAddr {
+	return &net.UDPAddr{IP: append(net.IP(nil), addr.IP...), Port: addr.Port, Zone: addr.Zone}
+}
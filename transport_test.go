@@ -0,0 +1,143 @@
+package udpnet
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receiveFrom returns the next datagram received by t, and its sender.
+func receiveFrom(t Transport) (string, *net.UDPAddr) {
+	var (
+		sender net.UDPAddr
+		buf    [256]byte
+	)
+	n := t.Receive(&sender, buf[:])
+	if n == 0 {
+		return "", nil
+	}
+	return string(buf[:n]), &sender
+}
+
+func TestMemNetwork(t *testing.T) {
+	network := NewMemNetwork()
+	aAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	bAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000}
+	a, err := network.Listen(aAddr)
+	require.NoError(t, err)
+	b, err := network.Listen(bAddr)
+	require.NoError(t, err)
+	_, err = network.Listen(aAddr)
+	assert.Error(t, err, "address should be in use")
+
+	require.NoError(t, a.Send(bAddr, []byte("hello")))
+	data, from := receiveFrom(b)
+	assert.Equal(t, "hello", data)
+	assert.Equal(t, aAddr.String(), from.String())
+	data, _ = receiveFrom(b)
+	assert.Empty(t, data)
+
+	// packets to unknown addresses are lost
+	assert.NoError(t, a.Send(&net.UDPAddr{IP: net.ParseIP("10.0.0.3"), Port: 1000}, []byte("lost")))
+
+	// datagrams arriving on a full queue are dropped
+	for i := 0; i < memQueueSize+10; i++ {
+		require.NoError(t, a.Send(bAddr, []byte("flood")))
+	}
+	assert.EqualValues(t, 10, b.Dropped())
+	var received int
+	for {
+		data, _ := receiveFrom(b)
+		if data == "" {
+			break
+		}
+		received++
+	}
+	assert.Equal(t, memQueueSize, received)
+
+	b.Close()
+	assert.Nil(t, b.LocalAddr())
+	assert.Error(t, b.Send(aAddr, []byte("closed")))
+	var _ Transport = a
+}
+
+func TestNATFiltering(t *testing.T) {
+	server := &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 1000}
+	other := &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 2000}
+	stranger := &net.UDPAddr{IP: net.ParseIP("2.2.2.2"), Port: 1000}
+	private := &net.UDPAddr{IP: net.ParseIP("192.168.0.2"), Port: 5000}
+
+	var tests = []struct {
+		kind                        NATType
+		fromOther, fromStranger     bool // packets let in after contacting server
+		samePortForOtherDestination bool
+	}{
+		{FullConeNAT, true, true, true},
+		{RestrictedConeNAT, true, false, true},
+		{PortRestrictedNAT, false, false, true},
+		{SymmetricNAT, false, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Logf("check %v NAT\n", tt.kind)
+		network := NewMemNetwork()
+		s, err := network.Listen(server)
+		require.NoError(t, err)
+		o, err := network.Listen(other)
+		require.NoError(t, err)
+		x, err := network.Listen(stranger)
+		require.NoError(t, err)
+		nat, err := network.AddNAT(net.ParseIP("3.3.3.3"), tt.kind)
+		require.NoError(t, err)
+		assert.Equal(t, tt.kind, nat.Type())
+		c, err := nat.Listen(private)
+		require.NoError(t, err)
+
+		// nothing gets in before the host behind the NAT sends a packet
+		public := &net.UDPAddr{IP: net.ParseIP("3.3.3.3"), Port: firstNATPort}
+		require.NoError(t, x.Send(public, []byte("unsolicited")))
+		data, _ := receiveFrom(c)
+		assert.Empty(t, data)
+
+		require.NoError(t, c.Send(server, []byte("out")))
+		data, from := receiveFrom(s)
+		require.Equal(t, "out", data)
+		assert.Equal(t, public.String(), from.String())
+
+		require.NoError(t, s.Send(from, []byte("reply")))
+		data, _ = receiveFrom(c)
+		assert.Equal(t, "reply", data, "replies should get in")
+
+		require.NoError(t, o.Send(from, []byte("other")))
+		data, _ = receiveFrom(c)
+		assert.Equal(t, tt.fromOther, data == "other")
+
+		require.NoError(t, x.Send(from, []byte("stranger")))
+		data, _ = receiveFrom(c)
+		assert.Equal(t, tt.fromStranger, data == "stranger")
+
+		require.NoError(t, c.Send(other, []byte("out")))
+		_, from2 := receiveFrom(o)
+		require.NotNil(t, from2)
+		assert.Equal(t, tt.samePortForOtherDestination, from.Port == from2.Port)
+	}
+}
+
+func TestNATPrivateNetwork(t *testing.T) {
+	network := NewMemNetwork()
+	nat, err := network.AddNAT(net.ParseIP("3.3.3.3"), SymmetricNAT)
+	require.NoError(t, err)
+	aAddr := &net.UDPAddr{IP: net.ParseIP("192.168.0.2"), Port: 5000}
+	bAddr := &net.UDPAddr{IP: net.ParseIP("192.168.0.3"), Port: 5000}
+	a, err := nat.Listen(aAddr)
+	require.NoError(t, err)
+	b, err := nat.Listen(bAddr)
+	require.NoError(t, err)
+
+	require.NoError(t, a.Send(bAddr, []byte("lan")))
+	data, from := receiveFrom(b)
+	assert.Equal(t, "lan", data)
+	assert.Equal(t, aAddr.String(), from.String(), "hosts behind the same NAT should see private addresses")
+}
@@ -0,0 +1,338 @@
+package udpnet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// MaxNATPayloadSize is the maximum size of the payloads exchanged by peers
+// through a Traversal.
+const MaxNATPayloadSize = 1024
+
+const (
+	// registerInterval is the interval between two registrations on the
+	// introducer, they also keep the NAT mapping to the introducer open.
+	registerInterval = 100 * time.Millisecond
+
+	// punchInterval is the interval between two punches to a peer.
+	punchInterval = 20 * time.Millisecond
+
+	// natKeepAliveInterval is the interval between two punches to a peer
+	// reached directly, keeping the hole open.
+	natKeepAliveInterval = time.Second
+
+	// defaultPunchTimeout is the default time given to hole punching before
+	// falling back to the relay.
+	defaultPunchTimeout = time.Second
+)
+
+// Route indicates how a peer is reached.
+type Route int
+
+const (
+	// RoutePending indicates holes are being punched to the peer.
+	RoutePending Route = iota
+
+	// RouteDirect indicates the peer is reached directly.
+	RouteDirect
+
+	// RouteRelay indicates hole punching failed, packets to the peer are
+	// relayed by the introducer.
+	RouteRelay
+)
+
+func (r Route) String() string {
+	switch r {
+	case RoutePending:
+		return "pending"
+	case RouteDirect:
+		return "direct"
+	case RouteRelay:
+		return "relay"
+	}
+	return fmt.Sprintf("unknown route %d", int(r))
+}
+
+// remotePeer is a peer of the session, as known by a Traversal.
+type remotePeer struct {
+	id      uint64
+	public  *net.UDPAddr // address the introducer sees the peer at
+	private *net.UDPAddr // address the peer is bound to
+	direct  *net.UDPAddr // address the peer answered a punch from
+	route   Route
+	age     time.Duration // time since hole punching started
+	punch   time.Duration // time left before the next punch
+}
+
+// Traversal connects a peer to the other peers of a session through their
+// NATs. It registers on an introducer, which tells it the public and private
+// addresses of the other peers, then punches holes to both addresses at the
+// same time the other peers do. Peers that couldn't be reached before the
+// punch timeout are reached through the introducer.
+type Traversal struct {
+	protocolID   uint
+	transport    Transport
+	introducer   *net.UDPAddr
+	session      uint64
+	id           uint64
+	public       *net.UDPAddr // address the introducer sees us at
+	peers        []*remotePeer
+	register     time.Duration // time left before the next registration
+	punchTimeout time.Duration
+}
+
+// NewTraversal returns a Traversal registering the peer id in the session,
+// on the introducer at addr.
+func NewTraversal(protocolID uint, transport Transport, introducer *net.UDPAddr, session, id uint64) *Traversal {
+	return &Traversal{
+		protocolID:   protocolID,
+		transport:    transport,
+		introducer:   introducer,
+		session:      session,
+		id:           id,
+		punchTimeout: defaultPunchTimeout,
+	}
+}
+
+// SetPunchTimeout sets the time given to hole punching before falling back to
+// the relay, 1 second by default.
+func (t *Traversal) SetPunchTimeout(timeout time.Duration) {
+	t.punchTimeout = timeout
+}
+
+// PublicAddr returns the address the introducer sees us at, or nil before
+// the introducer answered.
+func (t *Traversal) PublicAddr() *net.UDPAddr {
+	return t.public
+}
+
+// Peers returns the ids of the peers introduced so far.
+func (t *Traversal) Peers() []uint64 {
+	ids := make([]uint64, len(t.peers))
+	for i, p := range t.peers {
+		ids[i] = p.id
+	}
+	return ids
+}
+
+// Route returns how a peer is reached, false if the peer is unknown.
+func (t *Traversal) Route(id uint64) (Route, bool) {
+	if p := t.peer(id); p != nil {
+		return p.route, true
+	}
+	return RoutePending, false
+}
+
+// PeerAddr returns the address a peer is reached at directly, or nil.
+func (t *Traversal) PeerAddr(id uint64) *net.UDPAddr {
+	if p := t.peer(id); p != nil && p.route == RouteDirect {
+		return p.direct
+	}
+	return nil
+}
+
+// Update registers on the introducer and punches holes to the peers.
+func (t *Traversal) Update(dt time.Duration) {
+	t.register -= dt
+	if t.register <= 0 {
+		t.sendRegister()
+		t.register = registerInterval
+	}
+	for _, p := range t.peers {
+		p.punch -= dt
+		switch p.route {
+		case RoutePending:
+			p.age += dt
+			if p.age > t.punchTimeout {
+				fmt.Printf("couldn't punch through to peer %d, relaying\n", p.id)
+				p.route = RouteRelay
+				continue
+			}
+			if p.punch <= 0 {
+				t.sendPunch(p.public, natPunchPacket, p.id)
+				if p.private != nil && !sameAddress(p.private, p.public) {
+					t.sendPunch(p.private, natPunchPacket, p.id)
+				}
+				p.punch = punchInterval
+			}
+		case RouteDirect:
+			if p.punch <= 0 {
+				t.sendPunch(p.direct, natPunchPacket, p.id)
+				p.punch = natKeepAliveInterval
+			}
+		}
+	}
+}
+
+// SendTo sends data to a peer, directly or through the introducer depending
+// on its route. Data sent before hole punching completes is relayed.
+func (t *Traversal) SendTo(id uint64, data []byte) error {
+	if len(data) > MaxNATPayloadSize {
+		return fmt.Errorf("payload too large, %d bytes max", MaxNATPayloadSize)
+	}
+	p := t.peer(id)
+	if p == nil {
+		return fmt.Errorf("unknown peer %d", id)
+	}
+	if p.route == RouteDirect {
+		body := appendUint64(nil, t.id)
+		return sendProtocolPacket(t.transport, t.protocolID, p.direct, natDataPacket, append(body, data...))
+	}
+	body := appendUint64(nil, id)
+	return sendProtocolPacket(t.transport, t.protocolID, t.introducer, natRelayPacket, append(body, data...))
+}
+
+// Receive processes the received packets, copies the next payload sent by a
+// peer into data and returns its size and the peer id, or 0 if there is none.
+func (t *Traversal) Receive(data []byte) (int, uint64) {
+	for {
+		var (
+			sender net.UDPAddr
+			packet [natHeaderSize + 8 + MaxNATPayloadSize]byte
+		)
+		n := t.transport.Receive(&sender, packet[:])
+		if n == 0 {
+			return 0, 0
+		}
+		if !hasProtocolID(t.protocolID, packet[:n]) {
+			continue
+		}
+		body := packet[natHeaderSize:n]
+		switch packet[4] {
+		case natIntroducePacket:
+			t.processIntroduce(&sender, body)
+		case natPunchPacket, natPunchAckPacket:
+			t.processPunch(&sender, packet[4], body)
+		case natDataPacket:
+			if len(body) < 8 {
+				continue
+			}
+			p := t.peer(binary.BigEndian.Uint64(body))
+			if p == nil || !p.reachedFrom(&sender) {
+				continue
+			}
+			return copy(data, body[8:]), p.id
+		case natRelayPacket:
+			if len(body) < 8 || !sameAddress(&sender, t.introducer) {
+				continue
+			}
+			id := binary.BigEndian.Uint64(body)
+			if t.peer(id) == nil {
+				continue
+			}
+			return copy(data, body[8:]), id
+		}
+	}
+}
+
+// reachedFrom indicates if addr is one of the peer addresses. The peer may
+// have punched through before we did.
+func (p *remotePeer) reachedFrom(addr *net.UDPAddr) bool {
+	return sameAddress(addr, p.direct) || sameAddress(addr, p.public) || sameAddress(addr, p.private)
+}
+
+func (t *Traversal) peer(id uint64) *remotePeer {
+	for _, p := range t.peers {
+		if p.id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// sendRegister sends the session, the peer id and the private address to the
+// introducer. Registrations are padded like connection requests.
+func (t *Traversal) sendRegister() {
+	private := t.transport.LocalAddr()
+	if private == nil {
+		return
+	}
+	body := appendUint64(nil, t.session)
+	body = appendUint64(body, t.id)
+	body = appendAddress(body, private)
+	body = append(body, make([]byte, registerRequestSize-natHeaderSize-len(body))...)
+	if err := sendProtocolPacket(t.transport, t.protocolID, t.introducer, natRegisterPacket, body); err != nil {
+		fmt.Printf("couldn't register on introducer, %v\n", err)
+	}
+}
+
+// sendPunch sends a punch, or a punch answer, to a peer.
+func (t *Traversal) sendPunch(addr *net.UDPAddr, packetType byte, to uint64) {
+	body := appendUint64(nil, t.session)
+	body = appendUint64(body, t.id)
+	body = appendUint64(body, to)
+	sendProtocolPacket(t.transport, t.protocolID, addr, packetType, body)
+}
+
+// processIntroduce records our public address and the peers introduced by
+// the introducer. Peers we start to know are punched right away.
+func (t *Traversal) processIntroduce(sender *net.UDPAddr, body []byte) {
+	if !sameAddress(sender, t.introducer) || len(body) < addressSize+1 {
+		return
+	}
+	t.public = readAddress(body)
+	count := int(body[addressSize])
+	body = body[addressSize+1:]
+	if count > maxIntroductions || len(body) < count*introductionSize {
+		return
+	}
+	for i := 0; i < count; i++ {
+		intro := body[i*introductionSize:]
+		id := binary.BigEndian.Uint64(intro)
+		if id == t.id {
+			continue
+		}
+		public := readAddress(intro[8:])
+		private := readAddress(intro[8+addressSize:])
+		p := t.peer(id)
+		if p == nil {
+			fmt.Printf("introduced to peer %d at %v (private %v)\n", id, public.String(), private.String())
+			t.peers = append(t.peers, &remotePeer{id: id, public: public, private: private})
+			continue
+		}
+		if !sameAddress(p.public, public) || !sameAddress(p.private, private) {
+			// the peer moved, punch again
+			p.public, p.private = public, private
+			if p.route != RouteDirect {
+				p.route, p.age, p.punch = RoutePending, 0, 0
+			}
+		}
+	}
+}
+
+// processPunch answers the punches of the peers of the session, and switches
+// a peer to the direct route once it answers a punch.
+func (t *Traversal) processPunch(sender *net.UDPAddr, packetType byte, body []byte) {
+	if len(body) < 24 {
+		return
+	}
+	session := binary.BigEndian.Uint64(body)
+	from := binary.BigEndian.Uint64(body[8:])
+	to := binary.BigEndian.Uint64(body[16:])
+	if session != t.session || to != t.id || from == t.id {
+		return
+	}
+	p := t.peer(from)
+	if packetType == natPunchPacket {
+		t.sendPunch(sender, natPunchAckPacket, from)
+		if p != nil && p.route != RouteDirect {
+			// the peer NAT may map its packets to us on another port than the
+			// one the introducer saw, punch back to where the punch came from
+			t.sendPunch(sender, natPunchPacket, from)
+		}
+		return
+	}
+	if p == nil {
+		return
+	}
+	// the private address is preferred, peers behind the same NAT don't
+	// depend on it supporting hairpinning
+	if p.route != RouteDirect || (sameAddress(sender, p.private) && !sameAddress(p.direct, p.private)) {
+		fmt.Printf("punched through to peer %d at %v\n", from, sender.String())
+		p.route = RouteDirect
+		p.direct = copyAddr(sender)
+		p.punch = natKeepAliveInterval
+	}
+}
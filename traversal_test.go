@@ -0,0 +1,186 @@
+package udpnet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// updateTraversals updates an introducer and peers until done returns true,
+// sending payload to every known peer each iteration. It returns the number
+// of payloads each peer received.
+func updateTraversals(dt time.Duration, maxIterations int, done func() bool, payload []byte, in *Introducer, peers ...*Traversal) []int {
+	received := make([]int, len(peers))
+	for i := 0; i < maxIterations && !done(); i++ {
+		for _, p := range peers {
+			if payload == nil {
+				continue
+			}
+			for _, id := range p.Peers() {
+				p.SendTo(id, payload)
+			}
+		}
+		in.Update(dt)
+		for j, p := range peers {
+			for {
+				var data [256]byte
+				n, _ := p.Receive(data[:])
+				if n == 0 {
+					break
+				}
+				if payload != nil && string(data[:n]) == string(payload) {
+					received[j]++
+				}
+			}
+			p.Update(dt)
+		}
+	}
+	return received
+}
+
+func TestNATTraversal(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Second
+		Session   = 7
+	)
+	introducerAddr := &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 1000}
+
+	var tests = []struct {
+		a, b      NATType
+		sameNAT   bool
+		wantRoute Route
+	}{
+		{FullConeNAT, FullConeNAT, false, RouteDirect},
+		{RestrictedConeNAT, PortRestrictedNAT, false, RouteDirect},
+		{PortRestrictedNAT, PortRestrictedNAT, false, RouteDirect},
+		{SymmetricNAT, FullConeNAT, false, RouteDirect},
+		{PortRestrictedNAT, PortRestrictedNAT, true, RouteDirect},
+		{SymmetricNAT, PortRestrictedNAT, false, RouteRelay},
+		{SymmetricNAT, SymmetricNAT, false, RouteRelay},
+	}
+
+	for _, tt := range tests {
+		t.Logf("check traversal of %v and %v NATs, same NAT: %v\n", tt.a, tt.b, tt.sameNAT)
+		network := NewMemNetwork()
+		it, err := network.Listen(introducerAddr)
+		require.NoError(t, err)
+		in := NewIntroducer(protocolID, TimeOut, it)
+
+		natA, err := network.AddNAT(net.ParseIP("2.2.2.2"), tt.a)
+		require.NoError(t, err)
+		natB := natA
+		if !tt.sameNAT {
+			natB, err = network.AddNAT(net.ParseIP("3.3.3.3"), tt.b)
+			require.NoError(t, err)
+		}
+		privateA := &net.UDPAddr{IP: net.ParseIP("192.168.0.2"), Port: 5000}
+		privateB := &net.UDPAddr{IP: net.ParseIP("192.168.0.3"), Port: 5000}
+		ta, err := natA.Listen(privateA)
+		require.NoError(t, err)
+		tb, err := natB.Listen(privateB)
+		require.NoError(t, err)
+		a := NewTraversal(protocolID, ta, introducerAddr, Session, 1)
+		a.SetPunchTimeout(200 * time.Millisecond)
+		b := NewTraversal(protocolID, tb, introducerAddr, Session, 2)
+		b.SetPunchTimeout(200 * time.Millisecond)
+
+		settled := func() bool {
+			ra, oka := a.Route(2)
+			rb, okb := b.Route(1)
+			return oka && okb && ra != RoutePending && rb != RoutePending
+		}
+		updateTraversals(DeltaTime, 1000, settled, nil, in, a, b)
+		require.True(t, settled(), "routes should be settled")
+		assert.Equal(t, 2, in.Peers())
+		assert.Equal(t, "2.2.2.2", a.PublicAddr().IP.String())
+
+		ra, _ := a.Route(2)
+		rb, _ := b.Route(1)
+		assert.Equal(t, tt.wantRoute, ra)
+		assert.Equal(t, tt.wantRoute, rb)
+		if tt.sameNAT {
+			assert.Equal(t, privateB.String(), a.PeerAddr(2).String(), "peers behind the same NAT should use private addresses")
+			assert.Equal(t, privateA.String(), b.PeerAddr(1).String())
+		}
+
+		relayed, _ := in.Relayed()
+		received := updateTraversals(DeltaTime, 20, func() bool { return false }, clientPacket, in, a, b)
+		assert.True(t, received[0] > 0 && received[1] > 0, "peers should exchange packets")
+		relayedAfter, _ := in.Relayed()
+		if tt.wantRoute == RouteDirect {
+			assert.Equal(t, relayed, relayedAfter, "packets should not be relayed")
+		} else {
+			assert.True(t, relayedAfter > relayed, "packets should be relayed")
+		}
+	}
+}
+
+func TestIntroducerSessions(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(100) * time.Millisecond
+	)
+	introducerAddr := &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 1000}
+	network := NewMemNetwork()
+	it, err := network.Listen(introducerAddr)
+	require.NoError(t, err)
+	in := NewIntroducer(protocolID, TimeOut, it)
+
+	// 6 peers in session 1, introduced maxIntroductions at a time, 1 peer in
+	// session 2
+	var peers []*Traversal
+	for i := 0; i < 7; i++ {
+		addr := &net.UDPAddr{IP: net.ParseIP(fmt.Sprintf("10.0.0.%d", i+1)), Port: 5000}
+		tr, err := network.Listen(addr)
+		require.NoError(t, err)
+		session := uint64(1)
+		if i == 6 {
+			session = 2
+		}
+		peers = append(peers, NewTraversal(protocolID, tr, introducerAddr, session, uint64(i+1)))
+	}
+	updateTraversals(DeltaTime, 1000, func() bool {
+		for _, p := range peers[:6] {
+			if len(p.Peers()) < 5 {
+				return false
+			}
+		}
+		return true
+	}, nil, in, peers...)
+	assert.Equal(t, 7, in.Peers())
+	for _, p := range peers[:6] {
+		assert.Len(t, p.Peers(), 5, "peers should know the other peers of their session")
+		_, ok := p.Route(7)
+		assert.False(t, ok, "peers should not know peers of other sessions")
+	}
+	assert.Empty(t, peers[6].Peers())
+
+	t.Logf("check relaying to other sessions is refused\n")
+	require.NoError(t, sendProtocolPacket(peers[6].transport, protocolID, introducerAddr, natRelayPacket, appendUint64(nil, 1)))
+	in.Update(DeltaTime)
+	relayed, _ := in.Relayed()
+	assert.EqualValues(t, 0, relayed)
+
+	t.Logf("check undersized registrations are ignored\n")
+	stranger, err := network.Listen(&net.UDPAddr{IP: net.ParseIP("10.0.1.1"), Port: 5000})
+	require.NoError(t, err)
+	body := appendUint64(nil, 1)
+	body = appendUint64(body, 42)
+	body = appendAddress(body, stranger.LocalAddr())
+	require.NoError(t, sendProtocolPacket(stranger, protocolID, introducerAddr, natRegisterPacket, body))
+	in.Update(DeltaTime)
+	assert.Equal(t, 7, in.Peers())
+	data, _ := receiveFrom(stranger)
+	assert.Empty(t, data, "introducer should not answer")
+
+	t.Logf("check idle peers are forgotten\n")
+	for i := 0; i < 200; i++ {
+		in.Update(DeltaTime)
+	}
+	assert.Equal(t, 0, in.Peers())
+}
@@ -0,0 +1,82 @@
+package udpnet
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// size of the versions and features written at the start of connection
+// requests: minimum and maximum versions, then feature flags.
+const versionRequestSize = 2 + 2 + 4
+
+// negotiation is the protocol version and features agreed on by a client and
+// a server.
+type negotiation struct {
+	version  uint16
+	features uint32
+}
+
+// SetVersions sets the range of protocol versions supported by the
+// connection, 0 to 0 by default. A client sends its range in its connection
+// requests, a server accepts clients whose range overlaps its own and
+// negotiates the highest common version.
+func (c *Conn) SetVersions(min, max uint16) error {
+	if min > max {
+		return errors.New("minimum version is higher than maximum version")
+	}
+	c.minVersion = min
+	c.maxVersion = max
+	return nil
+}
+
+// Versions returns the range of protocol versions supported by the
+// connection.
+func (c *Conn) Versions() (min, max uint16) {
+	return c.minVersion, c.maxVersion
+}
+
+// SetFeatures sets the feature flags supported by the connection, the
+// negotiated features are the flags supported by both the client and the
+// server.
+func (c *Conn) SetFeatures(features uint32) {
+	c.features = features
+}
+
+// Features returns, on a connected client, the negotiated feature flags.
+func (c *Conn) Features() uint32 {
+	return c.negotiated.features
+}
+
+// Version returns, on a connected client, the negotiated protocol version.
+func (c *Conn) Version() uint16 {
+	return c.negotiated.version
+}
+
+func (c *Conn) appendVersions(buf []byte) []byte {
+	buf = appendUint16(buf, c.minVersion)
+	buf = appendUint16(buf, c.maxVersion)
+	return appendUint32(buf, c.features)
+}
+
+// negotiate returns the highest version supported by both the server and a
+// client sending the versions and features at the start of body.
+func (c *Conn) negotiate(body []byte) (negotiation, bool) {
+	if len(body) < versionRequestSize {
+		return negotiation{}, false
+	}
+	min := binary.BigEndian.Uint16(body)
+	max := binary.BigEndian.Uint16(body[2:])
+	if max > c.maxVersion {
+		max = c.maxVersion
+	}
+	if min < c.minVersion {
+		min = c.minVersion
+	}
+	if min > max {
+		return negotiation{}, false
+	}
+	return negotiation{
+		version:  max,
+		features: binary.BigEndian.Uint32(body[4:]) & c.features,
+	}, true
+}
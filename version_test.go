@@ -0,0 +1,79 @@
+package udpnet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionNegotiation(t *testing.T) {
+	const (
+		DeltaTime = time.Millisecond
+		TimeOut   = time.Duration(100) * time.Millisecond
+	)
+
+	sAddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", serverPort))
+
+	tests := []struct {
+		serverMin, serverMax uint16
+		clientMin, clientMax uint16
+		version              uint16
+		denied               bool
+	}{
+		{0, 0, 0, 0, 0, false},
+		{1, 3, 2, 5, 3, false},
+		{1, 3, 0, 1, 1, false},
+		{2, 4, 2, 2, 2, false},
+		{2, 4, 0, 1, 0, true},
+		{2, 4, 5, 6, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Logf("check versions %+v\n", tt)
+		server := NewConn(dummyCallback{}, protocolID, TimeOut)
+		server.SetHandshake(true)
+		require.NoError(t, server.SetVersions(tt.serverMin, tt.serverMax))
+		server.SetFeatures(0x0F)
+		require.True(t, server.Start(serverPort), "couldn't start server connection")
+		server.Listen()
+
+		client := NewConn(dummyCallback{}, protocolID, TimeOut)
+		client.SetHandshake(true)
+		require.NoError(t, client.SetVersions(tt.clientMin, tt.clientMax))
+		client.SetFeatures(0x3C)
+		require.True(t, client.Start(clientPort), "couldn't start client connection")
+		client.Connect(sAddr)
+
+		updateConns(DeltaTime, 1000, func() bool {
+			return !client.IsConnecting()
+		}, nil, client, server)
+
+		if tt.denied {
+			assert.True(t, client.ConnectFailed(), "client.ConnectFailed() should return true")
+			assert.Equal(t, DenyVersionMismatch, client.DenyReason())
+			assert.False(t, server.IsConnected(), "server should not be connected")
+		} else {
+			require.True(t, client.IsConnected(), "client should be connected")
+			assert.Equal(t, tt.version, client.Version())
+			assert.EqualValues(t, 0x0C, client.Features())
+			peer, ok := server.PeerBySlot(0)
+			require.True(t, ok)
+			assert.Equal(t, tt.version, peer.Version)
+			assert.EqualValues(t, 0x0C, peer.Features)
+		}
+		client.Stop()
+		server.Stop()
+	}
+
+	t.Logf("check invalid version range\n")
+	c := NewConn(dummyCallback{}, protocolID, TimeOut)
+	c.SetHandshake(true)
+	assert.Error(t, c.SetVersions(2, 1))
+	min, max := c.Versions()
+	assert.EqualValues(t, 0, min)
+	assert.EqualValues(t, 0, max)
+}